@@ -0,0 +1,155 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsubasa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/eval"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+)
+
+func newEvalCommand() *cobra.Command {
+	var templatePath string
+	var comparePath string
+	var perQuery bool
+	var asJson bool
+	options := eval.DefaultOptions
+
+	cmd := &cobra.Command{
+		Use:   "eval <judgments.json>",
+		Short: "Evaluates the relevance of a search template against a judgment list.",
+		Long: `Runs every query of the judgment list (a JSON object of queries to document IDs to
+grades) with the search template, and reports the NDCG, precision and MRR of the
+top hits. With --compare, a second template is evaluated and compared side by side.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if templatePath == "" {
+				return errors.New("a search template is required with --template")
+			}
+
+			judgments, err := eval.LoadJudgments(args[0])
+			if err != nil {
+				return err
+			}
+
+			templates := []string{templatePath}
+			if comparePath != "" {
+				templates = append(templates, comparePath)
+			}
+
+			// Evaluations aren't searches of users, so they aren't recorded.
+			config := loadConfig(configPath())
+			config.Analytics = nil
+			config.SlowQueries = nil
+
+			es, err := internal.NewElasticClient(config)
+			if err != nil {
+				return err
+			}
+
+			reports := make([]*eval.Report, 0, len(templates))
+			for _, path := range templates {
+				template, err := eval.LoadTemplate(path)
+				if err != nil {
+					return err
+				}
+
+				report, err := es.Evaluate(context.Background(), template, judgments, options)
+				if err != nil {
+					return fmt.Errorf("unable to evaluate %s: %v", path, err)
+				}
+
+				reports = append(reports, report)
+			}
+
+			if len(reports) == 1 {
+				if asJson {
+					return printJson(reports[0])
+				}
+
+				return printReport(reports[0], perQuery)
+			}
+
+			comparison := eval.Compare(reports[0], reports[1])
+			if asJson {
+				return printJson(comparison)
+			}
+
+			return printComparison(comparison, perQuery)
+		},
+	}
+
+	cmd.Flags().StringVarP(&templatePath, "template", "t", "", "The search template to evaluate, a JSON file with the index and the body to search.")
+	cmd.Flags().StringVar(&comparePath, "compare", "", "A second search template to compare with the first one.")
+	cmd.Flags().IntVarP(&options.K, "k", "k", options.K, "The number of top hits that the metrics are computed from.")
+	cmd.Flags().IntVar(&options.RelevantGrade, "relevant-grade", options.RelevantGrade, "The lowest grade of a relevant document.")
+	cmd.Flags().BoolVar(&options.RankEval, "rank-eval", false, "Evaluates with the _rank_eval API of Elasticsearch, rather than running every search.")
+	cmd.Flags().BoolVar(&perQuery, "per-query", false, "Prints the metrics of every query.")
+	cmd.Flags().BoolVar(&asJson, "json", false, "Prints the report as JSON.")
+
+	return cmd
+}
+
+func printJson(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func printReport(report *eval.Report, perQuery bool) error {
+	fmt.Printf("> Evaluated %d queries of '%s' on index '%s' at k=%d\n\n", len(report.Queries), report.Name, report.Index, report.Options.K)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tSCORE")
+	fmt.Fprintf(w, "ndcg@%d\t%.4f\n", report.Options.K, report.NDCG)
+	fmt.Fprintf(w, "precision@%d\t%.4f\n", report.Options.K, report.Precision)
+	fmt.Fprintf(w, "mrr@%d\t%.4f\n", report.Options.K, report.MRR)
+
+	if perQuery {
+		fmt.Fprintln(w, "\nQUERY\tNDCG\tPRECISION\tMRR\tUNRATED")
+		for _, query := range report.Queries {
+			fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%.4f\t%d\n", query.Query, query.NDCG, query.Precision, query.MRR, query.Unrated)
+		}
+	}
+
+	return w.Flush()
+}
+
+func printComparison(comparison *eval.Comparison, perQuery bool) error {
+	baseline, candidate := comparison.Baseline, comparison.Candidate
+	fmt.Printf("> Compared '%s' (baseline) with '%s' (candidate) on %d queries at k=%d\n\n", baseline.Name, candidate.Name, len(baseline.Queries), baseline.Options.K)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tBASELINE\tCANDIDATE\tDELTA")
+	fmt.Fprintf(w, "ndcg@%d\t%.4f\t%.4f\t%+.4f\n", baseline.Options.K, baseline.NDCG, candidate.NDCG, comparison.Delta.NDCG)
+	fmt.Fprintf(w, "precision@%d\t%.4f\t%.4f\t%+.4f\n", baseline.Options.K, baseline.Precision, candidate.Precision, comparison.Delta.Precision)
+	fmt.Fprintf(w, "mrr@%d\t%.4f\t%.4f\t%+.4f\n", baseline.Options.K, baseline.MRR, candidate.MRR, comparison.Delta.MRR)
+
+	if perQuery {
+		fmt.Fprintln(w, "\nQUERY\tBASELINE NDCG\tCANDIDATE NDCG\tDELTA")
+		for _, query := range comparison.Queries {
+			fmt.Fprintf(w, "%s\t%.4f\t%.4f\t%+.4f\n", query.Query, query.Baseline.NDCG, query.Candidate.NDCG, query.Delta.NDCG)
+		}
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,191 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsubasa
+
+import (
+	"encoding/json"
+	"errors"
+	"floofy.dev/tsubasa/internal/auth"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func newKeysCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys [COMMAND]",
+		Short: "Manages the API keys that are stored under `auth.api_keys_path`.",
+	}
+
+	cmd.AddCommand(newKeysCreateCommand(), newKeysListCommand(), newKeysRevokeCommand(), newKeysMintTokenCommand())
+	return cmd
+}
+
+func openAPIKeyStore() (*auth.APIKeyStore, error) {
+	config := loadConfig(configPath())
+	if config.Auth.APIKeysPath == nil {
+		return nil, errors.New("API keys are not enabled, set `auth.api_keys_path` in the configuration file")
+	}
+
+	return auth.NewAPIKeyStore(*config.Auth.APIKeysPath)
+}
+
+func newKeysCreateCommand() *cobra.Command {
+	var name string
+	var scopes []string
+	var rawFilters []string
+
+	cmd := &cobra.Command{
+		Use:   "create",
+		Short: "Creates a new API key and prints its token.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAPIKeyStore()
+			if err != nil {
+				return err
+			}
+
+			filters := make([]map[string]interface{}, 0, len(rawFilters))
+			for _, raw := range rawFilters {
+				var filter map[string]interface{}
+				if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+					return fmt.Errorf("filter %q is not a JSON object: %v", raw, err)
+				}
+
+				filters = append(filters, filter)
+			}
+
+			key, token, err := store.Create(name, scopes, filters)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("> Created API key '%s' (%s) with scopes [%s]\n", key.Name, key.ID, strings.Join(key.Scopes, ", "))
+			fmt.Printf("> Token (this is only shown once!): %s\n", token)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&name, "name", "n", "", "The name of the API key.")
+	cmd.Flags().StringArrayVarP(&scopes, "scope", "s", []string{}, "A scope to grant, i.e. `search:products`, `write:orders`, `role:support` or `admin`. Can be repeated.")
+	cmd.Flags().StringArrayVarP(&rawFilters, "filter", "f", []string{}, "A query that every search with the key is filtered with, i.e. `{\"term\":{\"tenant_id\":42}}`. Can be repeated.")
+	_ = cmd.MarkFlagRequired("name")
+
+	return cmd
+}
+
+func newKeysListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "Lists every API key.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAPIKeyStore()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED AT")
+
+			for _, key := range store.List() {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339))
+			}
+
+			return w.Flush()
+		},
+	}
+}
+
+func newKeysRevokeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <id>",
+		Short: "Revokes the API key with the id.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openAPIKeyStore()
+			if err != nil {
+				return err
+			}
+
+			if err := store.Revoke(args[0]); err != nil {
+				return err
+			}
+
+			fmt.Printf("> Revoked API key %s\n", args[0])
+			return nil
+		},
+	}
+}
+
+func newKeysMintTokenCommand() *cobra.Command {
+	var key string
+	var indices []string
+	var rawFilters []string
+	var ttl time.Duration
+	var rateLimit int
+
+	cmd := &cobra.Command{
+		Use:   "mint-token",
+		Short: "Mints a search token that is signed by an API key, this doesn't need the configuration file.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if key == "" {
+				key = os.Getenv("TSUBASA_API_KEY")
+			}
+
+			if key == "" {
+				return errors.New("the parent API key is required, use `--key` or the `TSUBASA_API_KEY` environment variable")
+			}
+
+			filters := make([]map[string]interface{}, 0, len(rawFilters))
+			for _, raw := range rawFilters {
+				var filter map[string]interface{}
+				if err := json.Unmarshal([]byte(raw), &filter); err != nil {
+					return fmt.Errorf("filter %q is not a JSON object: %v", raw, err)
+				}
+
+				filters = append(filters, filter)
+			}
+
+			expiresAt := time.Now().Add(ttl)
+			token, err := auth.MintSearchToken(key, auth.SearchTokenClaims{
+				Indices:   indices,
+				Filters:   filters,
+				ExpiresAt: expiresAt.Unix(),
+				RateLimit: rateLimit,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "> Search token expires at %s\n", expiresAt.Format(time.RFC3339))
+			fmt.Println(token)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&key, "key", "k", "", "The parent API key token (`tsb_...`), defaults to the `TSUBASA_API_KEY` environment variable.")
+	cmd.Flags().StringArrayVarP(&indices, "index", "i", []string{}, "An index pattern that the token can search. Can be repeated.")
+	cmd.Flags().StringArrayVarP(&rawFilters, "filter", "f", []string{}, "A query that every search with the token is filtered with. Can be repeated.")
+	cmd.Flags().DurationVarP(&ttl, "ttl", "t", time.Hour, "How long the token is valid for.")
+	cmd.Flags().IntVarP(&rateLimit, "rate-limit", "r", 0, "How many requests per minute can be made with the token, 0 for no limit of its own.")
+
+	return cmd
+}
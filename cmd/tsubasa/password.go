@@ -0,0 +1,60 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsubasa
+
+import (
+	"bufio"
+	"errors"
+	"floofy.dev/tsubasa/internal/auth"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+func newHashPasswordCommand() *cobra.Command {
+	var algorithm string
+
+	cmd := &cobra.Command{
+		Use:   "hash-password",
+		Short: "Hashes a password from stdin for the `password` configuration field.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fmt.Fprint(os.Stderr, "> Password: ")
+
+			password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && password == "" {
+				return err
+			}
+
+			password = strings.TrimRight(password, "\r\n")
+			if password == "" {
+				return errors.New("password can't be empty")
+			}
+
+			hash, err := auth.HashPassword(password, algorithm)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(os.Stderr)
+			fmt.Println(hash)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&algorithm, "algorithm", "a", "argon2id", "The hash algorithm to use, `argon2id` or `bcrypt`.")
+	return cmd
+}
@@ -18,8 +18,10 @@ package tsubasa
 import (
 	"floofy.dev/tsubasa/internal"
 	"floofy.dev/tsubasa/server"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"os"
 	"time"
 )
 
@@ -41,6 +43,10 @@ a good application without bringing the Elastic SDK into your application.
 	rootCmd.PersistentFlags().StringP("config", "c", "", "The configuration file to bootstrap the server.")
 	verbose = rootCmd.PersistentFlags().BoolP("verbose", "v", false, "If verbose mode should be enabled (overrides `config.debug`)")
 	rootCmd.AddCommand(newGenerateCommand())
+	rootCmd.AddCommand(newSchemaCommand())
+	rootCmd.AddCommand(newKeysCommand())
+	rootCmd.AddCommand(newHashPasswordCommand())
+	rootCmd.AddCommand(newEvalCommand())
 }
 
 func Execute() int {
@@ -52,20 +58,31 @@ func Execute() int {
 }
 
 func runServer(_ *cobra.Command, _ []string) error {
-	configPath := rootCmd.Flag("config").Value.String()
-
-	var path *string = nil
-	if configPath != "" {
-		path = &configPath
-	}
-
+	path := configPath()
 	if verbose != nil && *verbose == true {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	logrus.SetFormatter(internal.NewFormatter())
+	formatter := internal.NewFormatter()
+	logrus.SetFormatter(formatter)
 	logrus.SetReportCaller(true)
 
+	if name := os.Getenv("TSUBASA_LOG_FORMAT"); name != "" {
+		if _, err := internal.ParseLogFormat(name); err != nil {
+			return fmt.Errorf("invalid `TSUBASA_LOG_FORMAT`: %v", err)
+		}
+	}
+
+	config := loadConfig(path)
+	if config.LogFormat != nil && os.Getenv("TSUBASA_LOG_FORMAT") == "" {
+		output, err := internal.ParseLogFormat(*config.LogFormat)
+		if err != nil {
+			return fmt.Errorf("invalid `log_format`: %v", err)
+		}
+
+		formatter.Output = output
+	}
+
 	buildDate, _ := time.Parse(time.RFC3339, internal.BuildDate)
 
 	logrus.Infof("Running Tsubasa v%s (commit: %s | build date: %s)",
@@ -74,6 +91,11 @@ func runServer(_ *cobra.Command, _ []string) error {
 		buildDate.Format(time.RFC1123),
 	)
 
+	return server.Start(config)
+}
+
+// loadConfig loads the configuration from the path, or finds it if the path is nil.
+func loadConfig(path *string) *internal.Config {
 	var config *internal.Config
 	if path == nil {
 		c, err := internal.FindAndNewConfig()
@@ -91,5 +113,15 @@ func runServer(_ *cobra.Command, _ []string) error {
 		config = c
 	}
 
-	return server.Start(config)
+	return config
+}
+
+// configPath returns the path from the `--config` flag, if it was defined.
+func configPath() *string {
+	configPath := rootCmd.Flag("config").Value.String()
+	if configPath == "" {
+		return nil
+	}
+
+	return &configPath
 }
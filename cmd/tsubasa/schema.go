@@ -0,0 +1,80 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsubasa
+
+import (
+	"floofy.dev/tsubasa/internal/schema"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func newSchemaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "schema [COMMAND]",
+		Short: "Commands to manage index schemas.",
+	}
+
+	cmd.AddCommand(newSchemaInferCommand())
+	return cmd
+}
+
+func newSchemaInferCommand() *cobra.Command {
+	var index string
+	var sampleSize int
+	var keywordRatio float64
+
+	cmd := &cobra.Command{
+		Use:   "infer <file.jsonl>",
+		Short: "Proposes an index schema from sample documents in a newline-delimited JSON file.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+
+			defer file.Close()
+
+			proposal, sampled, err := schema.Infer(file, schema.InferOptions{
+				SampleSize:   sampleSize,
+				KeywordRatio: keywordRatio,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if index == "" {
+				base := filepath.Base(args[0])
+				index = strings.TrimSuffix(base, filepath.Ext(base))
+			}
+
+			fmt.Printf("# Proposed schema for index '%s' from %d sampled documents.\n", index, sampled)
+			fmt.Print(proposal.Encode(index))
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&index, "index", "i", "", "The index name to use in the proposal, defaults to the file name.")
+	cmd.Flags().IntVarP(&sampleSize, "sample-size", "n", 1000, "The maximum amount of documents to sample, 0 samples every document.")
+	cmd.Flags().Float64Var(&keywordRatio, "keyword-ratio", 0.5, "The maximum ratio of distinct values for free text to be a `keyword` field.")
+
+	return cmd
+}
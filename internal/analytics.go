@@ -0,0 +1,600 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"floofy.dev/tsubasa/internal/analytics"
+	"floofy.dev/tsubasa/internal/slowlog"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// analyticsMapping is the mapping of the analytics index. Filters are only kept,
+// not indexed, since every search can have different ones.
+var analyticsMapping = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"@timestamp":  map[string]interface{}{"type": "date"},
+		"query_id":    map[string]interface{}{"type": "keyword"},
+		"index":       map[string]interface{}{"type": "keyword"},
+		"key":         map[string]interface{}{"type": "keyword"},
+		"query":       map[string]interface{}{"type": "keyword"},
+		"fingerprint": map[string]interface{}{"type": "keyword"},
+		"filters":     map[string]interface{}{"type": "object", "enabled": false},
+		"total_hits":  map[string]interface{}{"type": "long"},
+		"latency_ms":  map[string]interface{}{"type": "float"},
+		"user_id":     map[string]interface{}{"type": "keyword"},
+		"session_id":  map[string]interface{}{"type": "keyword"},
+		"request_id":  map[string]interface{}{"type": "keyword"},
+
+		"clicks":               map[string]interface{}{"type": "long"},
+		"conversions":          map[string]interface{}{"type": "long"},
+		"first_click_position": map[string]interface{}{"type": "integer"},
+		"reciprocal_rank":      map[string]interface{}{"type": "float"},
+		"clicked_documents":    map[string]interface{}{"type": "keyword"},
+		"converted_documents":  map[string]interface{}{"type": "keyword"},
+	},
+}
+
+// feedbackScript applies feedback to an event like analytics.Event.Apply does.
+const feedbackScript = `
+if (params.type == 'click') {
+  ctx._source.clicks = (ctx._source.clicks == null ? 0 : ctx._source.clicks) + 1;
+  if (ctx._source.clicked_documents == null) { ctx._source.clicked_documents = []; }
+  ctx._source.clicked_documents.add(params.document_id);
+  if (ctx._source.first_click_position == null || ctx._source.first_click_position == 0 || params.position < ctx._source.first_click_position) {
+    ctx._source.first_click_position = params.position;
+    ctx._source.reciprocal_rank = 1.0 / params.position;
+  }
+} else {
+  ctx._source.conversions = (ctx._source.conversions == null ? 0 : ctx._source.conversions) + 1;
+  if (ctx._source.converted_documents == null) { ctx._source.converted_documents = []; }
+  ctx._source.converted_documents.add(params.document_id);
+}`
+
+// maxFeedbackWait is how long feedback waits for the event of its search to be
+// written, before it is looked up anyway.
+const maxFeedbackWait = 5 * time.Second
+
+// elasticAnalyticsStore records search events into an Elasticsearch index, and
+// computes the stats with aggregations. Events are written in the background, and
+// dropped if Elasticsearch can't keep up, so searches are never slowed down.
+type elasticAnalyticsStore struct {
+	es     *ElasticService
+	index  string
+	events chan analytics.Event
+	wg     sync.WaitGroup
+
+	// pending are closed once the event of their query ID is written.
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+}
+
+func newElasticAnalyticsStore(es *ElasticService, index string) (*elasticAnalyticsStore, error) {
+	res, err := es.client.Indices.Exists([]string{index})
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body.Close()
+	if res.StatusCode == 404 {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"mappings": analyticsMapping}); err != nil {
+			return nil, err
+		}
+
+		res, err := es.client.Indices.Create(index, es.client.Indices.Create.WithBody(&buf))
+		if err != nil {
+			return nil, err
+		}
+
+		defer res.Body.Close()
+		if res.IsError() {
+			return nil, fmt.Errorf("unable to create analytics index %s: %s", index, res.String())
+		}
+	} else {
+		// The mapping is updated, so fields that were added since the index was
+		// created aren't mapped dynamically (i.e. `reciprocal_rank` as a long).
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(analyticsMapping); err != nil {
+			return nil, err
+		}
+
+		res, err := es.client.Indices.PutMapping([]string{index}, &buf)
+		if err != nil {
+			return nil, err
+		}
+
+		defer res.Body.Close()
+		if res.IsError() {
+			return nil, fmt.Errorf("unable to update mapping of analytics index %s: %s", index, res.String())
+		}
+	}
+
+	s := &elasticAnalyticsStore{
+		es:      es,
+		index:   index,
+		events:  make(chan analytics.Event, 1024),
+		pending: map[string]chan struct{}{},
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+func (s *elasticAnalyticsStore) Record(event analytics.Event) {
+	s.mu.Lock()
+	s.pending[event.QueryID] = make(chan struct{})
+	s.mu.Unlock()
+
+	select {
+	case s.events <- event:
+	default:
+		s.written(event.QueryID)
+		logrus.Warnf("Dropping search event for index %s, the analytics index can't keep up", event.Index)
+	}
+}
+
+// written marks the event of the query ID as written (or dropped), which releases
+// the feedback that is waiting for it.
+func (s *elasticAnalyticsStore) written(queryID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pending, ok := s.pending[queryID]; ok {
+		close(pending)
+		delete(s.pending, queryID)
+	}
+}
+
+func (s *elasticAnalyticsStore) run() {
+	defer s.wg.Done()
+	for event := range s.events {
+		if err := s.write(event); err != nil {
+			logrus.Errorf("Unable to record search event for index %s: %v", event.Index, err)
+		}
+
+		s.written(event.QueryID)
+	}
+}
+
+func (s *elasticAnalyticsStore) write(event analytics.Event) error {
+	doc := struct {
+		analytics.Event
+		Key string `json:"key"`
+	}{event, event.Key()}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+		return err
+	}
+
+	// The query ID is the document ID, so feedback can update the event.
+	res, err := s.es.client.Index(s.index, &buf,
+		s.es.client.Index.WithContext(context.Background()),
+		s.es.client.Index.WithDocumentID(event.QueryID))
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	return nil
+}
+
+// waitForWrite waits until the event of the query ID is written, if it is still
+// queued, so the feedback that is given right after a search can find its event.
+func (s *elasticAnalyticsStore) waitForWrite(ctx context.Context, queryID string) error {
+	s.mu.Lock()
+	pending := s.pending[queryID]
+	s.mu.Unlock()
+
+	if pending == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(maxFeedbackWait)
+	defer timer.Stop()
+
+	select {
+	case <-pending:
+	case <-timer.C:
+		logrus.Warnf("Event of query %s wasn't written after %s", queryID, maxFeedbackWait)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+func (s *elasticAnalyticsStore) Event(ctx context.Context, queryID string) (*analytics.Event, error) {
+	if err := s.waitForWrite(ctx, queryID); err != nil {
+		return nil, err
+	}
+
+	res, err := s.es.client.Get(s.index, queryID, s.es.client.Get.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, analytics.ErrUnknownQuery
+	}
+
+	if res.IsError() {
+		return nil, fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	var doc struct {
+		Source analytics.Event `json:"_source"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return &doc.Source, nil
+}
+
+// RecordFeedback updates the event with a script, so concurrent feedback on the
+// same search isn't lost.
+func (s *elasticAnalyticsStore) RecordFeedback(ctx context.Context, feedback analytics.Feedback) error {
+	if err := s.waitForWrite(ctx, feedback.QueryID); err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": feedbackScript,
+			"lang":   "painless",
+			"params": map[string]interface{}{
+				"type":        string(feedback.Type),
+				"document_id": feedback.DocumentID,
+				"position":    feedback.Position,
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	res, err := s.es.client.Update(s.index, feedback.QueryID, &buf,
+		s.es.client.Update.WithContext(ctx),
+		s.es.client.Update.WithRetryOnConflict(3))
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return analytics.ErrUnknownQuery
+	}
+
+	if res.IsError() {
+		return fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	return nil
+}
+
+func (s *elasticAnalyticsStore) Close() error {
+	close(s.events)
+	s.wg.Wait()
+
+	return nil
+}
+
+// search runs an aggregation over the events that match the filter, and decodes
+// the aggregations into the result.
+func (s *elasticAnalyticsStore) search(ctx context.Context, filter analytics.Filter, extra []interface{}, aggs map[string]interface{}, result interface{}) error {
+	filters := []interface{}{
+		map[string]interface{}{"range": map[string]interface{}{"@timestamp": map[string]interface{}{"gte": filter.Since.Format(time.RFC3339Nano)}}},
+	}
+
+	if filter.Index != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"index": filter.Index}})
+	}
+
+	body := map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": append(filters, extra...)}},
+		"aggs":  aggs,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+
+	res, err := s.es.client.Search(
+		s.es.client.Search.WithIndex(s.index),
+		s.es.client.Search.WithContext(ctx),
+		s.es.client.Search.WithBody(&buf))
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	var data struct {
+		Aggregations json.RawMessage `json:"aggregations"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data.Aggregations, result)
+}
+
+type valueAggregation struct {
+	Value *float64 `json:"value"`
+}
+
+func (v valueAggregation) float() float64 {
+	if v.Value == nil {
+		return 0
+	}
+
+	return *v.Value
+}
+
+func (s *elasticAnalyticsStore) TopQueries(ctx context.Context, filter analytics.Filter, limit int) ([]analytics.QueryStats, error) {
+	return s.queries(ctx, filter, limit, nil)
+}
+
+func (s *elasticAnalyticsStore) ZeroResultQueries(ctx context.Context, filter analytics.Filter, limit int) ([]analytics.QueryStats, error) {
+	zero := map[string]interface{}{"term": map[string]interface{}{"total_hits": 0}}
+	return s.queries(ctx, filter, limit, []interface{}{zero})
+}
+
+func (s *elasticAnalyticsStore) queries(ctx context.Context, filter analytics.Filter, limit int, extra []interface{}) ([]analytics.QueryStats, error) {
+	aggs := map[string]interface{}{
+		"queries": map[string]interface{}{
+			"terms": map[string]interface{}{"field": "key", "size": limit},
+			"aggs": map[string]interface{}{
+				"zero_results": map[string]interface{}{"filter": map[string]interface{}{"term": map[string]interface{}{"total_hits": 0}}},
+				"hits":         map[string]interface{}{"avg": map[string]interface{}{"field": "total_hits"}},
+				"latency":      map[string]interface{}{"avg": map[string]interface{}{"field": "latency_ms"}},
+				"last_seen":    map[string]interface{}{"max": map[string]interface{}{"field": "@timestamp"}},
+				"clicks":       map[string]interface{}{"sum": map[string]interface{}{"field": "clicks"}},
+				"conversions":  map[string]interface{}{"sum": map[string]interface{}{"field": "conversions"}},
+				"clicked":      map[string]interface{}{"filter": map[string]interface{}{"range": map[string]interface{}{"clicks": map[string]interface{}{"gt": 0}}}},
+				"converted":    map[string]interface{}{"filter": map[string]interface{}{"range": map[string]interface{}{"conversions": map[string]interface{}{"gt": 0}}}},
+				"reciprocal":   map[string]interface{}{"avg": map[string]interface{}{"field": "reciprocal_rank", "missing": 0}},
+				"sample": map[string]interface{}{"top_hits": map[string]interface{}{
+					"size":    1,
+					"_source": []string{"query", "fingerprint"},
+				}},
+			},
+		},
+	}
+
+	var result struct {
+		Queries struct {
+			Buckets []struct {
+				DocCount    int64 `json:"doc_count"`
+				ZeroResults struct {
+					DocCount int64 `json:"doc_count"`
+				} `json:"zero_results"`
+				Hits        valueAggregation `json:"hits"`
+				Latency     valueAggregation `json:"latency"`
+				LastSeen    valueAggregation `json:"last_seen"`
+				Clicks      valueAggregation `json:"clicks"`
+				Conversions valueAggregation `json:"conversions"`
+				Clicked     struct {
+					DocCount int64 `json:"doc_count"`
+				} `json:"clicked"`
+				Converted struct {
+					DocCount int64 `json:"doc_count"`
+				} `json:"converted"`
+				Reciprocal valueAggregation `json:"reciprocal"`
+				Sample     struct {
+					Hits struct {
+						Hits []struct {
+							Source analytics.Event `json:"_source"`
+						} `json:"hits"`
+					} `json:"hits"`
+				} `json:"sample"`
+			} `json:"buckets"`
+		} `json:"queries"`
+	}
+
+	if err := s.search(ctx, filter, extra, aggs, &result); err != nil {
+		return nil, err
+	}
+
+	queries := make([]analytics.QueryStats, 0, len(result.Queries.Buckets))
+	for _, bucket := range result.Queries.Buckets {
+		stats := analytics.QueryStats{
+			Searches:           bucket.DocCount,
+			ZeroResults:        bucket.ZeroResults.DocCount,
+			AverageHits:        bucket.Hits.float(),
+			AverageLatencyMs:   bucket.Latency.float(),
+			Clicks:             int64(bucket.Clicks.float()),
+			Conversions:        int64(bucket.Conversions.float()),
+			ClickThroughRate:   float64(bucket.Clicked.DocCount) / float64(bucket.DocCount),
+			ConversionRate:     float64(bucket.Converted.DocCount) / float64(bucket.DocCount),
+			MeanReciprocalRank: bucket.Reciprocal.float(),
+			LastSeen:           time.UnixMilli(int64(bucket.LastSeen.float())).UTC(),
+		}
+
+		if len(bucket.Sample.Hits.Hits) > 0 {
+			stats.Query = bucket.Sample.Hits.Hits[0].Source.Query
+			stats.Fingerprint = bucket.Sample.Hits.Hits[0].Source.Fingerprint
+		}
+
+		queries = append(queries, stats)
+	}
+
+	return queries, nil
+}
+
+func (s *elasticAnalyticsStore) Indices(ctx context.Context, filter analytics.Filter) ([]analytics.IndexStats, error) {
+	aggs := map[string]interface{}{
+		"indices": map[string]interface{}{
+			"terms": map[string]interface{}{"field": "index", "size": 1000, "order": map[string]interface{}{"_key": "asc"}},
+			"aggs": map[string]interface{}{
+				"zero_results": map[string]interface{}{"filter": map[string]interface{}{"term": map[string]interface{}{"total_hits": 0}}},
+				"latency":      map[string]interface{}{"avg": map[string]interface{}{"field": "latency_ms"}},
+				"max_latency":  map[string]interface{}{"max": map[string]interface{}{"field": "latency_ms"}},
+			},
+		},
+	}
+
+	var result struct {
+		Indices struct {
+			Buckets []struct {
+				Key         string `json:"key"`
+				DocCount    int64  `json:"doc_count"`
+				ZeroResults struct {
+					DocCount int64 `json:"doc_count"`
+				} `json:"zero_results"`
+				Latency    valueAggregation `json:"latency"`
+				MaxLatency valueAggregation `json:"max_latency"`
+			} `json:"buckets"`
+		} `json:"indices"`
+	}
+
+	if err := s.search(ctx, filter, nil, aggs, &result); err != nil {
+		return nil, err
+	}
+
+	indices := make([]analytics.IndexStats, 0, len(result.Indices.Buckets))
+	for _, bucket := range result.Indices.Buckets {
+		indices = append(indices, analytics.IndexStats{
+			Index:            bucket.Key,
+			Searches:         bucket.DocCount,
+			ZeroResults:      bucket.ZeroResults.DocCount,
+			AverageLatencyMs: bucket.Latency.float(),
+			MaxLatencyMs:     bucket.MaxLatency.float(),
+		})
+	}
+
+	return indices, nil
+}
+
+func (s *elasticAnalyticsStore) Trends(ctx context.Context, filter analytics.Filter, interval time.Duration) ([]analytics.Bucket, error) {
+	aggs := map[string]interface{}{
+		"trends": map[string]interface{}{
+			"date_histogram": map[string]interface{}{
+				"field":          "@timestamp",
+				"fixed_interval": fmt.Sprintf("%ds", int64(interval.Seconds())),
+				"min_doc_count":  1,
+			},
+			"aggs": map[string]interface{}{
+				"zero_results": map[string]interface{}{"filter": map[string]interface{}{"term": map[string]interface{}{"total_hits": 0}}},
+				"latency":      map[string]interface{}{"avg": map[string]interface{}{"field": "latency_ms"}},
+			},
+		},
+	}
+
+	var result struct {
+		Trends struct {
+			Buckets []struct {
+				Key         int64 `json:"key"`
+				DocCount    int64 `json:"doc_count"`
+				ZeroResults struct {
+					DocCount int64 `json:"doc_count"`
+				} `json:"zero_results"`
+				Latency valueAggregation `json:"latency"`
+			} `json:"buckets"`
+		} `json:"trends"`
+	}
+
+	if err := s.search(ctx, filter, nil, aggs, &result); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]analytics.Bucket, 0, len(result.Trends.Buckets))
+	for _, bucket := range result.Trends.Buckets {
+		buckets = append(buckets, analytics.Bucket{
+			Time:             time.UnixMilli(bucket.Key).UTC(),
+			Searches:         bucket.DocCount,
+			ZeroResults:      bucket.ZeroResults.DocCount,
+			AverageLatencyMs: bucket.Latency.float(),
+		})
+	}
+
+	return buckets, nil
+}
+
+// newAnalyticsStore creates the analytics store from the `[analytics]` table.
+func newAnalyticsStore(config *AnalyticsConfig, es *ElasticService) (analytics.Store, error) {
+	if config.Index != nil {
+		logrus.Infof("Search analytics are enabled, recording them into index %s", *config.Index)
+		return newElasticAnalyticsStore(es, *config.Index)
+	}
+
+	retention := 7 * 24 * time.Hour
+	if config.Retention != nil {
+		var err error
+		retention, err = time.ParseDuration(*config.Retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `analytics.retention` %q: %v", *config.Retention, err)
+		}
+	}
+
+	maxEvents := 100000
+	if config.MaxEvents != nil {
+		maxEvents = *config.MaxEvents
+	}
+
+	logrus.Infof("Search analytics are enabled, keeping them in memory for %s", retention)
+	return analytics.NewMemoryStore(retention, maxEvents), nil
+}
+
+// recordSearch records the search into the analytics store, and returns the query
+// ID that feedback on its results is given with.
+func (es *ElasticService) recordSearch(ctx context.Context, index string, query map[string]interface{}, totalHits float64, elapsed time.Duration) string {
+	_, fingerprint := slowlog.Fingerprint(query)
+	visitor := analytics.VisitorFromContext(ctx)
+	queryID := analytics.NewQueryID()
+
+	es.Analytics.Record(analytics.Event{
+		Time:        time.Now().UTC(),
+		QueryID:     queryID,
+		Index:       index,
+		Query:       analytics.QueryText(query),
+		Fingerprint: fingerprint,
+		Filters:     analytics.QueryFilters(query),
+		TotalHits:   int64(totalHits),
+		LatencyMs:   float64(elapsed.Microseconds()) / 1000,
+		UserID:      visitor.UserID,
+		SessionID:   visitor.SessionID,
+		RequestID:   RequestID(ctx),
+	})
+
+	return queryID
+}
@@ -0,0 +1,320 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnknownQuery is returned when feedback is given for a query ID that wasn't
+// recorded, or whose search is past the retention.
+var ErrUnknownQuery = errors.New("unknown query id")
+
+// Event is a single search, with the feedback on its results.
+type Event struct {
+	Time        time.Time   `json:"@timestamp"`
+	QueryID     string      `json:"query_id"`
+	Index       string      `json:"index"`
+	Query       string      `json:"query,omitempty"`
+	Fingerprint string      `json:"fingerprint"`
+	Filters     interface{} `json:"filters,omitempty"`
+	TotalHits   int64       `json:"total_hits"`
+	LatencyMs   float64     `json:"latency_ms"`
+	UserID      string      `json:"user_id,omitempty"`
+	SessionID   string      `json:"session_id,omitempty"`
+	RequestID   string      `json:"request_id,omitempty"`
+
+	Clicks             int64    `json:"clicks"`
+	Conversions        int64    `json:"conversions"`
+	FirstClickPosition int      `json:"first_click_position,omitempty"`
+	ReciprocalRank     float64  `json:"reciprocal_rank"`
+	ClickedDocuments   []string `json:"clicked_documents,omitempty"`
+	ConvertedDocuments []string `json:"converted_documents,omitempty"`
+}
+
+// Key is what events are grouped by, the query text or the fingerprint of the
+// query if it doesn't have any text (i.e. it only has filters).
+func (e Event) Key() string {
+	if e.Query != "" {
+		return e.Query
+	}
+
+	return "#" + e.Fingerprint
+}
+
+// Apply applies the feedback to the event. The reciprocal rank is of the highest
+// result that was clicked, so it doesn't depend on the order of the clicks.
+func (e *Event) Apply(feedback Feedback) {
+	switch feedback.Type {
+	case FeedbackClick:
+		e.Clicks++
+		e.ClickedDocuments = append(e.ClickedDocuments, feedback.DocumentID)
+		if e.FirstClickPosition == 0 || feedback.Position < e.FirstClickPosition {
+			e.FirstClickPosition = feedback.Position
+			e.ReciprocalRank = 1 / float64(feedback.Position)
+		}
+
+	case FeedbackConversion:
+		e.Conversions++
+		e.ConvertedDocuments = append(e.ConvertedDocuments, feedback.DocumentID)
+	}
+}
+
+// FeedbackType is the type of feedback on a result.
+type FeedbackType string
+
+const (
+	// FeedbackClick is when the user opened a result.
+	FeedbackClick FeedbackType = "click"
+
+	// FeedbackConversion is when the user did what the result was for (i.e. bought
+	// the product).
+	FeedbackConversion FeedbackType = "conversion"
+)
+
+// Feedback is a click or a conversion on a result of a search.
+type Feedback struct {
+	QueryID    string
+	DocumentID string
+	Type       FeedbackType
+
+	// Position is the 1-based position of the result in the search response.
+	Position int
+}
+
+// NewQueryID returns a new random query ID.
+func NewQueryID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// ValidQueryID reports whether the ID could have been returned by NewQueryID.
+func ValidQueryID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Filter selects the events that stats are computed from.
+type Filter struct {
+	// Index only selects the events of the index, if it is not empty.
+	Index string
+
+	// Since only selects the events after this time.
+	Since time.Time
+}
+
+func (f Filter) matches(event Event) bool {
+	return (f.Index == "" || event.Index == f.Index) && !event.Time.Before(f.Since)
+}
+
+// QueryStats are the stats of a query text (or fingerprint). The click-through and
+// conversion rates are the share of searches with at least one click or conversion,
+// and the mean reciprocal rank is of the highest clicked result of every search.
+type QueryStats struct {
+	Query              string    `json:"query,omitempty"`
+	Fingerprint        string    `json:"fingerprint"`
+	Searches           int64     `json:"searches"`
+	ZeroResults        int64     `json:"zero_results"`
+	AverageHits        float64   `json:"average_hits"`
+	AverageLatencyMs   float64   `json:"average_latency_ms"`
+	Clicks             int64     `json:"clicks"`
+	Conversions        int64     `json:"conversions"`
+	ClickThroughRate   float64   `json:"click_through_rate"`
+	ConversionRate     float64   `json:"conversion_rate"`
+	MeanReciprocalRank float64   `json:"mean_reciprocal_rank"`
+	LastSeen           time.Time `json:"last_seen"`
+}
+
+// IndexStats are the stats of the searches on an index.
+type IndexStats struct {
+	Index            string  `json:"index"`
+	Searches         int64   `json:"searches"`
+	ZeroResults      int64   `json:"zero_results"`
+	AverageLatencyMs float64 `json:"average_latency_ms"`
+	MaxLatencyMs     float64 `json:"max_latency_ms"`
+}
+
+// Bucket are the stats of the searches in a time window.
+type Bucket struct {
+	Time             time.Time `json:"time"`
+	Searches         int64     `json:"searches"`
+	ZeroResults      int64     `json:"zero_results"`
+	AverageLatencyMs float64   `json:"average_latency_ms"`
+}
+
+// Store is where search events are recorded and queried from.
+type Store interface {
+	// Record records the event, it shouldn't block the search.
+	Record(event Event)
+
+	// Event returns the event of the query ID, or ErrUnknownQuery.
+	Event(ctx context.Context, queryID string) (*Event, error)
+
+	// RecordFeedback applies the feedback to the event of its query ID, or returns
+	// ErrUnknownQuery.
+	RecordFeedback(ctx context.Context, feedback Feedback) error
+
+	// TopQueries returns the most searched queries.
+	TopQueries(ctx context.Context, filter Filter, limit int) ([]QueryStats, error)
+
+	// ZeroResultQueries returns the most searched queries that returned no hits.
+	ZeroResultQueries(ctx context.Context, filter Filter, limit int) ([]QueryStats, error)
+
+	// Indices returns the stats of every index.
+	Indices(ctx context.Context, filter Filter) ([]IndexStats, error)
+
+	// Trends returns the stats of the searches in buckets of the interval.
+	Trends(ctx context.Context, filter Filter, interval time.Duration) ([]Bucket, error)
+
+	Close() error
+}
+
+// fullTextQueries are the queries that the text of a search is taken from.
+var fullTextQueries = map[string]bool{
+	"match":               true,
+	"match_phrase":        true,
+	"match_phrase_prefix": true,
+	"match_bool_prefix":   true,
+	"multi_match":         true,
+	"combined_fields":     true,
+	"query_string":        true,
+	"simple_query_string": true,
+	"fuzzy":               true,
+	"prefix":              true,
+}
+
+// QueryText returns the text that was searched for in a search body, which is the
+// text of its full-text queries. It is lowercased and its whitespace is collapsed,
+// so the same search is counted once.
+func QueryText(body map[string]interface{}) string {
+	texts := make([]string, 0)
+	collectText(body["query"], &texts)
+
+	return strings.Join(strings.Fields(strings.ToLower(strings.Join(texts, " "))), " ")
+}
+
+func collectText(value interface{}, texts *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if fullTextQueries[key] {
+				collectQueryText(inner, texts)
+				continue
+			}
+
+			collectText(inner, texts)
+		}
+
+	case []interface{}:
+		for _, element := range v {
+			collectText(element, texts)
+		}
+	}
+}
+
+// collectQueryText collects the text of a full-text query, which is either
+// `{"field": "text"}`, `{"field": {"query": "text"}}` or `{"query": "text"}`.
+func collectQueryText(query interface{}, texts *[]string) {
+	params, ok := query.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if text, ok := params["query"].(string); ok {
+		*texts = append(*texts, text)
+		return
+	}
+
+	for _, inner := range params {
+		switch v := inner.(type) {
+		case string:
+			*texts = append(*texts, v)
+
+		case map[string]interface{}:
+			if text, ok := v["query"].(string); ok {
+				*texts = append(*texts, text)
+			} else if text, ok := v["value"].(string); ok {
+				*texts = append(*texts, text)
+			}
+		}
+	}
+}
+
+// QueryFilters returns the `bool.filter` clauses of a search body, which are the
+// filters (i.e. facets) that the search was narrowed down with.
+func QueryFilters(body map[string]interface{}) interface{} {
+	query, ok := body["query"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	boolQuery, ok := query["bool"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	return boolQuery["filter"]
+}
+
+type visitorKey struct{}
+
+// Visitor is the user and the session that made a search, from the headers that
+// the client sent.
+type Visitor struct {
+	UserID    string
+	SessionID string
+}
+
+// WithVisitor returns a copy of the context with the visitor.
+func WithVisitor(ctx context.Context, visitor Visitor) context.Context {
+	return context.WithValue(ctx, visitorKey{}, visitor)
+}
+
+// VisitorFromContext returns the visitor of the context, or an empty Visitor.
+func VisitorFromContext(ctx context.Context) Visitor {
+	visitor, _ := ctx.Value(visitorKey{}).(Visitor)
+	return visitor
+}
+
+// ParseWindow parses a duration like time.ParseDuration, which can also be in
+// days (i.e. "7d").
+func ParseWindow(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days in %q", value)
+		}
+
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,92 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventApply(t *testing.T) {
+	var event Event
+	feedback := []Feedback{
+		{DocumentID: "c", Type: FeedbackClick, Position: 3},
+		{DocumentID: "a", Type: FeedbackClick, Position: 1},
+		{DocumentID: "b", Type: FeedbackClick, Position: 2},
+		{DocumentID: "a", Type: FeedbackConversion, Position: 1},
+	}
+
+	for _, f := range feedback {
+		event.Apply(f)
+	}
+
+	// The reciprocal rank is of the highest clicked result, not the first click.
+	if event.Clicks != 3 || event.FirstClickPosition != 1 || event.ReciprocalRank != 1 {
+		t.Errorf("clicks applied as %+v", event)
+	}
+
+	if event.Conversions != 1 || !reflect.DeepEqual(event.ConvertedDocuments, []string{"a"}) || !reflect.DeepEqual(event.ClickedDocuments, []string{"c", "a", "b"}) {
+		t.Errorf("documents applied as %+v", event)
+	}
+}
+
+func TestQueryStatsRates(t *testing.T) {
+	s := NewMemoryStore(time.Hour, 0)
+	now := time.Now()
+	for i, id := range []string{"q1", "q2", "q3", "q4"} {
+		s.Record(Event{QueryID: id, Index: "products", Query: "shoes", TotalHits: 10, Time: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	s.Record(Event{QueryID: "other", Index: "products", Query: "boots", TotalHits: 10, Time: now})
+
+	feedback := []Feedback{
+		{QueryID: "q1", DocumentID: "c", Type: FeedbackClick, Position: 3},
+		{QueryID: "q1", DocumentID: "a", Type: FeedbackClick, Position: 1},
+		{QueryID: "q2", DocumentID: "b", Type: FeedbackClick, Position: 2},
+		{QueryID: "q2", DocumentID: "b", Type: FeedbackConversion, Position: 2},
+		{QueryID: "q3", DocumentID: "d", Type: FeedbackConversion, Position: 4},
+		{QueryID: "other", DocumentID: "z", Type: FeedbackClick, Position: 5},
+	}
+
+	for _, f := range feedback {
+		if err := s.RecordFeedback(context.TODO(), f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	top, _ := s.TopQueries(context.TODO(), Filter{}, 0)
+	if len(top) != 2 {
+		t.Fatalf("TopQueries() = %+v", top)
+	}
+
+	// Two of the four searches for shoes were clicked (reciprocal ranks 1 and 1/2)
+	// and two converted, one of them without a click.
+	shoes := top[0]
+	if shoes.Query != "shoes" || shoes.Searches != 4 || shoes.Clicks != 3 || shoes.Conversions != 2 {
+		t.Errorf("shoes = %+v", shoes)
+	}
+
+	if shoes.ClickThroughRate != 0.5 || shoes.ConversionRate != 0.5 || shoes.MeanReciprocalRank != 0.375 {
+		t.Errorf("shoes rates: CTR %v, conversion rate %v, MRR %v", shoes.ClickThroughRate, shoes.ConversionRate, shoes.MeanReciprocalRank)
+	}
+
+	boots := top[1]
+	if boots.ClickThroughRate != 1 || boots.ConversionRate != 0 || boots.MeanReciprocalRank != 0.2 {
+		t.Errorf("boots rates: CTR %v, conversion rate %v, MRR %v", boots.ClickThroughRate, boots.ConversionRate, boots.MeanReciprocalRank)
+	}
+}
@@ -0,0 +1,263 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the events in memory, for at most the retention and at most
+// a maximum number of events. Stats are computed by scanning the events, so it is
+// only meant for small deployments; use the Elasticsearch store otherwise.
+type MemoryStore struct {
+	retention time.Duration
+	maxEvents int
+
+	mu        sync.RWMutex
+	events    []*Event
+	byQueryID map[string]*Event
+}
+
+// NewMemoryStore creates a new MemoryStore.
+func NewMemoryStore(retention time.Duration, maxEvents int) *MemoryStore {
+	return &MemoryStore{
+		retention: retention,
+		maxEvents: maxEvents,
+		events:    make([]*Event, 0),
+		byQueryID: map[string]*Event{},
+	}
+}
+
+func (s *MemoryStore) Record(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, &event)
+	if event.QueryID != "" {
+		s.byQueryID[event.QueryID] = &event
+	}
+
+	// Events are recorded in order, so the oldest ones are at the start.
+	drop := 0
+	cutoff := time.Now().Add(-s.retention)
+	for drop < len(s.events) && s.events[drop].Time.Before(cutoff) {
+		drop++
+	}
+
+	if s.maxEvents > 0 && len(s.events)-drop > s.maxEvents {
+		drop = len(s.events) - s.maxEvents
+	}
+
+	for _, dropped := range s.events[:drop] {
+		delete(s.byQueryID, dropped.QueryID)
+	}
+
+	// The dropped events are freed when append grows the slice into a new array.
+	s.events = s.events[drop:]
+}
+
+func (s *MemoryStore) Event(_ context.Context, queryID string) (*Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	event, ok := s.byQueryID[queryID]
+	if !ok {
+		return nil, ErrUnknownQuery
+	}
+
+	copied := *event
+	return &copied, nil
+}
+
+func (s *MemoryStore) RecordFeedback(_ context.Context, feedback Feedback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.byQueryID[feedback.QueryID]
+	if !ok {
+		return ErrUnknownQuery
+	}
+
+	// The documents are copied, so events returned by Event aren't changed.
+	event.ClickedDocuments = append([]string(nil), event.ClickedDocuments...)
+	event.ConvertedDocuments = append([]string(nil), event.ConvertedDocuments...)
+	event.Apply(feedback)
+
+	return nil
+}
+
+// each calls fn with every event that matches the filter.
+func (s *MemoryStore) each(filter Filter, fn func(event Event)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, event := range s.events {
+		if filter.matches(*event) {
+			fn(*event)
+		}
+	}
+}
+
+func (s *MemoryStore) TopQueries(_ context.Context, filter Filter, limit int) ([]QueryStats, error) {
+	return s.queries(filter, limit, false), nil
+}
+
+func (s *MemoryStore) ZeroResultQueries(_ context.Context, filter Filter, limit int) ([]QueryStats, error) {
+	return s.queries(filter, limit, true), nil
+}
+
+func (s *MemoryStore) queries(filter Filter, limit int, zeroResults bool) []QueryStats {
+	type totals struct {
+		stats          QueryStats
+		hits           int64
+		latency        float64
+		clicked        int64
+		converted      int64
+		reciprocalRank float64
+	}
+
+	byKey := map[string]*totals{}
+	s.each(filter, func(event Event) {
+		if zeroResults && event.TotalHits > 0 {
+			return
+		}
+
+		t, ok := byKey[event.Key()]
+		if !ok {
+			t = &totals{stats: QueryStats{Query: event.Query, Fingerprint: event.Fingerprint}}
+			byKey[event.Key()] = t
+		}
+
+		t.stats.Searches++
+		if event.TotalHits == 0 {
+			t.stats.ZeroResults++
+		}
+
+		t.hits += event.TotalHits
+		t.latency += event.LatencyMs
+		t.stats.Clicks += event.Clicks
+		t.stats.Conversions += event.Conversions
+		t.reciprocalRank += event.ReciprocalRank
+		if event.Clicks > 0 {
+			t.clicked++
+		}
+
+		if event.Conversions > 0 {
+			t.converted++
+		}
+
+		if event.Time.After(t.stats.LastSeen) {
+			t.stats.LastSeen = event.Time
+		}
+	})
+
+	queries := make([]QueryStats, 0, len(byKey))
+	for _, t := range byKey {
+		t.stats.AverageHits = float64(t.hits) / float64(t.stats.Searches)
+		t.stats.AverageLatencyMs = t.latency / float64(t.stats.Searches)
+		t.stats.ClickThroughRate = float64(t.clicked) / float64(t.stats.Searches)
+		t.stats.ConversionRate = float64(t.converted) / float64(t.stats.Searches)
+		t.stats.MeanReciprocalRank = t.reciprocalRank / float64(t.stats.Searches)
+		queries = append(queries, t.stats)
+	}
+
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Searches != queries[j].Searches {
+			return queries[i].Searches > queries[j].Searches
+		}
+
+		return queries[i].LastSeen.After(queries[j].LastSeen)
+	})
+
+	if limit > 0 && len(queries) > limit {
+		queries = queries[:limit]
+	}
+
+	return queries
+}
+
+func (s *MemoryStore) Indices(_ context.Context, filter Filter) ([]IndexStats, error) {
+	byIndex := map[string]*IndexStats{}
+	latencies := map[string]float64{}
+	s.each(filter, func(event Event) {
+		stats, ok := byIndex[event.Index]
+		if !ok {
+			stats = &IndexStats{Index: event.Index}
+			byIndex[event.Index] = stats
+		}
+
+		stats.Searches++
+		if event.TotalHits == 0 {
+			stats.ZeroResults++
+		}
+
+		latencies[event.Index] += event.LatencyMs
+		if event.LatencyMs > stats.MaxLatencyMs {
+			stats.MaxLatencyMs = event.LatencyMs
+		}
+	})
+
+	indices := make([]IndexStats, 0, len(byIndex))
+	for index, stats := range byIndex {
+		stats.AverageLatencyMs = latencies[index] / float64(stats.Searches)
+		indices = append(indices, *stats)
+	}
+
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i].Index < indices[j].Index
+	})
+
+	return indices, nil
+}
+
+func (s *MemoryStore) Trends(_ context.Context, filter Filter, interval time.Duration) ([]Bucket, error) {
+	byTime := map[int64]*Bucket{}
+	latencies := map[int64]float64{}
+	s.each(filter, func(event Event) {
+		start := event.Time.Truncate(interval)
+		bucket, ok := byTime[start.UnixNano()]
+		if !ok {
+			bucket = &Bucket{Time: start}
+			byTime[start.UnixNano()] = bucket
+		}
+
+		bucket.Searches++
+		if event.TotalHits == 0 {
+			bucket.ZeroResults++
+		}
+
+		latencies[start.UnixNano()] += event.LatencyMs
+	})
+
+	buckets := make([]Bucket, 0, len(byTime))
+	for key, bucket := range byTime {
+		bucket.AverageLatencyMs = latencies[key] / float64(bucket.Searches)
+		buckets = append(buckets, *bucket)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Time.Before(buckets[j].Time)
+	})
+
+	return buckets, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
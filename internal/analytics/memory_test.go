@@ -0,0 +1,122 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analytics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRetention(t *testing.T) {
+	s := NewMemoryStore(time.Hour, 0)
+	now := time.Now()
+
+	s.Record(Event{QueryID: "old", Index: "products", Time: now.Add(-2 * time.Hour)})
+	s.Record(Event{QueryID: "recent", Index: "products", Time: now.Add(-30 * time.Minute)})
+	s.Record(Event{QueryID: "new", Index: "products", Time: now})
+
+	if _, err := s.Event(context.TODO(), "old"); !errors.Is(err, ErrUnknownQuery) {
+		t.Errorf("event past the retention wasn't dropped: %v", err)
+	}
+
+	if err := s.RecordFeedback(context.TODO(), Feedback{QueryID: "old", Type: FeedbackClick, Position: 1}); !errors.Is(err, ErrUnknownQuery) {
+		t.Errorf("feedback on a dropped event = %v", err)
+	}
+
+	for _, id := range []string{"recent", "new"} {
+		if _, err := s.Event(context.TODO(), id); err != nil {
+			t.Errorf("event %s was dropped: %v", id, err)
+		}
+	}
+
+	if indices, _ := s.Indices(context.TODO(), Filter{}); len(indices) != 1 || indices[0].Searches != 2 {
+		t.Errorf("Indices() = %+v", indices)
+	}
+}
+
+func TestMemoryStoreMaxEvents(t *testing.T) {
+	s := NewMemoryStore(time.Hour, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		s.Record(Event{QueryID: id, Index: "products", Time: time.Now()})
+	}
+
+	if _, err := s.Event(context.TODO(), "a"); !errors.Is(err, ErrUnknownQuery) {
+		t.Errorf("oldest event wasn't evicted: %v", err)
+	}
+
+	for _, id := range []string{"b", "c"} {
+		if _, err := s.Event(context.TODO(), id); err != nil {
+			t.Errorf("event %s was evicted: %v", id, err)
+		}
+	}
+
+	if len(s.events) != 2 || len(s.byQueryID) != 2 {
+		t.Errorf("store has %d events and %d query ids", len(s.events), len(s.byQueryID))
+	}
+}
+
+func TestMemoryStoreEventIsCopied(t *testing.T) {
+	s := NewMemoryStore(time.Hour, 0)
+	s.Record(Event{QueryID: "a", Time: time.Now()})
+	_ = s.RecordFeedback(context.TODO(), Feedback{QueryID: "a", DocumentID: "1", Type: FeedbackClick, Position: 2})
+
+	event, err := s.Event(context.TODO(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.RecordFeedback(context.TODO(), Feedback{QueryID: "a", DocumentID: "2", Type: FeedbackClick, Position: 1})
+	if event.Clicks != 1 || len(event.ClickedDocuments) != 1 {
+		t.Errorf("returned event was changed by later feedback: %+v", event)
+	}
+}
+
+func TestMemoryStoreFilters(t *testing.T) {
+	s := NewMemoryStore(24*time.Hour, 0)
+	start := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+
+	s.Record(Event{Index: "products", Query: "shoes", Time: start, TotalHits: 10, LatencyMs: 10})
+	s.Record(Event{Index: "products", Query: "boots", Time: start.Add(10 * time.Minute), TotalHits: 0, LatencyMs: 30})
+	s.Record(Event{Index: "orders", Query: "shoes", Time: start.Add(time.Hour), TotalHits: 3, LatencyMs: 50})
+	s.Record(Event{Index: "products", Query: "shoes", Time: start.Add(2 * time.Hour), TotalHits: 0, LatencyMs: 20})
+
+	top, _ := s.TopQueries(context.TODO(), Filter{Index: "products"}, 0)
+	if len(top) != 2 || top[0].Query != "shoes" || top[0].Searches != 2 || top[0].ZeroResults != 1 || top[0].AverageHits != 5 {
+		t.Errorf("TopQueries() = %+v", top)
+	}
+
+	top, _ = s.TopQueries(context.TODO(), Filter{Since: start.Add(time.Minute)}, 1)
+	if len(top) != 1 || top[0].Query != "shoes" || top[0].Searches != 2 {
+		t.Errorf("TopQueries() since = %+v", top)
+	}
+
+	zero, _ := s.ZeroResultQueries(context.TODO(), Filter{}, 0)
+	if len(zero) != 2 || zero[0].Searches != 1 || zero[0].ZeroResults != 1 {
+		t.Errorf("ZeroResultQueries() = %+v", zero)
+	}
+
+	indices, _ := s.Indices(context.TODO(), Filter{})
+	if len(indices) != 2 || indices[0].Index != "orders" || indices[1].Searches != 3 || indices[1].AverageLatencyMs != 20 || indices[1].MaxLatencyMs != 30 {
+		t.Errorf("Indices() = %+v", indices)
+	}
+
+	trends, _ := s.Trends(context.TODO(), Filter{}, time.Hour)
+	if len(trends) != 3 || !trends[0].Time.Equal(start) || trends[0].Searches != 2 || trends[0].ZeroResults != 1 || trends[0].AverageLatencyMs != 20 {
+		t.Errorf("Trends() = %+v", trends)
+	}
+}
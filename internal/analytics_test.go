@@ -0,0 +1,239 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"floofy.dev/tsubasa/internal/analytics"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewElasticAnalyticsStore(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{"PUT /analytics": `{"acknowledged": true}`}}
+	s, err := newElasticAnalyticsStore(newTestElastic(t, fake), "analytics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Close()
+	if len(fake.requests) != 2 || fake.requests[1] != "PUT /analytics" || !strings.Contains(fake.bodies["PUT /analytics"], `"reciprocal_rank":{"type":"float"}`) {
+		t.Errorf("missing analytics index wasn't created: %v", fake.requests)
+	}
+
+	// The mapping of an existing index is updated.
+	fake = &fakeElastic{responses: map[string]string{
+		"HEAD /analytics":         ``,
+		"PUT /analytics/_mapping": `{"acknowledged": true}`,
+	}}
+
+	s, err = newElasticAnalyticsStore(newTestElastic(t, fake), "analytics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Close()
+	if len(fake.requests) != 2 || fake.requests[1] != "PUT /analytics/_mapping" {
+		t.Errorf("mapping of the analytics index wasn't updated: %v", fake.requests)
+	}
+}
+
+func TestElasticAnalyticsStoreRecord(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{"PUT /analytics/_doc/": `{"result": "created"}`}}
+	s := &elasticAnalyticsStore{es: newTestElastic(t, fake), index: "analytics", events: make(chan analytics.Event, 1), pending: map[string]chan struct{}{}}
+
+	s.Record(analytics.Event{QueryID: "a", Index: "products", Fingerprint: "f00"})
+
+	// The queue is full and nothing is writing, so the event is dropped rather than blocking.
+	done := make(chan struct{})
+	go func() {
+		s.Record(analytics.Event{QueryID: "b", Index: "products"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Record blocked on a full queue")
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	_ = s.Close()
+
+	if len(fake.requests) != 1 || fake.requests[0] != "PUT /analytics/_doc/a" {
+		t.Fatalf("requests = %v", fake.requests)
+	}
+
+	// Events are grouped by their key, which is kept in the document.
+	doc := decodeJson(t, fake.bodies["PUT /analytics/_doc/a"])
+	if doc["key"] != "#f00" || doc["index"] != "products" {
+		t.Errorf("event document = %v", doc)
+	}
+}
+
+func TestElasticAnalyticsStoreEvent(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{
+		"GET /analytics/_doc/a": `{"_id": "a", "found": true, "_source": {"query_id": "a", "index": "products", "clicks": 2}}`,
+	}}
+
+	s := &elasticAnalyticsStore{es: newTestElastic(t, fake), index: "analytics"}
+	event, err := s.Event(context.TODO(), "a")
+	if err != nil || event.QueryID != "a" || event.Clicks != 2 {
+		t.Errorf("Event() = %+v, %v", event, err)
+	}
+
+	if _, err := s.Event(context.TODO(), "b"); !errors.Is(err, analytics.ErrUnknownQuery) {
+		t.Errorf("Event() of a missing event = %v", err)
+	}
+
+	if err := s.RecordFeedback(context.TODO(), analytics.Feedback{QueryID: "b", Type: analytics.FeedbackClick, Position: 1}); !errors.Is(err, analytics.ErrUnknownQuery) {
+		t.Errorf("RecordFeedback() of a missing event = %v", err)
+	}
+}
+
+func TestElasticAnalyticsStoreStats(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{
+		"POST /analytics/_search": `{"aggregations": {
+			"queries": {"buckets": [{
+				"key": "shoes", "doc_count": 4,
+				"zero_results": {"doc_count": 1},
+				"hits": {"value": 7.5},
+				"latency": {"value": 12},
+				"last_seen": {"value": 1654086600000},
+				"clicks": {"value": 3},
+				"conversions": {"value": 1},
+				"clicked": {"doc_count": 2},
+				"converted": {"doc_count": 1},
+				"reciprocal": {"value": 0.375},
+				"sample": {"hits": {"hits": [{"_source": {"query": "shoes", "fingerprint": "f00"}}]}}
+			}]},
+			"indices": {"buckets": [{"key": "products", "doc_count": 4, "zero_results": {"doc_count": 1}, "latency": {"value": 12}, "max_latency": {"value": null}}]},
+			"trends": {"buckets": [{"key": 1654084800000, "doc_count": 4, "zero_results": {"doc_count": 1}, "latency": {"value": 12}}]}
+		}}`,
+	}}
+
+	s := &elasticAnalyticsStore{es: newTestElastic(t, fake), index: "analytics"}
+	since := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	queries, err := s.ZeroResultQueries(context.TODO(), analytics.Filter{Index: "products", Since: since}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := analytics.QueryStats{
+		Query:              "shoes",
+		Fingerprint:        "f00",
+		Searches:           4,
+		ZeroResults:        1,
+		AverageHits:        7.5,
+		AverageLatencyMs:   12,
+		Clicks:             3,
+		Conversions:        1,
+		ClickThroughRate:   0.5,
+		ConversionRate:     0.25,
+		MeanReciprocalRank: 0.375,
+		LastSeen:           time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+
+	if len(queries) != 1 || queries[0] != want {
+		t.Errorf("ZeroResultQueries() = %+v", queries)
+	}
+
+	body := fake.bodies["POST /analytics/_search"]
+	for _, filter := range []string{`{"term":{"index":"products"}}`, `{"term":{"total_hits":0}}`, `"gte":"2022-06-01T00:00:00Z"`, `"size":5`} {
+		if !strings.Contains(body, filter) {
+			t.Errorf("search body %s doesn't contain %s", body, filter)
+		}
+	}
+
+	indices, err := s.Indices(context.TODO(), analytics.Filter{})
+	if err != nil || len(indices) != 1 || indices[0].Searches != 4 || indices[0].MaxLatencyMs != 0 {
+		t.Errorf("Indices() = %+v, %v", indices, err)
+	}
+
+	trends, err := s.Trends(context.TODO(), analytics.Filter{}, time.Hour)
+	if err != nil || len(trends) != 1 || !trends[0].Time.Equal(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Trends() = %+v, %v", trends, err)
+	}
+
+	if !strings.Contains(fake.bodies["POST /analytics/_search"], `"fixed_interval":"3600s"`) {
+		t.Errorf("trends search body = %s", fake.bodies["POST /analytics/_search"])
+	}
+}
+
+func TestElasticAnalyticsStoreFeedbackBeforeWrite(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{
+		"PUT /analytics/_doc/a":     `{"result": "created"}`,
+		"GET /analytics/_doc/a":     `{"_id": "a", "found": true, "_source": {"query_id": "a", "index": "products"}}`,
+		"POST /analytics/_update/a": `{"result": "updated"}`,
+	}}
+
+	s := &elasticAnalyticsStore{es: newTestElastic(t, fake), index: "analytics", events: make(chan analytics.Event, 1), pending: map[string]chan struct{}{}}
+	s.Record(analytics.Event{QueryID: "a", Index: "products"})
+
+	// The event isn't written yet, so the feedback waits for it.
+	done := make(chan error)
+	go func() {
+		if _, err := s.Event(context.TODO(), "a"); err != nil {
+			done <- err
+			return
+		}
+
+		done <- s.RecordFeedback(context.TODO(), analytics.Feedback{QueryID: "a", DocumentID: "1", Type: analytics.FeedbackClick, Position: 2})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("feedback didn't wait for the event: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Close()
+	if len(fake.requests) != 3 || fake.requests[0] != "PUT /analytics/_doc/a" || fake.requests[2] != "POST /analytics/_update/a" {
+		t.Fatalf("requests = %v", fake.requests)
+	}
+
+	update := decodeJson(t, fake.bodies["POST /analytics/_update/a"])
+	params := update["script"].(map[string]interface{})["params"].(map[string]interface{})
+	if params["type"] != "click" || params["document_id"] != "1" || params["position"] != float64(2) {
+		t.Errorf("feedback params = %v", params)
+	}
+
+	if len(s.pending) != 0 {
+		t.Errorf("pending writes weren't released: %v", s.pending)
+	}
+}
+
+func TestElasticAnalyticsStoreFeedbackOnDroppedEvent(t *testing.T) {
+	s := &elasticAnalyticsStore{es: newTestElastic(t, &fakeElastic{}), index: "analytics", events: make(chan analytics.Event), pending: map[string]chan struct{}{}}
+
+	// Nothing reads the queue, so the event is dropped and feedback doesn't wait for it.
+	s.Record(analytics.Event{QueryID: "a", Index: "products"})
+	err := s.RecordFeedback(context.TODO(), analytics.Feedback{QueryID: "a", Type: analytics.FeedbackClick, Position: 1})
+	if !errors.Is(err, analytics.ErrUnknownQuery) {
+		t.Errorf("RecordFeedback() of a dropped event = %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"floofy.dev/tsubasa/internal/audit"
+	"fmt"
+)
+
+// elasticAuditSink writes audit records to an Elasticsearch index.
+type elasticAuditSink struct {
+	es    *ElasticService
+	index string
+}
+
+func (s *elasticAuditSink) Write(record audit.Record) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+
+	res, err := s.es.client.Index(s.index, &buf, s.es.client.Index.WithContext(context.Background()))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	return nil
+}
+
+func (s *elasticAuditSink) Close() error {
+	return nil
+}
+
+// newAuditLogger creates the audit logger from the `[audit]` table.
+func newAuditLogger(config *AuditConfig, es *ElasticService) (*audit.Logger, error) {
+	var sink audit.Sink
+	switch {
+	case config.Index != nil:
+		sink = &elasticAuditSink{es: es, index: *config.Index}
+
+	case config.Path != nil:
+		maxSize := 100
+		if config.MaxSizeMB != nil {
+			maxSize = *config.MaxSizeMB
+		}
+
+		maxFiles := 10
+		if config.MaxFiles != nil {
+			maxFiles = *config.MaxFiles
+		}
+
+		file, err := audit.NewFileSink(*config.Path, int64(maxSize)*1024*1024, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+
+		sink = file
+
+	default:
+		return nil, errors.New("either `audit.path` or `audit.index` is required")
+	}
+
+	return audit.NewLogger(sink, config.RedactFields), nil
+}
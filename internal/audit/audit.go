@@ -0,0 +1,196 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"github.com/sirupsen/logrus"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Redacted is the value that redacted fields are replaced with.
+const Redacted = "[REDACTED]"
+
+// Record is a single entry in the audit log.
+type Record struct {
+	Time           time.Time   `json:"@timestamp"`
+	Principal      string      `json:"principal"`
+	Provider       string      `json:"provider"`
+	CredentialID   string      `json:"credential_id,omitempty"`
+	IP             string      `json:"ip"`
+	Action         string      `json:"action"`
+	Method         string      `json:"method"`
+	Route          string      `json:"route"`
+	Path           string      `json:"path"`
+	Index          string      `json:"index,omitempty"`
+	DocumentIDs    []string    `json:"document_ids,omitempty"`
+	QueryHash      string      `json:"query_hash,omitempty"`
+	Body           interface{} `json:"body,omitempty"`
+	Status         int         `json:"status"`
+	LatencyMs      float64     `json:"latency_ms"`
+	IdempotencyKey string      `json:"idempotency_key,omitempty"`
+	RequestID      string      `json:"request_id,omitempty"`
+}
+
+// Sink is where audit records are written to.
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// Redactor replaces the values of sensitive fields in request bodies. Patterns
+// are matched against the dotted path of a field (i.e. `customer.email`) and
+// against its name, so `password` redacts every field named password.
+type Redactor []string
+
+// Redact returns a copy of the value with the sensitive fields redacted.
+func (r Redactor) Redact(value interface{}) interface{} {
+	return r.redact("", value)
+}
+
+func (r Redactor) redact(prefix string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			field := key
+			if prefix != "" {
+				field = prefix + "." + key
+			}
+
+			if r.matches(field, key) {
+				redacted[key] = Redacted
+				continue
+			}
+
+			redacted[key] = r.redact(field, inner)
+		}
+
+		return redacted
+
+	case []interface{}:
+		redacted := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			redacted = append(redacted, r.redact(prefix, element))
+		}
+
+		return redacted
+
+	default:
+		return value
+	}
+}
+
+func (r Redactor) matches(field string, key string) bool {
+	for _, pattern := range r {
+		if matched, _ := path.Match(pattern, field); matched {
+			return true
+		}
+
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Logger writes audit records to a sink in the background, so requests don't
+// wait for the sink. Records are dropped if the sink fails, or if it can't keep
+// up and the queue is full; Dropped counts the latter.
+type Logger struct {
+	sink     Sink
+	redactor Redactor
+	records  chan Record
+	wg       sync.WaitGroup
+	dropped  uint64
+
+	// mu guards closed, so records aren't sent after the channel is closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewLogger creates a new Logger that writes to the sink.
+func NewLogger(sink Sink, redactor Redactor) *Logger {
+	l := &Logger{
+		sink:     sink,
+		redactor: redactor,
+		records:  make(chan Record, 1024),
+	}
+
+	l.wg.Add(1)
+	go l.run()
+
+	return l
+}
+
+// Log queues the record to be written, after redacting its body. It never blocks:
+// records that are logged after the Logger is closed or while the queue is full
+// are dropped.
+func (l *Logger) Log(record Record) {
+	if record.Body != nil {
+		record.Body = l.redactor.Redact(record.Body)
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		logrus.Warnf("Dropping audit record for %s %s by %s, since the audit log is closed", record.Method, record.Path, record.Principal)
+		return
+	}
+
+	select {
+	case l.records <- record:
+	default:
+		dropped := atomic.AddUint64(&l.dropped, 1)
+		logrus.Warnf("Dropping audit record for %s %s by %s, the audit sink can't keep up (%d dropped)", record.Method, record.Path, record.Principal, dropped)
+	}
+}
+
+// Dropped returns the number of records that were dropped because the queue was full.
+func (l *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close writes the queued records and closes the sink, it does nothing if the
+// Logger is already closed.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.closed = true
+	close(l.records)
+	l.mu.Unlock()
+
+	l.wg.Wait()
+
+	return l.sink.Close()
+}
+
+func (l *Logger) run() {
+	defer l.wg.Done()
+	for record := range l.records {
+		if err := l.sink.Write(record); err != nil {
+			logrus.Errorf("Unable to write audit record for %s %s by %s: %v", record.Method, record.Path, record.Principal, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+func (s *memorySink) Write(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestLoggerLogAfterClose(t *testing.T) {
+	sink := &memorySink{}
+	logger := NewLogger(sink, nil)
+
+	logger.Log(Record{Path: "/before"})
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	logger.Log(Record{Path: "/after"})
+	if err := logger.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	if len(sink.records) != 1 || sink.records[0].Path != "/before" {
+		t.Fatalf("unexpected records %+v", sink.records)
+	}
+}
+
+func TestLoggerConcurrentClose(t *testing.T) {
+	logger := NewLogger(&memorySink{}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			logger.Log(Record{Path: "/"})
+		}()
+	}
+
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	wg.Wait()
+}
+
+// blockingSink blocks every write until it's released.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s *blockingSink) Write(Record) error {
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestLoggerDropsWhenFull(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	logger := NewLogger(sink, nil)
+
+	// One record is held by the blocked sink, the rest fill the queue.
+	total := cap(logger.records) + 10
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < total; i++ {
+			logger.Log(Record{Path: "/"})
+		}
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Log blocked on a full queue")
+	}
+
+	if dropped := logger.Dropped(); dropped < 9 || dropped > 10 {
+		t.Errorf("Dropped() = %d, want 9 or 10", dropped)
+	}
+
+	close(sink.release)
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyPrefix is the prefix of every API key token.
+const APIKeyPrefix = "tsb_"
+
+// ErrUnknownAPIKey is returned when an API key doesn't exist.
+var ErrUnknownAPIKey = errors.New("unknown api key")
+
+// APIKey is a named API key. Only the hash of the secret is stored, the token
+// is only known when the key is created.
+type APIKey struct {
+	// ID is the public identifier of the key, it is part of the token.
+	ID string `json:"id"`
+
+	// Name is the name of the key, this is used as the principal name.
+	Name string `json:"name"`
+
+	// Hash is the hex-encoded SHA-256 hash of the secret part of the token.
+	Hash string `json:"hash"`
+
+	// SearchTokenKey is the public key that search tokens of the key are verified
+	// with. Its private key is derived from the secret, so it is never stored.
+	SearchTokenKey string `json:"search_token_key,omitempty"`
+
+	// Scopes are the scopes that the key grants.
+	Scopes []string `json:"scopes"`
+
+	// Filters are queries that every search with the key is filtered with.
+	Filters []map[string]interface{} `json:"filters,omitempty"`
+
+	// CreatedAt is when the key was created.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyStore is a store of API keys that is persisted as a JSON file, so the
+// `tsubasa keys` command and the admin endpoints can both manage the keys. The
+// file is reloaded when it is changed on disk.
+type APIKeyStore struct {
+	path      string
+	mu        sync.RWMutex
+	keys      map[string]*APIKey
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewAPIKeyStore creates a new APIKeyStore from the file at the path, the file
+// doesn't need to exist yet.
+func NewAPIKeyStore(path string) (*APIKeyStore, error) {
+	store := &APIKeyStore{path: path, keys: map[string]*APIKey{}}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *APIKeyStore) load() error {
+	stat, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.keys = map[string]*APIKey{}
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(contents, &keys); err != nil {
+		return fmt.Errorf("unable to parse api keys file %s: %v", s.path, err)
+	}
+
+	s.keys = make(map[string]*APIKey, len(keys))
+	for _, key := range keys {
+		s.keys[key.ID] = key
+	}
+
+	s.modTime = stat.ModTime()
+	return nil
+}
+
+// reloadIfChanged reloads the file if it was modified, it is checked at most once a second.
+func (s *APIKeyStore) reloadIfChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastCheck) < time.Second {
+		return
+	}
+
+	s.lastCheck = time.Now()
+	stat, err := os.Stat(s.path)
+	if err != nil || stat.ModTime().Equal(s.modTime) {
+		return
+	}
+
+	logrus.Info("API keys file has changed, now reloading...")
+	if err := s.load(); err != nil {
+		logrus.Errorf("Unable to reload API keys: %v", err)
+	}
+}
+
+func (s *APIKeyStore) save() error {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	contents, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(s.path, contents, 0o600); err != nil {
+		return err
+	}
+
+	if stat, err := os.Stat(s.path); err == nil {
+		s.modTime = stat.ModTime()
+	}
+
+	return nil
+}
+
+// Create creates a new API key and returns it with its token. The token is
+// not stored, so it can't be retrieved again. The filters are mandatory queries
+// for every search with the key, they can be empty.
+func (s *APIKeyStore) Create(name string, scopes []string, filters []map[string]interface{}) (*APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("api key name can't be empty")
+	}
+
+	for _, scope := range scopes {
+		if err := ValidateScope(scope); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, filter := range filters {
+		if len(filter) == 0 {
+			return nil, "", errors.New("api key filters can't be empty queries")
+		}
+	}
+
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &APIKey{
+		ID:             id,
+		Name:           name,
+		Hash:           hashSecret(secret),
+		SearchTokenKey: searchTokenPublicKey(secret),
+		Scopes:         scopes,
+		Filters:        filters,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, "", err
+	}
+
+	s.keys[id] = key
+	if err := s.save(); err != nil {
+		return nil, "", err
+	}
+
+	return key, APIKeyPrefix + id + "." + secret, nil
+}
+
+// List returns every API key, sorted by when they were created.
+func (s *APIKeyStore) List() []APIKey {
+	s.reloadIfChanged()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys
+}
+
+// Revoke deletes the API key with the id.
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	if _, ok := s.keys[id]; !ok {
+		return ErrUnknownAPIKey
+	}
+
+	delete(s.keys, id)
+	return s.save()
+}
+
+// Verify returns the API key of the token, if the token is valid.
+func (s *APIKeyStore) Verify(token string) (*APIKey, bool) {
+	id, secret, ok := ParseAPIKeyToken(token)
+	if !ok {
+		return nil, false
+	}
+
+	s.reloadIfChanged()
+
+	s.mu.RLock()
+	key, ok := s.keys[id]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, false
+	}
+
+	return key, true
+}
+
+// ParseAPIKeyToken splits an API key token into its id and secret.
+func ParseAPIKeyToken(token string) (string, string, bool) {
+	if !strings.HasPrefix(token, APIKeyPrefix) {
+		return "", "", false
+	}
+
+	return strings.Cut(strings.TrimPrefix(token, APIKeyPrefix), ".")
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomString(size int, encode func([]byte) string) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return encode(b), nil
+}
@@ -0,0 +1,137 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request doesn't have
+// the credentials that it handles, so the next Authenticator in the Chain is tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Error is an authentication failure with the error code that is sent back.
+type Error struct {
+	Code    string
+	Message string
+
+	// RetryAfter is set when the client is locked out, and is sent as a 429
+	// rather than a 401.
+	RetryAfter time.Duration
+
+	// Fallthrough is set when the credentials are valid but grant nothing (i.e. a
+	// verified client certificate without a principal), so the rest of the Chain is
+	// tried. The error is only returned if no other Authenticator has credentials.
+	Fallthrough bool
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Authenticator is a provider that authenticates requests, i.e. with Basic
+// authentication or API keys.
+type Authenticator interface {
+	// Name is the name of the provider, i.e. `basic`. It is used as the provider
+	// of the principals that it returns.
+	Name() string
+
+	// Authenticate returns the principal that made the request. It returns
+	// ErrNoCredentials if the request doesn't have credentials for this provider,
+	// and any other error if the credentials are invalid.
+	Authenticate(req *http.Request) (*Principal, error)
+
+	// Challenge is the `WWW-Authenticate` header that is sent when the credentials
+	// are missing or invalid, it can be empty.
+	Challenge() string
+}
+
+// Chain is a list of authenticators that are tried in order.
+type Chain []Authenticator
+
+// Authenticate returns the principal from the first Authenticator that has
+// credentials in the request, with that Authenticator. If none of them have
+// credentials, ErrNoCredentials (or the first Error with Fallthrough) is returned.
+func (c Chain) Authenticate(req *http.Request) (*Principal, Authenticator, error) {
+	var fallthroughErr error
+	var fallthroughAuthenticator Authenticator
+
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(req)
+		if err == ErrNoCredentials {
+			continue
+		}
+
+		if authErr, ok := err.(*Error); ok && authErr.Fallthrough {
+			if fallthroughErr == nil {
+				fallthroughErr, fallthroughAuthenticator = err, authenticator
+			}
+
+			continue
+		}
+
+		return principal, authenticator, err
+	}
+
+	if fallthroughErr != nil {
+		return nil, fallthroughAuthenticator, fallthroughErr
+	}
+
+	return nil, nil, ErrNoCredentials
+}
+
+// Challenges returns the `WWW-Authenticate` headers of every Authenticator.
+func (c Chain) Challenges() []string {
+	challenges := make([]string, 0, len(c))
+	for _, authenticator := range c {
+		if challenge := authenticator.Challenge(); challenge != "" && !containsString(challenges, challenge) {
+			challenges = append(challenges, challenge)
+		}
+	}
+
+	return challenges
+}
+
+type peerAddressKey struct{}
+
+// WithPeerAddress returns a copy of the context with the address of the peer that
+// made the connection, before it is replaced by proxy headers.
+func WithPeerAddress(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, peerAddressKey{}, address)
+}
+
+// PeerAddress returns the address of the peer that made the connection.
+func PeerAddress(req *http.Request) string {
+	if address, ok := req.Context().Value(peerAddressKey{}).(string); ok {
+		return address
+	}
+
+	return req.RemoteAddr
+}
+
+// bearerToken returns the token of the `Authorization: Bearer <token>` header.
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(header, "Bearer "), true
+}
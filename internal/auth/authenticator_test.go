@@ -0,0 +1,85 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChainAuthenticate(t *testing.T) {
+	mtls, err := NewMTLSAuthenticator(MTLSConfig{Principals: map[string][]string{"backend": {"search:products"}}})
+	if err != nil {
+		t.Fatalf("NewMTLSAuthenticator: %v", err)
+	}
+
+	lockout, err := NewLockout(LockoutConfig{})
+	if err != nil {
+		t.Fatalf("NewLockout: %v", err)
+	}
+
+	chain := Chain{mtls, &BasicAuthenticator{Username: "noel", Password: "hunter2", Lockout: lockout}}
+
+	tests := []struct {
+		name     string
+		cert     string
+		password string
+		provider string
+		code     string
+	}{
+		{"mapped certificate", "backend", "", "mtls", ""},
+		{"mapped certificate with basic", "backend", "hunter2", "mtls", ""},
+		{"unmapped certificate with basic", "frontend", "hunter2", "basic", ""},
+		{"unmapped certificate with wrong password", "frontend", "wrong", "", "INVALID_CREDENTIALS"},
+		{"unmapped certificate", "frontend", "", "", "UNKNOWN_CERTIFICATE"},
+		{"basic", "", "hunter2", "basic", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.cert != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.cert}}
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+
+			if test.password != "" {
+				req.SetBasicAuth("noel", test.password)
+			}
+
+			principal, _, err := chain.Authenticate(req)
+			if test.code != "" {
+				authErr, ok := err.(*Error)
+				if !ok || authErr.Code != test.code {
+					t.Fatalf("expected error %s, got %v", test.code, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+
+			if principal.Provider != test.provider {
+				t.Fatalf("authenticated with %s, expected %s", principal.Provider, test.provider)
+			}
+		})
+	}
+}
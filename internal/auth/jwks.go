@@ -0,0 +1,285 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval is how often the JWKS is fetched again.
+const jwksRefreshInterval = 10 * time.Minute
+
+// jwksMinRefreshInterval is the minimum time between fetching the JWKS when
+// a token has a key id that we don't know of, i.e. when keys are rotated. It
+// doubles after every failed fetch, up to jwksRefreshInterval.
+const jwksMinRefreshInterval = time.Minute
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// KeySet is a JSON Web Key Set that is loaded from a URL or a local file.
+type KeySet struct {
+	url     string
+	file    string
+	client  *http.Client
+	mu      sync.RWMutex
+	keys    map[string]interface{}
+	fetched time.Time
+
+	// attempted is when the set was last fetched, even if it failed, and failures
+	// is how many fetches have failed in a row since the last successful one.
+	attempted time.Time
+	failures  int
+	now       func() time.Time
+
+	// refreshes makes concurrent requests with an unknown key id share one fetch.
+	refreshes singleflight.Group
+}
+
+// NewKeySet creates a KeySet from the URL or the file, and loads it.
+func NewKeySet(url string, file string) (*KeySet, error) {
+	if url == "" && file == "" {
+		return nil, fmt.Errorf("either a JWKS url or file is required")
+	}
+
+	ks := &KeySet{
+		url:    url,
+		file:   file,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]interface{}{},
+		now:    time.Now,
+	}
+
+	if err := ks.refresh(); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Key returns the public key with the key id. If the key is unknown or the set is
+// stale, the set is fetched again.
+func (ks *KeySet) Key(kid string) (interface{}, error) {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	stale := ks.now().Sub(ks.fetched) > jwksRefreshInterval
+	canRefresh := ks.canRefresh()
+	ks.mu.RUnlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	// A stale set keeps being used until a fetch succeeds, so a JWKS endpoint
+	// that is down isn't fetched again on every request.
+	if canRefresh {
+		_, err, _ := ks.refreshes.Do("refresh", func() (interface{}, error) {
+			// Another request could have refreshed the set since it was checked.
+			ks.mu.RLock()
+			canRefresh := ks.canRefresh()
+			ks.mu.RUnlock()
+
+			if !canRefresh {
+				return nil, nil
+			}
+
+			return nil, ks.refresh()
+		})
+
+		if err != nil {
+			logrus.Errorf("Unable to refresh JWKS: %v", err)
+		}
+
+		ks.mu.RLock()
+		key, ok = ks.keys[kid]
+		ks.mu.RUnlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	return key, nil
+}
+
+// canRefresh reports whether the backoff since the last fetch has passed, ks.mu
+// must be held.
+func (ks *KeySet) canRefresh() bool {
+	backoff := jwksMinRefreshInterval
+	for i := 0; i < ks.failures && backoff < jwksRefreshInterval; i++ {
+		backoff *= 2
+	}
+
+	if backoff > jwksRefreshInterval {
+		backoff = jwksRefreshInterval
+	}
+
+	return ks.now().Sub(ks.attempted) > backoff
+}
+
+// refresh fetches the set, and records the attempt so failures are backed off.
+func (ks *KeySet) refresh() error {
+	attempted := ks.now()
+	keys, err := ks.load()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.attempted = attempted
+	if err != nil {
+		ks.failures++
+		return err
+	}
+
+	ks.keys = keys
+	ks.fetched = attempted
+	ks.failures = 0
+
+	logrus.Debugf("Loaded %d key(s) from JWKS", len(keys))
+	return nil
+}
+
+func (ks *KeySet) load() (map[string]interface{}, error) {
+	var reader io.ReadCloser
+	if ks.file != "" {
+		file, err := os.Open(ks.file)
+		if err != nil {
+			return nil, err
+		}
+
+		reader = file
+	} else {
+		res, err := ks.client.Get(ks.url)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode != 200 {
+			res.Body.Close()
+			return nil, fmt.Errorf("received status %d when fetching JWKS from %s", res.StatusCode, ks.url)
+		}
+
+		reader = res.Body
+	}
+
+	defer reader.Close()
+
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(contents, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse JWKS: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			logrus.Warnf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
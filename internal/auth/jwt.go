@@ -0,0 +1,267 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"strings"
+	"time"
+)
+
+// JWTConfig represents the `[auth.jwt]` table, which enables authenticating
+// with JWTs from an identity provider as `Authorization: Bearer <jwt>`.
+type JWTConfig struct {
+	// Issuer is the `iss` claim that the tokens must have.
+	Issuer string `toml:"issuer"`
+
+	// Audience is the list of audiences, the `aud` claim must contain one of them.
+	// It is required, so tokens that were issued for other services are rejected.
+	Audience []string `toml:"audience"`
+
+	// JWKSURL is the URL to fetch the JSON Web Key Set that signs the tokens.
+	JWKSURL *string `toml:"jwks_url,omitempty"`
+
+	// JWKSFile is the path to a local JSON Web Key Set file, this is used
+	// rather than `jwks_url` if both are defined.
+	JWKSFile *string `toml:"jwks_file,omitempty"`
+
+	// Leeway is the clock skew to allow when checking `exp` and `nbf`, i.e. "30s".
+	Leeway *string `toml:"leeway,omitempty"`
+
+	// NameClaim is the claim to use as the principal name, defaults to `sub`.
+	NameClaim *string `toml:"name_claim,omitempty"`
+
+	// ScopesClaim is the claim that holds Tsubasa scopes (i.e. `search:products`),
+	// either as a space-separated string or an array. Defaults to `scope`, scopes
+	// that Tsubasa doesn't understand are ignored.
+	ScopesClaim *string `toml:"scopes_claim,omitempty"`
+
+	// IndicesClaim is the claim that holds the indices the token is allowed to search.
+	IndicesClaim *string `toml:"indices_claim,omitempty"`
+
+	// RolesClaim is the claim that holds the names of the roles (from `[auth.roles]`)
+	// that are assigned to the token.
+	RolesClaim *string `toml:"roles_claim,omitempty"`
+
+	// FiltersClaim is the claim that holds a query (or an array of queries) that every
+	// search with the token is filtered with, i.e. `{"term": {"tenant_id": 42}}`.
+	// Tokens without the claim are rejected, unless they have the `admin` scope.
+	FiltersClaim *string `toml:"filters_claim,omitempty"`
+
+	// AdminClaim is the claim that grants the `admin` scope. If AdminValue is defined,
+	// the claim must be (or contain) it, otherwise the claim must be `true`.
+	AdminClaim *string `toml:"admin_claim,omitempty"`
+
+	// AdminValue is the value that AdminClaim must have.
+	AdminValue *string `toml:"admin_value,omitempty"`
+}
+
+// JWTVerifier verifies JWTs and maps their claims to a Principal.
+type JWTVerifier struct {
+	config JWTConfig
+	keys   *KeySet
+	leeway time.Duration
+	parser *jwt.Parser
+}
+
+// NewJWTVerifier creates a new JWTVerifier and loads the key set.
+func NewJWTVerifier(config JWTConfig) (*JWTVerifier, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("`auth.jwt.issuer` is required")
+	}
+
+	if len(config.Audience) == 0 {
+		return nil, errors.New("`auth.jwt.audience` is required")
+	}
+
+	url := ""
+	if config.JWKSURL != nil {
+		url = *config.JWKSURL
+	}
+
+	file := ""
+	if config.JWKSFile != nil {
+		file = *config.JWKSFile
+	}
+
+	keys, err := NewKeySet(url, file)
+	if err != nil {
+		return nil, err
+	}
+
+	leeway := time.Duration(0)
+	if config.Leeway != nil {
+		leeway, err = time.ParseDuration(*config.Leeway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `auth.jwt.leeway` %q: %v", *config.Leeway, err)
+		}
+	}
+
+	return &JWTVerifier{
+		config: config,
+		keys:   keys,
+		leeway: leeway,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+			jwt.WithoutClaimsValidation(),
+		),
+	}, nil
+}
+
+// LooksLikeJWT returns if the token has the shape of a JWT.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify verifies the signature and the claims of the token, and returns the
+// Principal from its claims.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(kid)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !claims.VerifyExpiresAt(now.Add(-v.leeway).Unix(), true) {
+		return nil, errors.New("token is expired")
+	}
+
+	if !claims.VerifyNotBefore(now.Add(v.leeway).Unix(), false) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	if !claims.VerifyIssuer(v.config.Issuer, true) {
+		return nil, errors.New("token has an invalid issuer")
+	}
+
+	valid := false
+	for _, aud := range v.config.Audience {
+		if aud != "" && claims.VerifyAudience(aud, true) {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return nil, errors.New("token has an invalid audience")
+	}
+
+	return v.principal(claims)
+}
+
+func (v *JWTVerifier) principal(claims jwt.MapClaims) (*Principal, error) {
+	nameClaim := "sub"
+	if v.config.NameClaim != nil {
+		nameClaim = *v.config.NameClaim
+	}
+
+	name, _ := claims[nameClaim].(string)
+	scopes := make([]string, 0)
+
+	scopesClaim := "scope"
+	if v.config.ScopesClaim != nil {
+		scopesClaim = *v.config.ScopesClaim
+	}
+
+	for _, scope := range claimStrings(claims[scopesClaim]) {
+		if ValidateScope(scope) == nil {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if v.config.IndicesClaim != nil {
+		for _, index := range claimStrings(claims[*v.config.IndicesClaim]) {
+			scopes = append(scopes, ActionSearch+":"+index)
+		}
+	}
+
+	if v.config.RolesClaim != nil {
+		for _, role := range claimStrings(claims[*v.config.RolesClaim]) {
+			scopes = append(scopes, RoleScopePrefix+role)
+		}
+	}
+
+	if v.config.AdminClaim != nil {
+		admin := false
+		if v.config.AdminValue != nil {
+			for _, value := range claimStrings(claims[*v.config.AdminClaim]) {
+				if value == *v.config.AdminValue {
+					admin = true
+				}
+			}
+		} else {
+			admin, _ = claims[*v.config.AdminClaim].(bool)
+		}
+
+		if admin {
+			scopes = append(scopes, ActionAdmin)
+		}
+	}
+
+	var filters []map[string]interface{}
+	if v.config.FiltersClaim != nil {
+		switch claim := claims[*v.config.FiltersClaim].(type) {
+		case map[string]interface{}:
+			filters = append(filters, claim)
+
+		case []interface{}:
+			for _, element := range claim {
+				if filter, ok := element.(map[string]interface{}); ok {
+					filters = append(filters, filter)
+				}
+			}
+		}
+
+		if len(filters) == 0 && !containsString(scopes, ActionAdmin) {
+			return nil, fmt.Errorf("token is missing the %q claim", *v.config.FiltersClaim)
+		}
+	}
+
+	return &Principal{
+		Name:     name,
+		Provider: "jwt",
+		Scopes:   scopes,
+		Filters:  filters,
+	}, nil
+}
+
+// claimStrings returns a claim that is a space-separated string or an array of strings.
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+
+		return values
+
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,331 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JSON Web Key Set that can be changed, to test key rotation.
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int32
+	delay   time.Duration
+	failing int32
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+
+	s := &jwksServer{keys: map[string]*rsa.PrivateKey{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+		time.Sleep(s.delay)
+
+		if atomic.LoadInt32(&s.failing) == 1 {
+			w.WriteHeader(503)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		keys := make([]map[string]string, 0, len(s.keys))
+		for kid, key := range s.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// rotate replaces the keys of the set with a new key, and returns it.
+func (s *jwksServer) rotate(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+
+	s.mu.Lock()
+	s.keys = map[string]*rsa.PrivateKey{kid: key}
+	s.mu.Unlock()
+
+	return key
+}
+
+func newTestJWTVerifier(t *testing.T, url string) *JWTVerifier {
+	t.Helper()
+
+	verifier, err := NewJWTVerifier(JWTConfig{
+		Issuer:   "https://id.floofy.dev",
+		Audience: []string{"tsubasa"},
+		JWKSURL:  &url,
+	})
+
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+
+	return verifier
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":   "https://id.floofy.dev",
+		"aud":   "tsubasa",
+		"sub":   "noel",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "search:products",
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	server := newJWKSServer(t)
+	key := server.rotate(t, "1")
+	verifier := newTestJWTVerifier(t, server.URL)
+
+	principal, err := verifier.Verify(signJWT(t, key, "1", validClaims()))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if principal.Name != "noel" || !principal.Can(ActionSearch, "products") {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+}
+
+func TestJWTRejected(t *testing.T) {
+	server := newJWKSServer(t)
+	key := server.rotate(t, "1")
+	verifier := newTestJWTVerifier(t, server.URL)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"signed by another key", signJWT(t, other, "1", validClaims()), "verification error"},
+		{"unknown key id", signJWT(t, key, "2", validClaims()), "unknown key id"},
+		{"expired", signJWT(t, key, "1", with("exp", time.Now().Add(-time.Minute).Unix())), "expired"},
+		{"no expiry", signJWT(t, key, "1", with("exp", nil)), "expired"},
+		{"not valid yet", signJWT(t, key, "1", with("nbf", time.Now().Add(time.Hour).Unix())), "not valid yet"},
+		{"wrong issuer", signJWT(t, key, "1", with("iss", "https://evil.dev")), "issuer"},
+		{"no issuer", signJWT(t, key, "1", with("iss", nil)), "issuer"},
+		{"wrong audience", signJWT(t, key, "1", with("aud", "other-service")), "audience"},
+		{"no audience", signJWT(t, key, "1", with("aud", nil)), "audience"},
+		{"unsigned", "eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0.eyJzdWIiOiJub2VsIn0.", "signing method"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifier.Verify(test.token)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %q doesn't contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestJWTAudienceRequired(t *testing.T) {
+	url := "http://127.0.0.1:0"
+	if _, err := NewJWTVerifier(JWTConfig{Issuer: "https://id.floofy.dev", JWKSURL: &url}); err == nil || !strings.Contains(err.Error(), "audience") {
+		t.Fatalf("expected an error about the audience, got %v", err)
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	server := newJWKSServer(t)
+	oldKey := server.rotate(t, "1")
+	verifier := newTestJWTVerifier(t, server.URL)
+
+	if _, err := verifier.Verify(signJWT(t, oldKey, "1", validClaims())); err != nil {
+		t.Fatalf("Verify with the old key: %v", err)
+	}
+
+	newKey := server.rotate(t, "2")
+	token := signJWT(t, newKey, "2", validClaims())
+
+	// The set was just fetched, so unknown key ids don't fetch it again yet.
+	if _, err := verifier.Verify(token); err == nil {
+		t.Fatal("expected the new key to be unknown right after a fetch")
+	}
+
+	verifier.keys.mu.Lock()
+	verifier.keys.attempted = time.Now().Add(-2 * jwksMinRefreshInterval)
+	verifier.keys.mu.Unlock()
+
+	if _, err := verifier.Verify(token); err != nil {
+		t.Fatalf("Verify with the new key: %v", err)
+	}
+
+	if _, err := verifier.Verify(signJWT(t, oldKey, "1", validClaims())); err == nil {
+		t.Fatal("expected the old key to be rejected after it was rotated out")
+	}
+}
+
+func TestJWTKeyRefreshIsShared(t *testing.T) {
+	server := newJWKSServer(t)
+	server.rotate(t, "1")
+	verifier := newTestJWTVerifier(t, server.URL)
+
+	key := server.rotate(t, "2")
+	token := signJWT(t, key, "2", validClaims())
+
+	server.delay = 50 * time.Millisecond
+	atomic.StoreInt32(&server.fetches, 0)
+	verifier.keys.mu.Lock()
+	verifier.keys.attempted = time.Now().Add(-2 * jwksMinRefreshInterval)
+	verifier.keys.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(token)
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+
+	if fetches := atomic.LoadInt32(&server.fetches); fetches != 1 {
+		t.Fatalf("JWKS was fetched %d times, expected once", fetches)
+	}
+}
+
+func TestJWKSBackoff(t *testing.T) {
+	server := newJWKSServer(t)
+	key := server.rotate(t, "1")
+	verifier := newTestJWTVerifier(t, server.URL)
+
+	now := time.Now()
+	verifier.keys.now = func() time.Time { return now }
+
+	atomic.StoreInt32(&server.failing, 1)
+	atomic.StoreInt32(&server.fetches, 0)
+
+	// The set is stale, but the key is still used while the JWKS can't be fetched.
+	tests := []struct {
+		name    string
+		advance time.Duration
+		fetches int32
+	}{
+		{name: "stale set is fetched", advance: jwksRefreshInterval + time.Second, fetches: 1},
+		{name: "no fetch right after a failure", advance: time.Second, fetches: 1},
+		{name: "fetched after the backoff", advance: 2 * jwksMinRefreshInterval, fetches: 2},
+		{name: "backoff doubles", advance: 2*jwksMinRefreshInterval + time.Second, fetches: 2},
+		{name: "fetched after the doubled backoff", advance: 2 * jwksMinRefreshInterval, fetches: 3},
+	}
+
+	for _, test := range tests {
+		now = now.Add(test.advance)
+		if _, err := verifier.Verify(signJWT(t, key, "1", validClaims())); err != nil {
+			t.Fatalf("%s: Verify: %v", test.name, err)
+		}
+
+		if _, err := verifier.Verify(signJWT(t, key, "unknown", validClaims())); err == nil {
+			t.Fatalf("%s: expected an unknown key id to be rejected", test.name)
+		}
+
+		if fetches := atomic.LoadInt32(&server.fetches); fetches != test.fetches {
+			t.Fatalf("%s: JWKS was fetched %d times, expected %d", test.name, fetches, test.fetches)
+		}
+	}
+
+	// A successful fetch resets the backoff.
+	atomic.StoreInt32(&server.failing, 0)
+	now = now.Add(8*jwksMinRefreshInterval + time.Second)
+	if _, err := verifier.Verify(signJWT(t, key, "1", validClaims())); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	verifier.keys.mu.RLock()
+	failures, fetched := verifier.keys.failures, verifier.keys.fetched
+	verifier.keys.mu.RUnlock()
+
+	if failures != 0 || !fetched.Equal(now) {
+		t.Fatalf("expected the backoff to reset after a fetch, got %d failure(s) and fetched at %v", failures, fetched)
+	}
+}
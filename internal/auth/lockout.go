@@ -0,0 +1,178 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LockoutConfig represents the `[auth.lockout]` table, which locks out clients
+// after repeated failed Basic authentication attempts.
+type LockoutConfig struct {
+	// MaxFailures is how many failures are allowed before the client is locked
+	// out, by default it is 5.
+	MaxFailures *int `toml:"max_failures,omitempty"`
+
+	// Delay is how long the first lockout is, it doubles on every failure after
+	// that. By default, it is "1s".
+	Delay *string `toml:"delay,omitempty"`
+
+	// MaxDelay is the longest that a client can be locked out for, by default it
+	// is "15m". Failures are forgotten after this long without any failures.
+	MaxDelay *string `toml:"max_delay,omitempty"`
+}
+
+type failures struct {
+	count       int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+// Lockout tracks failed authentication attempts by key (i.e. the client IP or the
+// username), and locks out keys with a delay that doubles on every failure.
+type Lockout struct {
+	maxFailures int
+	delay       time.Duration
+	maxDelay    time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*failures
+	lastSweep time.Time
+}
+
+// NewLockout creates a new Lockout from the configuration.
+func NewLockout(config LockoutConfig) (*Lockout, error) {
+	l := &Lockout{
+		maxFailures: 5,
+		delay:       time.Second,
+		maxDelay:    15 * time.Minute,
+		failures:    map[string]*failures{},
+		lastSweep:   time.Now(),
+	}
+
+	if config.MaxFailures != nil {
+		l.maxFailures = *config.MaxFailures
+	}
+
+	if config.Delay != nil {
+		delay, err := time.ParseDuration(*config.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `delay` %q: %v", *config.Delay, err)
+		}
+
+		l.delay = delay
+	}
+
+	if config.MaxDelay != nil {
+		maxDelay, err := time.ParseDuration(*config.MaxDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `max_delay` %q: %v", *config.MaxDelay, err)
+		}
+
+		l.maxDelay = maxDelay
+	}
+
+	return l, nil
+}
+
+// Locked returns how long the longest-locked key is still locked out for, or 0
+// if none of them are.
+func (l *Lockout) Locked(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	longest := time.Duration(0)
+	for _, key := range keys {
+		if f, ok := l.failures[key]; ok && f.lockedUntil.After(now) {
+			if remaining := f.lockedUntil.Sub(now); remaining > longest {
+				longest = remaining
+			}
+		}
+	}
+
+	return longest
+}
+
+// Fail records a failed attempt for the keys.
+func (l *Lockout) Fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if !ok {
+			f = &failures{}
+			l.failures[key] = f
+		}
+
+		f.count++
+		f.last = now
+
+		if f.count >= l.maxFailures {
+			f.lockedUntil = now.Add(l.backoff(f.count - l.maxFailures))
+		}
+	}
+}
+
+// backoff returns the delay after the failures past MaxFailures, which is Delay
+// doubled that many times and clamped to MaxDelay. It is doubled step by step, so
+// a large count or Delay can't overflow into a negative delay.
+func (l *Lockout) backoff(failures int) time.Duration {
+	delay := l.delay
+	for i := 0; i < failures && delay < l.maxDelay; i++ {
+		if delay > l.maxDelay/2 {
+			return l.maxDelay
+		}
+
+		delay *= 2
+	}
+
+	if delay > l.maxDelay {
+		return l.maxDelay
+	}
+
+	return delay
+}
+
+// Succeed forgets the failed attempts of the keys.
+func (l *Lockout) Succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.failures, key)
+	}
+}
+
+// sweep forgets the keys that didn't fail for MaxDelay, at most once a minute.
+func (l *Lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+
+	l.lastSweep = now
+	for key, f := range l.failures {
+		if now.Sub(f.last) > l.maxDelay && now.After(f.lockedUntil) {
+			delete(l.failures, key)
+		}
+	}
+}
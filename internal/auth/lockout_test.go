@@ -0,0 +1,147 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLockout(t *testing.T, maxFailures int, delay string, maxDelay string) *Lockout {
+	t.Helper()
+
+	lockout, err := NewLockout(LockoutConfig{MaxFailures: &maxFailures, Delay: &delay, MaxDelay: &maxDelay})
+	if err != nil {
+		t.Fatalf("NewLockout: %v", err)
+	}
+
+	return lockout
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    string
+		maxDelay string
+		failures int
+		expected time.Duration
+	}{
+		{"first", "1s", "15m", 0, time.Second},
+		{"doubles", "1s", "15m", 1, 2 * time.Second},
+		{"doubles again", "1s", "15m", 4, 16 * time.Second},
+		{"clamped", "1s", "15m", 20, 15 * time.Minute},
+		{"clamped exactly", "1s", "8s", 3, 8 * time.Second},
+		{"delay above max", "1h", "15m", 0, 15 * time.Minute},
+		{"would overflow", "1h", "2562047h", 100, 2562047 * time.Hour},
+		{"many failures", "1s", "15m", math.MaxInt32, 15 * time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lockout := newTestLockout(t, 1, test.delay, test.maxDelay)
+			if got := lockout.backoff(test.failures); got != test.expected {
+				t.Errorf("backoff(%d) = %s, expected %s", test.failures, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestLockoutFail(t *testing.T) {
+	lockout := newTestLockout(t, 3, "1m", "15m")
+
+	for i := 0; i < 2; i++ {
+		lockout.Fail("ip:a")
+	}
+
+	if locked := lockout.Locked("ip:a"); locked != 0 {
+		t.Fatalf("locked for %s before MaxFailures", locked)
+	}
+
+	lockout.Fail("ip:a")
+	if locked := lockout.Locked("ip:a"); locked <= 0 || locked > time.Minute {
+		t.Fatalf("locked for %s after MaxFailures, expected up to 1m", locked)
+	}
+
+	lockout.Fail("ip:a")
+	if locked := lockout.Locked("ip:a"); locked <= time.Minute || locked > 2*time.Minute {
+		t.Fatalf("locked for %s after another failure, expected up to 2m", locked)
+	}
+
+	if locked := lockout.Locked("ip:b"); locked != 0 {
+		t.Fatalf("other key is locked for %s", locked)
+	}
+
+	lockout.Succeed("ip:a")
+	if locked := lockout.Locked("ip:a"); locked != 0 {
+		t.Fatalf("locked for %s after success", locked)
+	}
+}
+
+func TestBasicAuthenticatorLockout(t *testing.T) {
+	authenticator := &BasicAuthenticator{
+		Username: "noel",
+		Password: "hunter2",
+		Lockout:  newTestLockout(t, 2, "1m", "15m"),
+	}
+
+	attempt := func(ip string, password string) error {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.SetBasicAuth("noel", password)
+
+		_, err := authenticator.Authenticate(req)
+		return err
+	}
+
+	code := func(err error) string {
+		if err == nil {
+			return ""
+		}
+
+		return err.(*Error).Code
+	}
+
+	// Another client locks out the username, and itself.
+	for i := 0; i < 2; i++ {
+		if err := attempt("10.0.0.1", "wrong"); code(err) != "INVALID_CREDENTIALS" {
+			t.Fatalf("wrong password got %v, expected INVALID_CREDENTIALS", err)
+		}
+	}
+
+	// The username stays locked from other IPs, even with the correct password.
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := attempt(ip, "hunter2"); code(err) != "TOO_MANY_ATTEMPTS" {
+			t.Fatalf("locked username from %s got %v, expected TOO_MANY_ATTEMPTS", ip, err)
+		}
+	}
+
+	// Once the delay is over, the correct password works and the failures are forgotten.
+	authenticator.Lockout.mu.Lock()
+	for _, f := range authenticator.Lockout.failures {
+		f.lockedUntil = time.Now()
+	}
+	authenticator.Lockout.mu.Unlock()
+
+	if err := attempt("10.0.0.3", "hunter2"); err != nil {
+		t.Fatalf("correct password after the delay got %v, expected success", err)
+	}
+
+	if locked := authenticator.Lockout.Locked("user:noel"); locked != 0 {
+		t.Fatalf("username is still locked for %s after a success", locked)
+	}
+}
@@ -0,0 +1,287 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Actions that a scope can grant on an index, the `admin` scope grants every
+// action on every index and the admin routes.
+const (
+	ActionSearch = "search"
+	ActionWrite  = "write"
+	ActionAdmin  = "admin"
+)
+
+type principalKey struct{}
+
+// Principal is the identity that made a request and what it is allowed to do.
+type Principal struct {
+	// ID identifies the credential when its name isn't unique, i.e. the id of
+	// the API key. It can be empty.
+	ID string `json:"id,omitempty"`
+
+	// Name is the name of the principal, i.e. the name of the API key.
+	Name string `json:"name"`
+
+	// Provider is the Authenticator that authenticated the principal, i.e. `basic` or `api_key`.
+	Provider string `json:"provider"`
+
+	// Scopes are what the principal is allowed to do. A scope is either `admin`
+	// or `<action>:<index>`, where the index can be a glob pattern (i.e. `search:logs-*`),
+	// or `role:<name>` to assign a role from the `[auth.roles]` table.
+	Scopes []string `json:"scopes"`
+
+	// Filters are queries that every search by the principal is filtered with,
+	// regardless of its scopes or roles. This is used to pin a credential to a tenant.
+	Filters []map[string]interface{} `json:"filters,omitempty"`
+
+	// Actions restricts the actions that the principal can do, regardless of its
+	// scopes. If this is empty, the scopes decide.
+	Actions []string `json:"actions,omitempty"`
+
+	// Indices restricts the index patterns that the principal can access, regardless
+	// of its scopes. If this is empty, the scopes decide.
+	Indices []string `json:"indices,omitempty"`
+
+	// RateLimit is how many requests per minute the principal can make, 0 means
+	// that the principal has no limit of its own.
+	RateLimit int `json:"rate_limit,omitempty"`
+
+	// roles are the roles that were resolved from the `role:<name>` scopes.
+	roles []Role
+}
+
+// Anonymous returns the Principal that is used when authentication is disabled.
+func Anonymous() *Principal {
+	return &Principal{
+		Name:     "anonymous",
+		Provider: "anonymous",
+		Scopes:   []string{ActionAdmin},
+	}
+}
+
+// Can returns if the principal is allowed to do the action on the index. If index
+// is empty, the action must be granted on every index (`<action>:*`).
+func (p *Principal) Can(action string, index string) bool {
+	if !p.allowedByRestrictions(action, index) {
+		return false
+	}
+
+	if p.canWithScopes(action, index) {
+		return true
+	}
+
+	for _, role := range p.roles {
+		if role.grants(action, index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ResolveRoles resolves the `role:<name>` scopes of the principal with the role
+// definitions, scopes of roles that aren't defined grant nothing.
+func (p *Principal) ResolveRoles(roles map[string]Role) {
+	p.roles = nil
+	for _, scope := range p.Scopes {
+		if !strings.HasPrefix(scope, RoleScopePrefix) {
+			continue
+		}
+
+		if role, ok := roles[strings.TrimPrefix(scope, RoleScopePrefix)]; ok {
+			p.roles = append(p.roles, role)
+		}
+	}
+}
+
+// Fields returns the FieldFilter that applies to the principal when doing the
+// action on the index. It is `nil` (every field is visible) if a scope grants the
+// action, or if one of the roles that grants it doesn't restrict fields.
+func (p *Principal) Fields(action string, index string) FieldFilter {
+	if p.canWithScopes(action, index) {
+		return nil
+	}
+
+	var filter FieldFilter
+	for _, role := range p.roles {
+		if !role.grants(action, index) {
+			continue
+		}
+
+		if role.Fields == nil {
+			return nil
+		}
+
+		filter = append(filter, *role.Fields)
+	}
+
+	return filter
+}
+
+// QueryFilters returns the queries that searches by the principal on the index must
+// be filtered with, they are all required to match. The filters of the roles that
+// grant the action are combined so any of them can match, and they don't apply if a
+// scope or a role without a filter grants the action.
+func (p *Principal) QueryFilters(action string, index string) []map[string]interface{} {
+	filters := append([]map[string]interface{}{}, p.Filters...)
+	if p.canWithScopes(action, index) {
+		return filters
+	}
+
+	roleFilters := make([]interface{}, 0)
+	for _, role := range p.roles {
+		if !role.grants(action, index) {
+			continue
+		}
+
+		if len(role.Filter) == 0 {
+			return filters
+		}
+
+		roleFilters = append(roleFilters, role.Filter)
+	}
+
+	switch len(roleFilters) {
+	case 0:
+		return filters
+
+	case 1:
+		return append(filters, roleFilters[0].(map[string]interface{}))
+
+	default:
+		return append(filters, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should":               roleFilters,
+				"minimum_should_match": 1,
+			},
+		})
+	}
+}
+
+// allowedByRestrictions returns if the Actions and Indices restrictions allow the
+// action on the index.
+func (p *Principal) allowedByRestrictions(action string, index string) bool {
+	if len(p.Actions) > 0 && !containsString(p.Actions, action) {
+		return false
+	}
+
+	if len(p.Indices) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Indices {
+		if matchIndex(pattern, index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Principal) canWithScopes(action string, index string) bool {
+	for _, scope := range p.Scopes {
+		if scope == ActionAdmin {
+			return true
+		}
+
+		scopeAction, pattern, ok := strings.Cut(scope, ":")
+		if !ok || scopeAction != action {
+			continue
+		}
+
+		if matchIndex(pattern, index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchIndex returns if the index pattern of a scope, role or token matches the
+// index. The `*` pattern matches anything, other patterns only match a concrete
+// index name, since Elasticsearch would otherwise search more than the index that
+// was matched (i.e. `prod*` matches the string `products,secrets`).
+func matchIndex(pattern string, index string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if !ConcreteIndex(index) {
+		return false
+	}
+
+	matched, _ := path.Match(pattern, index)
+	return matched
+}
+
+// ConcreteIndex returns if the index is the name of a single index, rather than a
+// comma list, a wildcard, an exclusion (`-logs`), `_all` or an index of a remote
+// cluster (`cluster:logs`).
+func ConcreteIndex(index string) bool {
+	if index == "" || index == "." || index == ".." {
+		return false
+	}
+
+	if strings.ContainsAny(index, `,*?:"<>|\/ #`) {
+		return false
+	}
+
+	return !strings.HasPrefix(index, "-") && !strings.HasPrefix(index, "_") && !strings.HasPrefix(index, "+")
+}
+
+// ValidateScope checks if the scope is one that Tsubasa understands.
+func ValidateScope(scope string) error {
+	if scope == ActionAdmin {
+		return nil
+	}
+
+	action, pattern, ok := strings.Cut(scope, ":")
+	if !ok || pattern == "" {
+		return fmt.Errorf("scope %q must be `admin`, `role:<name>` or `<action>:<index>`", scope)
+	}
+
+	if action+":" == RoleScopePrefix {
+		return nil
+	}
+
+	if action != ActionSearch && action != ActionWrite {
+		return fmt.Errorf("scope %q has unknown action %q (expected `search` or `write`)", scope, action)
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("scope %q has an invalid index pattern: %v", scope, err)
+	}
+
+	return nil
+}
+
+// WithPrincipal returns a copy of the context with the principal attached.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal that made the request, or `nil` if
+// the request wasn't authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
@@ -0,0 +1,126 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import "testing"
+
+func TestPrincipalCan(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		action string
+		index  string
+		want   bool
+	}{
+		{"admin scope", []string{"admin"}, ActionWrite, "products,secrets", true},
+		{"exact scope", []string{"search:products"}, ActionSearch, "products", true},
+		{"other action", []string{"search:products"}, ActionWrite, "products", false},
+		{"other index", []string{"search:products"}, ActionSearch, "secrets", false},
+		{"wildcard scope", []string{"search:prod*"}, ActionSearch, "products", true},
+		{"wildcard scope with comma list", []string{"search:prod*"}, ActionSearch, "products,secrets", false},
+		{"wildcard scope with wildcard index", []string{"search:prod*"}, ActionSearch, "prod,*", false},
+		{"wildcard scope with question mark", []string{"search:prod*"}, ActionSearch, "prod?cts", false},
+		{"wildcard scope with exclusion", []string{"search:*-logs"}, ActionSearch, "-app-logs", false},
+		{"wildcard scope with _all", []string{"search:_*"}, ActionSearch, "_all", false},
+		{"wildcard scope with remote cluster", []string{"search:prod*"}, ActionSearch, "products:secrets", false},
+		{"exact scope with comma list", []string{"search:products"}, ActionSearch, "products,products", false},
+		{"star scope", []string{"search:*"}, ActionSearch, "products,secrets", true},
+		{"star scope without index", []string{"search:*"}, ActionSearch, "", true},
+		{"pattern scope without index", []string{"search:prod*"}, ActionSearch, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal := &Principal{Scopes: test.scopes}
+			if got := principal.Can(test.action, test.index); got != test.want {
+				t.Errorf("Can(%q, %q) with scopes %v = %v, want %v", test.action, test.index, test.scopes, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrincipalRestrictions(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		indices []string
+		action  string
+		index   string
+		want    bool
+	}{
+		{"no restrictions", nil, nil, ActionWrite, "products", true},
+		{"allowed action", []string{ActionSearch}, nil, ActionSearch, "products", true},
+		{"restricted action", []string{ActionSearch}, nil, ActionWrite, "products", false},
+		{"allowed index", nil, []string{"prod*"}, ActionSearch, "products", true},
+		{"restricted index", nil, []string{"prod*"}, ActionSearch, "secrets", false},
+		{"restricted comma list", nil, []string{"prod*"}, ActionSearch, "products,secrets", false},
+		{"restricted wildcard", nil, []string{"prod*"}, ActionSearch, "prod,*", false},
+		{"star index", nil, []string{"*"}, ActionSearch, "products,secrets", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			principal := &Principal{Scopes: []string{ActionAdmin}, Actions: test.actions, Indices: test.indices}
+			if got := principal.Can(test.action, test.index); got != test.want {
+				t.Errorf("Can(%q, %q) = %v, want %v", test.action, test.index, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConcreteIndex(t *testing.T) {
+	tests := map[string]bool{
+		"products":         true,
+		"logs-2022.07.01":  true,
+		".tsubasa-audit":   true,
+		"":                 false,
+		".":                false,
+		"..":               false,
+		"products,secrets": false,
+		"prod*":            false,
+		"prod?":            false,
+		"-products":        false,
+		"+products":        false,
+		"_all":             false,
+		"cluster:products": false,
+		"products/_doc":    false,
+	}
+
+	for index, want := range tests {
+		if got := ConcreteIndex(index); got != want {
+			t.Errorf("ConcreteIndex(%q) = %v, want %v", index, got, want)
+		}
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	tests := map[string]bool{
+		"admin":           true,
+		"search:products": true,
+		"write:logs-*":    true,
+		"role:support":    true,
+		"search":          false,
+		"search:":         false,
+		"delete:products": false,
+		"search:[":        false,
+	}
+
+	for scope, valid := range tests {
+		if err := ValidateScope(scope); (err == nil) != valid {
+			t.Errorf("ValidateScope(%q) = %v, want valid %v", scope, err, valid)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BasicAuthenticator authenticates requests with the `username` and `password`
+// from the configuration, the password can be a bcrypt or argon2id hash. The
+// principal has the `admin` scope.
+type BasicAuthenticator struct {
+	Username string
+	Password string
+
+	// Lockout locks out the client IP and the username after repeated failures.
+	Lockout *Lockout
+}
+
+func (a *BasicAuthenticator) Name() string {
+	return "basic"
+}
+
+func (a *BasicAuthenticator) Challenge() string {
+	return `Basic realm="Noel/Tsubasa"`
+}
+
+func (a *BasicAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	// The username is locked out too, so a brute force from many IPs is slowed down
+	// as well. Its delay starts short and doubles on every failure, so other clients
+	// can only hold the real user back for a while.
+	ipKey, userKey := "ip:"+host, "user:"+user
+	if locked := a.Lockout.Locked(ipKey, userKey); locked > 0 {
+		return nil, tooManyAttempts(locked)
+	}
+
+	// Both are always checked, so the response time doesn't tell if the username exists.
+	validUser := subtle.ConstantTimeCompare([]byte(a.Username), []byte(user)) == 1
+	validPass := VerifyPassword(a.Password, pass)
+
+	if !validUser || !validPass {
+		a.Lockout.Fail(ipKey, userKey)
+		return nil, &Error{Code: "INVALID_CREDENTIALS", Message: "Invalid username or password."}
+	}
+
+	a.Lockout.Succeed(ipKey, userKey)
+	return &Principal{
+		Name:     user,
+		Provider: a.Name(),
+		Scopes:   []string{ActionAdmin},
+	}, nil
+}
+
+func tooManyAttempts(locked time.Duration) *Error {
+	return &Error{
+		Code:       "TOO_MANY_ATTEMPTS",
+		Message:    "Too many failed attempts, try again later.",
+		RetryAfter: locked,
+	}
+}
+
+// APIKeyAuthenticator authenticates requests with API keys and the search tokens
+// that they sign, as `Authorization: Bearer <token>`.
+type APIKeyAuthenticator struct {
+	Store *APIKeyStore
+}
+
+func (a *APIKeyAuthenticator) Name() string {
+	return "api_key"
+}
+
+func (a *APIKeyAuthenticator) Challenge() string {
+	return `Bearer realm="Noel/Tsubasa"`
+}
+
+func (a *APIKeyAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	switch {
+	case strings.HasPrefix(token, APIKeyPrefix):
+		key, ok := a.Store.Verify(token)
+		if !ok {
+			return nil, &Error{Code: "INVALID_TOKEN", Message: "Invalid bearer token."}
+		}
+
+		return &Principal{
+			ID:       key.ID,
+			Name:     key.Name,
+			Provider: a.Name(),
+			Scopes:   key.Scopes,
+			Filters:  key.Filters,
+		}, nil
+
+	case strings.HasPrefix(token, SearchTokenPrefix):
+		claims, key, err := a.Store.VerifySearchToken(token)
+		if err != nil {
+			return nil, &Error{Code: "INVALID_TOKEN", Message: fmt.Sprintf("Invalid search token: %v.", err)}
+		}
+
+		principal := claims.Principal(key)
+
+		// Search tokens are stateless, so they are identified by their signature.
+		principal.ID = token[strings.LastIndex(token, ".")+1:]
+		return principal, nil
+
+	default:
+		return nil, ErrNoCredentials
+	}
+}
+
+func (v *JWTVerifier) Name() string {
+	return "jwt"
+}
+
+func (v *JWTVerifier) Challenge() string {
+	return `Bearer realm="Noel/Tsubasa"`
+}
+
+// Authenticate verifies the JWT of the `Authorization: Bearer <jwt>` header.
+func (v *JWTVerifier) Authenticate(req *http.Request) (*Principal, error) {
+	token, ok := bearerToken(req)
+	if !ok || !LooksLikeJWT(token) {
+		return nil, ErrNoCredentials
+	}
+
+	principal, err := v.Verify(token)
+	if err != nil {
+		return nil, &Error{Code: "INVALID_TOKEN", Message: fmt.Sprintf("Invalid JWT: %v.", err)}
+	}
+
+	return principal, nil
+}
+
+// MTLSConfig represents the `[auth.mtls]` table, which authenticates requests
+// with the verified TLS client certificate.
+type MTLSConfig struct {
+	// Principals maps certificate subjects to their scopes. The key is either the
+	// common name (i.e. `backend.internal`) or the full subject (i.e. `CN=backend,O=Noel`).
+	Principals map[string][]string `toml:"principals"`
+}
+
+// MTLSAuthenticator authenticates requests with the verified TLS client certificate.
+type MTLSAuthenticator struct {
+	config MTLSConfig
+}
+
+// NewMTLSAuthenticator creates a new MTLSAuthenticator and validates the scopes.
+func NewMTLSAuthenticator(config MTLSConfig) (*MTLSAuthenticator, error) {
+	for subject, scopes := range config.Principals {
+		for _, scope := range scopes {
+			if err := ValidateScope(scope); err != nil {
+				return nil, fmt.Errorf("certificate subject %q: %v", subject, err)
+			}
+		}
+	}
+
+	return &MTLSAuthenticator{config: config}, nil
+}
+
+func (a *MTLSAuthenticator) Name() string {
+	return "mtls"
+}
+
+func (a *MTLSAuthenticator) Challenge() string {
+	return ""
+}
+
+func (a *MTLSAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	name := subject.CommonName
+
+	scopes, ok := a.config.Principals[name]
+	if !ok {
+		name = subject.String()
+		scopes, ok = a.config.Principals[name]
+	}
+
+	// The certificate could be for other services behind the same proxy, so the
+	// request can still authenticate with an API key or a JWT.
+	if !ok {
+		return nil, &Error{
+			Code:        "UNKNOWN_CERTIFICATE",
+			Message:     fmt.Sprintf("Client certificate '%s' is not allowed.", subject.String()),
+			Fallthrough: true,
+		}
+	}
+
+	return &Principal{
+		Name:     name,
+		Provider: a.Name(),
+		Scopes:   scopes,
+	}, nil
+}
+
+// TrustedHeaderConfig represents the `[auth.trusted_header]` table, which trusts
+// the identity that a reverse proxy (i.e. an OAuth2 proxy) sets in a header.
+type TrustedHeaderConfig struct {
+	// UserHeader is the header that has the name of the user, i.e. `X-Forwarded-User`.
+	UserHeader string `toml:"user_header"`
+
+	// ScopesHeader is the header that has the space or comma-separated scopes of the user.
+	ScopesHeader *string `toml:"scopes_header,omitempty"`
+
+	// DefaultScopes are the scopes of the user if the scopes header is not set.
+	DefaultScopes []string `toml:"default_scopes,omitempty"`
+
+	// TrustedProxies are the IPs or CIDRs of the proxies that are allowed to set
+	// the headers. Requests from anywhere else can't use the headers.
+	TrustedProxies []string `toml:"trusted_proxies"`
+}
+
+// TrustedHeaderAuthenticator authenticates requests from a trusted reverse proxy
+// with the user that it sets in a header.
+type TrustedHeaderAuthenticator struct {
+	config  TrustedHeaderConfig
+	proxies []*net.IPNet
+}
+
+// NewTrustedHeaderAuthenticator creates a new TrustedHeaderAuthenticator.
+func NewTrustedHeaderAuthenticator(config TrustedHeaderConfig) (*TrustedHeaderAuthenticator, error) {
+	if config.UserHeader == "" {
+		return nil, fmt.Errorf("`user_header` is required")
+	}
+
+	if len(config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("`trusted_proxies` is required, or anyone could set the headers")
+	}
+
+	for _, scope := range config.DefaultScopes {
+		if err := ValidateScope(scope); err != nil {
+			return nil, err
+		}
+	}
+
+	proxies, err := ParseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrustedHeaderAuthenticator{config: config, proxies: proxies}, nil
+}
+
+func (a *TrustedHeaderAuthenticator) Name() string {
+	return "trusted_header"
+}
+
+func (a *TrustedHeaderAuthenticator) Challenge() string {
+	return ""
+}
+
+func (a *TrustedHeaderAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	user := req.Header.Get(a.config.UserHeader)
+	if user == "" {
+		return nil, ErrNoCredentials
+	}
+
+	if !ContainsIP(a.proxies, PeerAddress(req)) {
+		return nil, &Error{Code: "UNTRUSTED_PROXY", Message: fmt.Sprintf("Header '%s' can only be set by a trusted proxy.", a.config.UserHeader)}
+	}
+
+	scopes := a.config.DefaultScopes
+	if a.config.ScopesHeader != nil {
+		if header := req.Header.Get(*a.config.ScopesHeader); header != "" {
+			scopes = make([]string, 0)
+			for _, scope := range strings.FieldsFunc(header, func(r rune) bool { return r == ',' || r == ' ' }) {
+				if ValidateScope(scope) == nil {
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+	}
+
+	return &Principal{
+		Name:     user,
+		Provider: a.Name(),
+		Scopes:   scopes,
+	}, nil
+}
+
+// ParseCIDRs parses a list of IPs and CIDRs, IPs are treated as single-address CIDRs.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", value)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", value, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// ContainsIP returns if the address (an IP, or `host:port`) is in one of the networks.
+func ContainsIP(networks []*net.IPNet, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,579 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fieldQueries are the queries where the keys of the query body are field
+// names, i.e. `{"term": {"user.id": "kimchy"}}`.
+var fieldQueries = map[string]bool{
+	"match":               true,
+	"match_phrase":        true,
+	"match_phrase_prefix": true,
+	"match_bool_prefix":   true,
+	"term":                true,
+	"terms":               true,
+	"terms_set":           true,
+	"range":               true,
+	"prefix":              true,
+	"wildcard":            true,
+	"regexp":              true,
+	"fuzzy":               true,
+	"intervals":           true,
+	"span_term":           true,
+	"geo_distance":        true,
+	"geo_bounding_box":    true,
+	"geo_polygon":         true,
+	"geo_shape":           true,
+	"shape":               true,
+}
+
+// fieldsQueries are the full text queries that search the fields in `fields`, they
+// search the `index.query.default_field` setting (every field) without it.
+var fieldsQueries = map[string]bool{
+	"simple_query_string": true,
+	"multi_match":         true,
+	"combined_fields":     true,
+	"more_like_this":      true,
+}
+
+// fieldQueryOptions are the keys of field queries that are options rather than
+// field names.
+var fieldQueryOptions = map[string]bool{
+	"boost":             true,
+	"_name":             true,
+	"distance":          true,
+	"distance_type":     true,
+	"validation_method": true,
+	"ignore_unmapped":   true,
+	"type":              true,
+	"order":             true,
+	"unit":              true,
+	"mode":              true,
+	"relation":          true,
+}
+
+// subQueries are the keys of compound queries that hold one query or a list of
+// queries, i.e. `must` of `bool`. Other keys of compound queries are options.
+var subQueries = map[string]map[string]bool{
+	"bool":               {"must": true, "filter": true, "should": true, "must_not": true},
+	"constant_score":     {"filter": true},
+	"boosting":           {"positive": true, "negative": true},
+	"dis_max":            {"queries": true},
+	"nested":             {"query": true},
+	"has_child":          {"query": true},
+	"has_parent":         {"query": true},
+	"pinned":             {"organic": true},
+	"span_near":          {"clauses": true},
+	"span_or":            {"clauses": true},
+	"span_not":           {"include": true, "exclude": true},
+	"span_first":         {"match": true},
+	"span_containing":    {"big": true, "little": true},
+	"span_within":        {"big": true, "little": true},
+	"span_multi":         {"match": true},
+	"field_masking_span": {"query": true},
+}
+
+// searchOptions are the keys of a search body that don't reference fields.
+var searchOptions = map[string]bool{
+	"from":                true,
+	"size":                true,
+	"timeout":             true,
+	"terminate_after":     true,
+	"track_total_hits":    true,
+	"track_scores":        true,
+	"min_score":           true,
+	"explain":             true,
+	"version":             true,
+	"seq_no_primary_term": true,
+	"search_after":        true,
+	"indices_boost":       true,
+	"profile":             true,
+	"pit":                 true,
+	"stats":               true,
+}
+
+// scriptKeys are the keys that can read any field through a script, they are
+// not allowed when fields are restricted.
+var scriptKeys = map[string]bool{
+	"script":           true,
+	"script_fields":    true,
+	"script_score":     true,
+	"runtime_mappings": true,
+	"init_script":      true,
+	"map_script":       true,
+	"combine_script":   true,
+	"reduce_script":    true,
+}
+
+// CheckQuery checks that a search body only queries, sorts, aggregates and
+// highlights on fields that the filter allows.
+func (f FieldFilter) CheckQuery(body map[string]interface{}) error {
+	if f == nil {
+		return nil
+	}
+
+	fields, err := ReferencedFields(body)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		if strings.ContainsAny(field, "*?") {
+			return fmt.Errorf("wildcard field pattern '%s' can't be used on restricted fields", field)
+		}
+
+		if !f.Allowed(field) {
+			return fmt.Errorf("field '%s' is not allowed", field)
+		}
+	}
+
+	return nil
+}
+
+// ReferencedFields returns the fields that a search body references in its queries,
+// aggregations, sorts, highlights and fetched fields. Only the parts of the search
+// API where the fields are known are allowed, so an error is returned for anything
+// else, i.e. scripts, `query_string`, `wrapper` or query types that aren't known.
+func ReferencedFields(body map[string]interface{}) ([]string, error) {
+	w := &fieldWalker{fields: map[string]bool{}}
+	w.walkBody(body)
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	fields := make([]string, 0, len(w.fields))
+	for field := range w.fields {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+	return fields, nil
+}
+
+type fieldWalker struct {
+	fields map[string]bool
+	err    error
+}
+
+func (w *fieldWalker) add(field string) {
+	// Strip the boost of `multi_match` fields, i.e. `title^3`.
+	if i := strings.Index(field, "^"); i >= 0 {
+		field = field[:i]
+	}
+
+	if field != "" && field != "_score" && field != "_doc" {
+		w.fields[field] = true
+	}
+}
+
+func (w *fieldWalker) fail(format string, args ...interface{}) {
+	if w.err == nil {
+		w.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (w *fieldWalker) addAll(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		w.add(v)
+
+	case []interface{}:
+		for _, element := range v {
+			w.addAll(element)
+		}
+
+	case map[string]interface{}:
+		// i.e. `{"field": "created_at", "format": "epoch_millis"}` in `docvalue_fields`
+		if field, ok := v["field"].(string); ok {
+			w.add(field)
+		}
+	}
+}
+
+// walkBody walks the top-level keys of a search body.
+func (w *fieldWalker) walkBody(body map[string]interface{}) {
+	for key, value := range body {
+		switch {
+		case scriptKeys[key]:
+			w.fail("'%s' can't be used on restricted fields", key)
+
+		case key == "query" || key == "post_filter":
+			w.walkQuery(value)
+
+		case key == "fields" || key == "docvalue_fields" || key == "stored_fields":
+			w.addAll(value)
+
+		case key == "sort":
+			w.walkSort(value)
+
+		case key == "highlight":
+			w.walkHighlight(value)
+
+		case key == "aggs" || key == "aggregations":
+			w.walkAggregations(value)
+
+		case key == "collapse":
+			w.walkCollapse(value)
+
+		case key == "rescore":
+			w.walkRescore(value)
+
+		case key == "_source" || searchOptions[key]:
+			// The source is filtered from the response, so it can reference anything.
+
+		default:
+			w.fail("'%s' can't be used on restricted fields", key)
+		}
+	}
+}
+
+// walkQuery walks a query, or a list of queries. Only the query types where the
+// referenced fields are known are allowed.
+func (w *fieldWalker) walkQuery(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			w.walkQuery(element)
+		}
+
+	case map[string]interface{}:
+		for kind, body := range v {
+			w.walkQueryType(kind, body)
+		}
+
+	default:
+		w.fail("queries must be objects")
+	}
+}
+
+func (w *fieldWalker) walkQueryType(kind string, value interface{}) {
+	body, _ := value.(map[string]interface{})
+
+	switch {
+	case kind == "match_all" || kind == "match_none" || kind == "ids":
+
+	case fieldQueries[kind]:
+		for field := range body {
+			if !fieldQueryOptions[field] {
+				w.add(field)
+			}
+		}
+
+	case fieldsQueries[kind]:
+		fields, ok := body["fields"]
+		if !ok {
+			w.fail("'%s' must declare 'fields' when fields are restricted", kind)
+			return
+		}
+
+		w.addAll(fields)
+		if kind == "more_like_this" {
+			w.walkLikeDocuments(body["like"])
+			w.walkLikeDocuments(body["unlike"])
+		}
+
+	case kind == "exists" || kind == "rank_feature" || kind == "distance_feature":
+		w.addAll(body["field"])
+
+	case kind == "function_score":
+		w.walkFunctionScore(body)
+
+	case subQueries[kind] != nil:
+		for key, inner := range body {
+			switch {
+			case subQueries[kind][key]:
+				w.walkQuery(inner)
+
+			case key == "inner_hits":
+				// Inner hits have the `_source` of the matched documents, which isn't filtered.
+				w.fail("'inner_hits' can't be used on restricted fields")
+
+			case kind == "field_masking_span" && key == "field":
+				w.addAll(inner)
+			}
+		}
+
+	case kind == "query_string":
+		w.fail("'query_string' can't be used on restricted fields, use 'simple_query_string' with 'fields' instead")
+
+	case scriptKeys[kind]:
+		w.fail("'%s' can't be used on restricted fields", kind)
+
+	default:
+		// i.e. `wrapper` queries are encoded, so the fields that they reference can't be known.
+		w.fail("'%s' queries can't be used on restricted fields", kind)
+	}
+}
+
+// walkLikeDocuments walks the `like` and `unlike` documents of `more_like_this`,
+// artificial documents (`{"doc": {...}}`) reference their fields.
+func (w *fieldWalker) walkLikeDocuments(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			w.walkLikeDocuments(element)
+		}
+
+	case map[string]interface{}:
+		if doc, ok := v["doc"].(map[string]interface{}); ok {
+			for field := range doc {
+				w.add(field)
+			}
+		}
+
+		w.addAll(v["fields"])
+	}
+}
+
+func (w *fieldWalker) walkFunctionScore(body map[string]interface{}) {
+	if query, ok := body["query"]; ok {
+		w.walkQuery(query)
+	}
+
+	functions, _ := body["functions"].([]interface{})
+	functions = append(functions, body)
+	for _, element := range functions {
+		function, ok := element.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for key, inner := range function {
+			switch key {
+			case "query", "functions", "boost", "boost_mode", "score_mode", "max_boost", "min_score", "weight":
+
+			case "filter":
+				w.walkQuery(inner)
+
+			case "field_value_factor", "random_score":
+				if m, ok := inner.(map[string]interface{}); ok {
+					w.addAll(m["field"])
+				}
+
+			case "gauss", "linear", "exp":
+				if m, ok := inner.(map[string]interface{}); ok {
+					for field := range m {
+						if field != "multi_value_mode" {
+							w.add(field)
+						}
+					}
+				}
+
+			default:
+				w.fail("'%s' can't be used on restricted fields", key)
+			}
+		}
+	}
+}
+
+func (w *fieldWalker) walkCollapse(value interface{}) {
+	body, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	w.addAll(body["field"])
+	if _, ok := body["inner_hits"]; ok {
+		w.fail("'inner_hits' can't be used on restricted fields")
+	}
+}
+
+func (w *fieldWalker) walkRescore(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			w.walkRescore(element)
+		}
+
+	case map[string]interface{}:
+		if query, ok := v["query"].(map[string]interface{}); ok {
+			w.walkQuery(query["rescore_query"])
+		}
+	}
+}
+
+func (w *fieldWalker) walkSort(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		w.add(v)
+
+	case []interface{}:
+		for _, element := range v {
+			w.walkSort(element)
+		}
+
+	case map[string]interface{}:
+		for field, options := range v {
+			switch field {
+			case "_script":
+				w.fail("'_script' sorts can't be used on restricted fields")
+
+			case "_geo_distance":
+				if body, ok := options.(map[string]interface{}); ok {
+					for geoField := range body {
+						if !fieldQueryOptions[geoField] {
+							w.add(geoField)
+						}
+					}
+				}
+
+			default:
+				w.add(field)
+				if body, ok := options.(map[string]interface{}); ok {
+					if nested, ok := body["nested"]; ok {
+						w.walkNestedSort(nested)
+					}
+				}
+			}
+		}
+	}
+}
+
+// walkNestedSort walks the `nested` option of a sort, which can filter the nested
+// documents and have a `nested` option of its own.
+func (w *fieldWalker) walkNestedSort(value interface{}) {
+	body, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if filter, ok := body["filter"]; ok {
+		w.walkQuery(filter)
+	}
+
+	if nested, ok := body["nested"]; ok {
+		w.walkNestedSort(nested)
+	}
+}
+
+func (w *fieldWalker) walkHighlight(value interface{}) {
+	body, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	switch fields := body["fields"].(type) {
+	case map[string]interface{}:
+		for field := range fields {
+			w.add(field)
+		}
+
+	case []interface{}:
+		for _, element := range fields {
+			if m, ok := element.(map[string]interface{}); ok {
+				for field := range m {
+					w.add(field)
+				}
+			}
+		}
+	}
+
+	if query, ok := body["highlight_query"]; ok {
+		w.walkQuery(query)
+	}
+}
+
+// walkAggregations walks `{"<name>": {"<type>": {...}, "aggs": {...}}}`, aggregation
+// bodies reference fields with `field`, except for the ones that hold queries.
+func (w *fieldWalker) walkAggregations(value interface{}) {
+	aggs, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for _, agg := range aggs {
+		definition, ok := agg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for kind, body := range definition {
+			switch kind {
+			case "aggs", "aggregations":
+				w.walkAggregations(body)
+
+			case "filter":
+				w.walkQuery(body)
+
+			case "top_hits":
+				// Aggregations are returned as-is, so the `_source` of the hits isn't filtered.
+				w.fail("'top_hits' aggregations can't be used on restricted fields")
+
+			case "filters", "adjacency_matrix":
+				if m, ok := body.(map[string]interface{}); ok {
+					w.walkNamedQueries(m["filters"])
+				}
+
+			case "scripted_metric":
+				w.fail("'scripted_metric' aggregations can't be used on restricted fields")
+
+			case "meta":
+				// Metadata is returned as-is and doesn't reference fields.
+
+			default:
+				w.walkAggregationBody(body)
+			}
+		}
+	}
+}
+
+func (w *fieldWalker) walkAggregationBody(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			w.walkAggregationBody(element)
+		}
+
+	case map[string]interface{}:
+		for key, inner := range v {
+			switch {
+			case scriptKeys[key]:
+				w.fail("'%s' can't be used on restricted fields", key)
+
+			case key == "field" || key == "fields":
+				w.addAll(inner)
+
+			case key == "sort":
+				w.walkSort(inner)
+
+			case key == "filter" || key == "background_filter":
+				w.walkQuery(inner)
+
+			default:
+				w.walkAggregationBody(inner)
+			}
+		}
+	}
+}
+
+// walkNamedQueries walks the queries of `filters` aggregations, which are a list
+// or an object of named queries.
+func (w *fieldWalker) walkNamedQueries(value interface{}) {
+	switch v := value.(type) {
+	case []interface{}:
+		w.walkQuery(v)
+
+	case map[string]interface{}:
+		for _, query := range v {
+			w.walkQuery(query)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// RoleScopePrefix is the prefix of scopes that assign a role, i.e. `role:support`.
+const RoleScopePrefix = "role:"
+
+// Role represents a role in the `[auth.roles.<name>]` table. Roles are assigned
+// to credentials with the `role:<name>` scope.
+type Role struct {
+	// Indices are the index patterns the role can access, i.e. `["products", "logs-*"]`.
+	Indices []string `toml:"indices"`
+
+	// Actions are the actions the role can do on the indices, i.e. `["search"]`.
+	Actions []string `toml:"actions"`
+
+	// Fields restricts which fields the role can see and query. If this is not
+	// defined, every field is visible.
+	Fields *FieldPolicy `toml:"fields,omitempty"`
+
+	// Filter is a query that every search by the role is filtered with, i.e.
+	// `{ term = { tenant_id = 42 } }`, so the role can only see the documents
+	// that match it.
+	Filter map[string]interface{} `toml:"filter,omitempty"`
+}
+
+// FieldPolicy represents the fields a role can see and query, fields are
+// dotted paths and can be glob patterns. Including or excluding an object
+// field applies to all of its children.
+type FieldPolicy struct {
+	// Include is the list of fields that are visible, if this is empty, every
+	// field that isn't excluded is visible.
+	Include []string `toml:"include,omitempty"`
+
+	// Exclude is the list of fields that are hidden, this takes precedence over Include.
+	Exclude []string `toml:"exclude,omitempty"`
+}
+
+// FieldFilter is the combination of the field policies that apply to a principal
+// on an index, a field is allowed if any of the policies allow it. A `nil`
+// FieldFilter allows every field.
+type FieldFilter []FieldPolicy
+
+// Validate checks that the role only has actions and patterns that Tsubasa understands.
+func (r Role) Validate() error {
+	for _, action := range r.Actions {
+		if action != ActionSearch && action != ActionWrite && action != "*" {
+			return fmt.Errorf("unknown action %q (expected `search`, `write` or `*`)", action)
+		}
+	}
+
+	for _, pattern := range r.Indices {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid index pattern %q: %v", pattern, err)
+		}
+	}
+
+	if r.Fields != nil {
+		for _, pattern := range append(append([]string{}, r.Fields.Include...), r.Fields.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid field pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// grants returns if the role allows the action on the index.
+func (r Role) grants(action string, index string) bool {
+	if !containsString(r.Actions, action) && !containsString(r.Actions, "*") {
+		return false
+	}
+
+	for _, pattern := range r.Indices {
+		if matchIndex(pattern, index) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allowed returns if the field is allowed by the policy.
+func (f FieldPolicy) Allowed(field string) bool {
+	for _, pattern := range f.Exclude {
+		if matchFieldOrParent(pattern, field) {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.Include {
+		// The parents of included fields are allowed too, so the object
+		// that holds them can be traversed.
+		if matchFieldOrParent(pattern, field) || strings.HasPrefix(pattern, field+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Excluded returns if the field (or one of its parents) is explicitly excluded
+// by every policy.
+func (f FieldFilter) Excluded(field string) bool {
+	if f == nil {
+		return false
+	}
+
+	for _, policy := range f {
+		excluded := false
+		for _, pattern := range policy.Exclude {
+			if matchFieldOrParent(pattern, field) {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Allowed returns if any of the policies allow the field.
+func (f FieldFilter) Allowed(field string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, policy := range f {
+		if policy.Allowed(field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterSource removes the fields that are not allowed from a document's `_source`.
+func (f FieldFilter) FilterSource(source map[string]interface{}) map[string]interface{} {
+	if f == nil {
+		return source
+	}
+
+	return f.filterObject("", source)
+}
+
+func (f FieldFilter) filterObject(prefix string, object map[string]interface{}) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(object))
+	for key, value := range object {
+		field := key
+		if prefix != "" {
+			field = prefix + "." + key
+		}
+
+		if v, ok := f.filterValue(field, value); ok {
+			filtered[key] = v
+		}
+	}
+
+	return filtered
+}
+
+func (f FieldFilter) filterValue(field string, value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if f.Excluded(field) {
+			return nil, false
+		}
+
+		object := f.filterObject(field, v)
+		if len(object) == 0 && !f.Allowed(field) {
+			return nil, false
+		}
+
+		return object, true
+
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			if e, ok := f.filterValue(field, element); ok {
+				values = append(values, e)
+			}
+		}
+
+		if len(values) == 0 && !f.Allowed(field) {
+			return nil, false
+		}
+
+		return values, true
+
+	default:
+		return value, f.Allowed(field)
+	}
+}
+
+// matchFieldOrParent returns if the pattern matches the field or one of its parents.
+func matchFieldOrParent(pattern string, field string) bool {
+	for {
+		if matched, _ := path.Match(pattern, field); matched {
+			return true
+		}
+
+		i := strings.LastIndex(field, ".")
+		if i < 0 {
+			return false
+		}
+
+		field = field[:i]
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,217 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoleGrants(t *testing.T) {
+	role := Role{Indices: []string{"products", "logs-*"}, Actions: []string{ActionSearch}}
+	tests := []struct {
+		action string
+		index  string
+		want   bool
+	}{
+		{ActionSearch, "products", true},
+		{ActionSearch, "logs-2022", true},
+		{ActionWrite, "products", false},
+		{ActionSearch, "secrets", false},
+		{ActionSearch, "logs-2022,secrets", false},
+		{ActionSearch, "logs-*", false},
+		{ActionSearch, "logs-,*", false},
+		{ActionSearch, "_all", false},
+		{ActionSearch, "", false},
+	}
+
+	for _, test := range tests {
+		if got := role.grants(test.action, test.index); got != test.want {
+			t.Errorf("grants(%q, %q) = %v, want %v", test.action, test.index, got, test.want)
+		}
+	}
+
+	all := Role{Indices: []string{"*"}, Actions: []string{"*"}}
+	if !all.grants(ActionWrite, "products,secrets") || !all.grants(ActionSearch, "") {
+		t.Error("role with `*` index and action should grant everything")
+	}
+}
+
+func TestPrincipalRoles(t *testing.T) {
+	roles := map[string]Role{
+		"support": {
+			Indices: []string{"tickets-*"},
+			Actions: []string{ActionSearch},
+			Fields:  &FieldPolicy{Exclude: []string{"customer.email"}},
+			Filter:  map[string]interface{}{"term": map[string]interface{}{"tenant": "a"}},
+		},
+	}
+
+	principal := &Principal{Scopes: []string{"role:support", "role:unknown"}}
+	principal.ResolveRoles(roles)
+
+	if !principal.Can(ActionSearch, "tickets-2022") {
+		t.Error("role should grant search on tickets-2022")
+	}
+
+	if principal.Can(ActionSearch, "tickets-2022,secrets") {
+		t.Error("role shouldn't grant search on a comma list")
+	}
+
+	fields := principal.Fields(ActionSearch, "tickets-2022")
+	if fields == nil || fields.Allowed("customer.email") || !fields.Allowed("customer.name") {
+		t.Errorf("unexpected field filter %v", fields)
+	}
+
+	filters := principal.QueryFilters(ActionSearch, "tickets-2022")
+	if len(filters) != 1 || !reflect.DeepEqual(filters[0], roles["support"].Filter) {
+		t.Errorf("unexpected query filters %v", filters)
+	}
+}
+
+func TestRoleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		role  Role
+		valid bool
+	}{
+		{"valid", Role{Indices: []string{"logs-*"}, Actions: []string{ActionSearch, ActionWrite}}, true},
+		{"star action", Role{Indices: []string{"*"}, Actions: []string{"*"}}, true},
+		{"unknown action", Role{Indices: []string{"logs"}, Actions: []string{"delete"}}, false},
+		{"invalid index pattern", Role{Indices: []string{"["}, Actions: []string{ActionSearch}}, false},
+		{"invalid field pattern", Role{Indices: []string{"logs"}, Actions: []string{ActionSearch}, Fields: &FieldPolicy{Include: []string{"["}}}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.role.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestFieldPolicyAllowed(t *testing.T) {
+	policy := FieldPolicy{Include: []string{"title", "customer.*"}, Exclude: []string{"customer.email"}}
+	tests := map[string]bool{
+		"title":          true,
+		"customer":       true,
+		"customer.name":  true,
+		"customer.email": false,
+		"price":          false,
+	}
+
+	for field, want := range tests {
+		if got := policy.Allowed(field); got != want {
+			t.Errorf("Allowed(%q) = %v, want %v", field, got, want)
+		}
+	}
+}
+
+func TestFilterSource(t *testing.T) {
+	filter := FieldFilter{{Exclude: []string{"customer.email", "secret"}}}
+	source := map[string]interface{}{
+		"title":    "Shoes",
+		"secret":   "hidden",
+		"customer": map[string]interface{}{"name": "Noel", "email": "cutie@floofy.dev"},
+	}
+
+	want := map[string]interface{}{
+		"title":    "Shoes",
+		"customer": map[string]interface{}{"name": "Noel"},
+	}
+
+	if got := filter.FilterSource(source); !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterSource() = %v, want %v", got, want)
+	}
+
+	if got := FieldFilter(nil).FilterSource(source); !reflect.DeepEqual(got, source) {
+		t.Errorf("nil filter changed the source to %v", got)
+	}
+}
+
+func TestCheckQuery(t *testing.T) {
+	filter := FieldFilter{{Exclude: []string{"secret", "customer.email"}}}
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"allowed match", `{"query": {"match": {"title": "shoes"}}}`, ""},
+		{"excluded match", `{"query": {"match": {"secret": "x"}}}`, "field 'secret' is not allowed"},
+		{"excluded child", `{"query": {"term": {"customer.email": "x"}}}`, "field 'customer.email' is not allowed"},
+		{"excluded in bool", `{"query": {"bool": {"filter": [{"range": {"secret": {"gte": 1}}}]}}}`, "field 'secret' is not allowed"},
+		{"excluded sort", `{"sort": [{"secret": "asc"}]}`, "field 'secret' is not allowed"},
+		{"excluded aggregation", `{"aggs": {"a": {"terms": {"field": "secret"}}}}`, "field 'secret' is not allowed"},
+		{"excluded highlight", `{"highlight": {"fields": {"secret": {}}}}`, "field 'secret' is not allowed"},
+		{"wildcard field", `{"query": {"multi_match": {"query": "x", "fields": ["*"]}}}`, "wildcard field pattern"},
+		{"multi_match without fields", `{"query": {"multi_match": {"query": "x"}}}`, "must declare 'fields'"},
+		{"query_string", `{"query": {"query_string": {"query": "secret:x"}}}`, "'query_string' can't be used"},
+		{"script", `{"query": {"script": {"script": "doc['secret']"}}}`, "'script' can't be used"},
+		{"script sort", `{"sort": {"_script": {}}}`, "'_script' sorts can't be used"},
+		{"top_hits", `{"aggs": {"a": {"top_hits": {"size": 1}}}}`, "'top_hits' aggregations can't be used"},
+		{"nested top_hits", `{"aggs": {"a": {"terms": {"field": "title"}, "aggs": {"b": {"top_hits": {}}}}}}`, "'top_hits' aggregations can't be used"},
+		{"inner_hits", `{"query": {"nested": {"path": "customer", "query": {"match_all": {}}, "inner_hits": {}}}}`, "'inner_hits' can't be used"},
+		{"collapse inner_hits", `{"collapse": {"field": "title", "inner_hits": {"name": "x"}}}`, "'inner_hits' can't be used"},
+		{"source", `{"_source": ["secret"], "query": {"match_all": {}}}`, ""},
+		{"wrapper", `{"query": {"wrapper": {"query": "eyJ0ZXJtIjp7InNlY3JldCI6IngifX0="}}}`, "'wrapper' queries can't be used"},
+		{"more_like_this without fields", `{"query": {"more_like_this": {"like": "x"}}}`, "must declare 'fields'"},
+		{"more_like_this", `{"query": {"more_like_this": {"fields": ["title"], "like": "x"}}}`, ""},
+		{"more_like_this excluded field", `{"query": {"more_like_this": {"fields": ["secret"], "like": "x"}}}`, "field 'secret' is not allowed"},
+		{"more_like_this artificial document", `{"query": {"more_like_this": {"fields": ["title"], "like": [{"doc": {"secret": "x"}}]}}}`, "field 'secret' is not allowed"},
+		{"shape", `{"query": {"shape": {"secret": {"shape": {"type": "point", "coordinates": [1, 2]}}}}}`, "field 'secret' is not allowed"},
+		{"unknown query", `{"query": {"percolate": {"field": "query", "document": {}}}}`, "'percolate' queries can't be used"},
+		{"excluded in should", `{"query": {"bool": {"should": {"bool": {"must_not": [{"exists": {"field": "secret"}}]}}}}}`, "field 'secret' is not allowed"},
+		{"function_score decay", `{"query": {"function_score": {"query": {"match_all": {}}, "functions": [{"gauss": {"secret": {"origin": 0, "scale": 1}}}]}}}`, "field 'secret' is not allowed"},
+		{"function_score filter", `{"query": {"function_score": {"functions": [{"filter": {"term": {"secret": "x"}}, "weight": 2}]}}}`, "field 'secret' is not allowed"},
+		{"nested sort filter", `{"sort": [{"customer.age": {"nested": {"path": "customer", "filter": {"term": {"customer.email": "x"}}}}}]}`, "field 'customer.email' is not allowed"},
+		{"highlight query", `{"highlight": {"fields": {"title": {}}, "highlight_query": {"term": {"secret": "x"}}}}`, "field 'secret' is not allowed"},
+		{"rescore", `{"rescore": {"query": {"rescore_query": {"match": {"secret": "x"}}}}}`, "field 'secret' is not allowed"},
+		{"background filter", `{"aggs": {"a": {"significant_terms": {"field": "title", "background_filter": {"term": {"secret": "x"}}}}}}`, "field 'secret' is not allowed"},
+		{"filters aggregation", `{"aggs": {"a": {"filters": {"filters": {"b": {"term": {"secret": "x"}}}}}}}`, "field 'secret' is not allowed"},
+		{"scripted_metric", `{"aggs": {"a": {"scripted_metric": {"map_script": "state.x = doc['secret']"}}}}`, "can't be used"},
+		{"unknown search key", `{"suggest": {"s": {"text": "x", "term": {"field": "secret"}}}}`, "'suggest' can't be used"},
+		{"allowed compound", `{"query": {"bool": {"must": [{"multi_match": {"query": "x", "fields": ["title^2"]}}], "filter": {"range": {"price": {"gte": 1}}}}}, "size": 10, "track_total_hits": true}`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(test.body), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			err := filter.CheckQuery(body)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("CheckQuery() = %v, want nil", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("CheckQuery() = %v, want error containing %q", err, test.err)
+			}
+		})
+	}
+
+	var body map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"aggs": {"a": {"top_hits": {}}}, "query": {"script": {}}}`), &body)
+	if err := FieldFilter(nil).CheckQuery(body); err != nil {
+		t.Errorf("nil filter should allow everything, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// SearchTokenPrefix is the prefix of every search token.
+const SearchTokenPrefix = "tst_"
+
+// SearchTokenClaims are the restrictions that a search token embeds. A search
+// token can only search, and never has more access than its parent API key.
+type SearchTokenClaims struct {
+	// Indices are the index patterns that the token can search, on top of the
+	// scopes of the parent key. If this is empty, the scopes of the parent key apply.
+	Indices []string `json:"indices,omitempty"`
+
+	// Filters are queries that every search with the token is filtered with, on
+	// top of the filters of the parent key.
+	Filters []map[string]interface{} `json:"filters,omitempty"`
+
+	// ExpiresAt is the unix time (in seconds) when the token expires.
+	ExpiresAt int64 `json:"exp"`
+
+	// RateLimit is how many requests per minute can be made with the token, 0
+	// means that only the limits of the parent key apply.
+	RateLimit int `json:"rate_limit,omitempty"`
+}
+
+// MintSearchToken creates a search token that is signed by the parent API key
+// token (`tsb_...`). This doesn't need access to the server, so backends can
+// mint search tokens for browsers without exposing their API key. Tokens are
+// signed with a private key that is derived from the secret of the parent key,
+// and only its public key is stored, so the keys file can't be used to forge them.
+func MintSearchToken(parentToken string, claims SearchTokenClaims) (string, error) {
+	id, secret, ok := ParseAPIKeyToken(parentToken)
+	if !ok {
+		return "", errors.New("parent token is not an api key")
+	}
+
+	if claims.ExpiresAt == 0 {
+		return "", errors.New("search tokens must expire")
+	}
+
+	for _, index := range claims.Indices {
+		if _, err := path.Match(index, ""); err != nil {
+			return "", fmt.Errorf("invalid index pattern %q: %v", index, err)
+		}
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := id + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(searchTokenPrivateKey(secret), []byte(signed))
+	return SearchTokenPrefix + signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// VerifySearchToken verifies the signature and expiry of a search token, and returns
+// its claims with the parent API key.
+func (s *APIKeyStore) VerifySearchToken(token string) (*SearchTokenClaims, *APIKey, error) {
+	if !strings.HasPrefix(token, SearchTokenPrefix) {
+		return nil, nil, errors.New("not a search token")
+	}
+
+	signed := strings.TrimPrefix(token, SearchTokenPrefix)
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return nil, nil, errors.New("malformed search token")
+	}
+
+	signed, signature := signed[:i], signed[i+1:]
+	id, encoded, ok := strings.Cut(signed, ".")
+	if !ok {
+		return nil, nil, errors.New("malformed search token")
+	}
+
+	s.reloadIfChanged()
+
+	s.mu.RLock()
+	key, ok := s.keys[id]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, nil, ErrUnknownAPIKey
+	}
+
+	if key.SearchTokenKey == "" {
+		return nil, nil, errors.New("parent api key was created before search tokens were signed with a key pair, create a new key")
+	}
+
+	publicKey, err := base64.RawURLEncoding.DecodeString(key.SearchTokenKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, nil, errors.New("parent api key has an invalid search token key")
+	}
+
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(publicKey, []byte(signed), decodedSignature) {
+		return nil, nil, errors.New("invalid search token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed search token payload: %v", err)
+	}
+
+	var claims SearchTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, nil, fmt.Errorf("malformed search token payload: %v", err)
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, nil, errors.New("search token is expired")
+	}
+
+	return &claims, key, nil
+}
+
+// Principal returns the Principal of a search token with its parent API key.
+func (claims *SearchTokenClaims) Principal(key *APIKey) *Principal {
+	return &Principal{
+		Name:      key.Name,
+		Provider:  "search_token",
+		Scopes:    key.Scopes,
+		Filters:   append(append([]map[string]interface{}{}, key.Filters...), claims.Filters...),
+		Actions:   []string{ActionSearch},
+		Indices:   claims.Indices,
+		RateLimit: claims.RateLimit,
+	}
+}
+
+// searchTokenPrivateKey derives the key that search tokens are signed with from
+// the secret of the parent key, so only whoever holds the parent key can sign them.
+func searchTokenPrivateKey(secret string) ed25519.PrivateKey {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("search-token"))
+
+	return ed25519.NewKeyFromSeed(mac.Sum(nil))
+}
+
+// searchTokenPublicKey returns the encoded public key that search tokens of the
+// secret are verified with.
+func searchTokenPublicKey(secret string) string {
+	publicKey := searchTokenPrivateKey(secret).Public().(ed25519.PublicKey)
+	return base64.RawURLEncoding.EncodeToString(publicKey)
+}
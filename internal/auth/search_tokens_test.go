@@ -0,0 +1,149 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAPIKey(t *testing.T) (*APIKeyStore, *APIKey, string) {
+	store, err := NewAPIKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, token, err := store.Create("frontend", []string{"search:prod*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, key, token
+}
+
+func TestSearchTokenVerify(t *testing.T) {
+	store, key, parent := newTestAPIKey(t)
+
+	token, err := MintSearchToken(parent, SearchTokenClaims{
+		Indices:   []string{"products"},
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, verified, err := store.VerifySearchToken(token)
+	if err != nil {
+		t.Fatalf("VerifySearchToken() = %v", err)
+	}
+
+	if verified.ID != key.ID || len(claims.Indices) != 1 || claims.Indices[0] != "products" {
+		t.Errorf("unexpected claims %+v of key %s", claims, verified.ID)
+	}
+
+	principal := claims.Principal(verified)
+	tests := []struct {
+		action string
+		index  string
+		want   bool
+	}{
+		{ActionSearch, "products", true},
+		{ActionSearch, "production", false},
+		{ActionSearch, "products,production", false},
+		{ActionSearch, "prod*", false},
+		{ActionWrite, "products", false},
+	}
+
+	for _, test := range tests {
+		if got := principal.Can(test.action, test.index); got != test.want {
+			t.Errorf("Can(%q, %q) = %v, want %v", test.action, test.index, got, test.want)
+		}
+	}
+}
+
+func TestSearchTokenRejected(t *testing.T) {
+	store, key, parent := newTestAPIKey(t)
+	_, _, otherParent := newTestAPIKey(t)
+
+	valid, err := MintSearchToken(parent, SearchTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := MintSearchToken(parent, SearchTokenClaims{ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token of another key, that claims to be of this key.
+	other, err := MintSearchToken(otherParent, SearchTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherRest, _ := strings.Cut(strings.TrimPrefix(other, SearchTokenPrefix), ".")
+	impersonated := SearchTokenPrefix + key.ID + "." + otherRest
+
+	// A token that was signed with the stored hash, like they were before.
+	payload, _ := json.Marshal(SearchTokenClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(key.Hash))
+	mac.Write([]byte(signed))
+	forged := SearchTokenPrefix + signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	// A token where the claims were changed after it was signed.
+	i := strings.LastIndex(valid, ".")
+	widened, _ := json.Marshal(SearchTokenClaims{Indices: []string{"*"}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	tampered := SearchTokenPrefix + key.ID + "." + base64.RawURLEncoding.EncodeToString(widened) + valid[i:]
+
+	tests := map[string]string{
+		"expired":      expired,
+		"impersonated": impersonated,
+		"forged":       forged,
+		"tampered":     tampered,
+		"malformed":    SearchTokenPrefix + "nope",
+		"unknown key":  SearchTokenPrefix + "deadbeef." + valid[i+1:],
+	}
+
+	for name, token := range tests {
+		if _, _, err := store.VerifySearchToken(token); err == nil {
+			t.Errorf("%s token was accepted", name)
+		}
+	}
+}
+
+func TestMintSearchToken(t *testing.T) {
+	_, _, parent := newTestAPIKey(t)
+
+	if _, err := MintSearchToken(parent, SearchTokenClaims{}); err == nil {
+		t.Error("token without expiry was minted")
+	}
+
+	if _, err := MintSearchToken(parent, SearchTokenClaims{ExpiresAt: time.Now().Unix() + 60, Indices: []string{"["}}); err == nil {
+		t.Error("token with an invalid index pattern was minted")
+	}
+
+	if _, err := MintSearchToken("not-a-key", SearchTokenClaims{ExpiresAt: time.Now().Unix() + 60}); err == nil {
+		t.Error("token was minted without an api key")
+	}
+}
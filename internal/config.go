@@ -16,10 +16,14 @@
 package internal
 
 import (
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/schema"
+	"floofy.dev/tsubasa/internal/tracing"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 // Config represents the configuration for Tsubasa. The configuration file
@@ -36,15 +40,23 @@ type Config struct {
 	Username *string `toml:"username"`
 
 	// The password to use to enable Basic authentication on the Tsubasa server.
-	// This requires the `username` field to be defined.
+	// This requires the `username` field to be defined. This should be a bcrypt
+	// or argon2id hash from `tsubasa hash-password`, plaintext is still accepted.
 	Password *string `toml:"password"`
 
+	// The configuration for authenticating requests other than Basic authentication.
+	Auth AuthConfig `toml:"auth"`
+
 	// The configuration to use to configure Elasticsearch.
 	Elastic ElasticConfig `toml:"elastic"`
 
 	// If debug logging should be enabled.
 	Debug bool `toml:"debug"`
 
+	// LogFormat is the format of the logs, "text", "json" or "logfmt". By default,
+	// it is "text". The `TSUBASA_LOG_FORMAT` environment variable overrides this.
+	LogFormat *string `toml:"log_format,omitempty"`
+
 	// The host to use that Tsubasa should listen to. By default, it will
 	// listen at 0.0.0.0
 	Host *string `toml:"host"`
@@ -52,6 +64,307 @@ type Config struct {
 	// The HTTP port that Tsubasa should be listening to. By default,
 	// it allocates the port: 23145
 	Port *int `toml:"port"`
+
+	// IdempotencyTTL is how long responses to POST requests with an `Idempotency-Key`
+	// header are kept, so retried requests are replayed rather than executed again.
+	// By default, it is "24h".
+	IdempotencyTTL *string `toml:"idempotency_ttl,omitempty"`
+
+	// RateLimits are the rate limits and daily quotas of each route class, which
+	// are kept per principal (or per IP for anonymous requests).
+	RateLimits RateLimitConfig `toml:"rate_limits,omitempty"`
+
+	// Audit enables the audit log of every write and admin request. If this is
+	// not defined, nothing is audited.
+	Audit *AuditConfig `toml:"audit,omitempty"`
+
+	// TLS enables serving HTTPS rather than HTTP.
+	TLS *TLSConfig `toml:"tls,omitempty"`
+
+	// CORS enables Cross-Origin Resource Sharing for browser clients. If this is
+	// not defined, no CORS headers are sent.
+	CORS *CORSConfig `toml:"cors,omitempty"`
+
+	// TrustedProxies are the IPs or CIDRs of the reverse proxies in front of Tsubasa.
+	// The `Forwarded`, `X-Forwarded-For` and `X-Real-IP` headers are only used when
+	// they are set by these proxies, if this is not defined, the headers are ignored.
+	TrustedProxies []string `toml:"trusted_proxies,omitempty"`
+
+	// IPFilters are the IP allow and deny lists of the routes under a path prefix,
+	// i.e. the `[ip_filters."/admin"]` table only applies to `/admin`.
+	IPFilters map[string]IPFilterConfig `toml:"ip_filters,omitempty"`
+
+	// Metrics enables the Prometheus metrics on `/metrics`. If this is not defined,
+	// the metrics are not served.
+	Metrics *MetricsConfig `toml:"metrics,omitempty"`
+
+	// Tracing enables OpenTelemetry tracing of the requests and the Elasticsearch
+	// calls. If this is not defined, nothing is traced.
+	Tracing *tracing.Config `toml:"tracing,omitempty"`
+
+	// SlowQueries enables the slow query log, which logs and aggregates the shapes
+	// of searches that are slower than a threshold.
+	SlowQueries *SlowQueryConfig `toml:"slow_queries,omitempty"`
+
+	// Analytics enables the search analytics, which records every search to find
+	// the top queries and the queries without results.
+	Analytics *AnalyticsConfig `toml:"analytics,omitempty"`
+}
+
+// AnalyticsConfig represents the `[analytics]` table. Searches are kept in memory,
+// unless an index is defined.
+type AnalyticsConfig struct {
+	// Index is the Elasticsearch index that searches are recorded into, rather
+	// than in memory.
+	Index *string `toml:"index,omitempty"`
+
+	// Retention is how long searches are kept in memory, by default it is "168h".
+	Retention *string `toml:"retention,omitempty"`
+
+	// MaxEvents is how many searches are kept in memory, by default it is 100000.
+	MaxEvents *int `toml:"max_events,omitempty"`
+
+	// UserHeader is the header of the ID of the user that searched, by default
+	// it is `X-User-Id`.
+	UserHeader *string `toml:"user_header,omitempty"`
+
+	// SessionHeader is the header of the ID of the session that searched, by
+	// default it is `X-Session-Id`.
+	SessionHeader *string `toml:"session_header,omitempty"`
+}
+
+// SlowQueryConfig represents the `[slow_queries]` table.
+type SlowQueryConfig struct {
+	// Threshold is how long a search has to take to be logged, as reported by
+	// Elasticsearch (`took`) or as measured by Tsubasa. By default, it is "500ms".
+	Threshold *string `toml:"threshold,omitempty"`
+
+	// MaxShapes is how many query shapes are kept for `/admin/slow-queries`, by
+	// default it is 1000.
+	MaxShapes *int `toml:"max_shapes,omitempty"`
+}
+
+// MetricsConfig represents the `[metrics]` table.
+type MetricsConfig struct {
+	// Port serves the metrics on a separate port rather than on the main port,
+	// without authentication. On the main port, the `admin` scope is required.
+	Port *int `toml:"port,omitempty"`
+
+	// Host is the host of the separate port, by default it is the same as `host`.
+	Host *string `toml:"host,omitempty"`
+}
+
+// IPFilterConfig is an IP allow and deny list, the IPs are the client IPs after
+// the trusted proxies are resolved.
+type IPFilterConfig struct {
+	// Allow are the IPs or CIDRs that can make requests, if this is empty, every
+	// IP that is not denied can.
+	Allow []string `toml:"allow,omitempty"`
+
+	// Deny are the IPs or CIDRs that can't make requests, even if they are allowed.
+	Deny []string `toml:"deny,omitempty"`
+}
+
+// CORSPolicy is a CORS policy, fields that are not defined use the defaults (or,
+// in `[cors.routes]`, the values from `[cors]`).
+type CORSPolicy struct {
+	// AllowedOrigins are the origins that can make requests, i.e. `https://app.floofy.dev`.
+	// `https://*.floofy.dev` allows every subdomain, and `*` allows every origin,
+	// which can't be used with `allow_credentials`.
+	AllowedOrigins []string `toml:"allowed_origins,omitempty"`
+
+	// AllowedMethods are the methods that can be used, by default every method
+	// that Tsubasa's routes use.
+	AllowedMethods []string `toml:"allowed_methods,omitempty"`
+
+	// AllowedHeaders are the request headers that can be sent, `*` allows every header.
+	AllowedHeaders []string `toml:"allowed_headers,omitempty"`
+
+	// ExposedHeaders are the response headers that browsers can read.
+	ExposedHeaders []string `toml:"exposed_headers,omitempty"`
+
+	// AllowCredentials allows requests with cookies or `Authorization` headers.
+	AllowCredentials *bool `toml:"allow_credentials,omitempty"`
+
+	// MaxAge is how long browsers can cache preflight responses, i.e. "10m".
+	MaxAge *string `toml:"max_age,omitempty"`
+}
+
+// CORSConfig represents the `[cors]` table.
+type CORSConfig struct {
+	CORSPolicy
+
+	// Routes overrides the policy for the routes under a path prefix, i.e. the
+	// `[cors.routes."/admin"]` table only applies to `/admin`.
+	Routes map[string]CORSPolicy `toml:"routes,omitempty"`
+}
+
+// For returns the policy of the path, the policy of the longest matching prefix in
+// Routes is merged on top of the `[cors]` policy.
+func (c *CORSConfig) For(path string) CORSPolicy {
+	policy := c.CORSPolicy
+	longest := ""
+	for prefix := range c.Routes {
+		matches := path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+		if matches && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+
+	if longest == "" {
+		return policy
+	}
+
+	override := c.Routes[longest]
+	if override.AllowedOrigins != nil {
+		policy.AllowedOrigins = override.AllowedOrigins
+	}
+
+	if override.AllowedMethods != nil {
+		policy.AllowedMethods = override.AllowedMethods
+	}
+
+	if override.AllowedHeaders != nil {
+		policy.AllowedHeaders = override.AllowedHeaders
+	}
+
+	if override.ExposedHeaders != nil {
+		policy.ExposedHeaders = override.ExposedHeaders
+	}
+
+	if override.AllowCredentials != nil {
+		policy.AllowCredentials = override.AllowCredentials
+	}
+
+	if override.MaxAge != nil {
+		policy.MaxAge = override.MaxAge
+	}
+
+	return policy
+}
+
+// TLSConfig represents the `[tls]` table.
+type TLSConfig struct {
+	// CertFile is the path to the PEM-encoded server certificate (and its chain).
+	// It is reloaded when the file changes, so certificates can be renewed
+	// without restarting Tsubasa.
+	CertFile string `toml:"cert_file"`
+
+	// KeyFile is the path to the PEM-encoded private key of the certificate.
+	KeyFile string `toml:"key_file"`
+
+	// MinVersion is the minimum TLS version, "1.2" or "1.3". By default, it is "1.2".
+	MinVersion *string `toml:"min_version,omitempty"`
+
+	// ClientCAFile is the path to the PEM-encoded CA bundle that client certificates
+	// are verified against. Verified client certificates can be used with `[auth.mtls]`.
+	ClientCAFile *string `toml:"client_ca_file,omitempty"`
+
+	// RequireClientCert rejects connections without a verified client certificate,
+	// rather than only verifying the ones that are given.
+	RequireClientCert bool `toml:"require_client_cert,omitempty"`
+}
+
+// AuditConfig represents the `[audit]` table. Records are written to a JSON lines
+// file, or to an Elasticsearch index if `index` is defined.
+type AuditConfig struct {
+	// Path is the path to the JSON lines file that records are appended to.
+	Path *string `toml:"path,omitempty"`
+
+	// MaxSizeMB is how large the file can grow (in megabytes) before it is
+	// rotated, by default it is 100.
+	MaxSizeMB *int `toml:"max_size_mb,omitempty"`
+
+	// MaxFiles is how many rotated files are kept, by default it is 10.
+	MaxFiles *int `toml:"max_files,omitempty"`
+
+	// Index is the Elasticsearch index that records are written to, rather than a file.
+	Index *string `toml:"index,omitempty"`
+
+	// IncludeBody records the request body, with the redacted fields replaced.
+	IncludeBody bool `toml:"include_body,omitempty"`
+
+	// IncludeSearches audits search requests too, not only writes and admin requests.
+	IncludeSearches bool `toml:"include_searches,omitempty"`
+
+	// RedactFields are the fields of request bodies that are redacted, as dotted
+	// paths or field names, which can be glob patterns (i.e. `password`, `customer.*`).
+	RedactFields []string `toml:"redact_fields,omitempty"`
+}
+
+// RateLimitConfig represents the `[rate_limits]` table, a route class without
+// a table is not limited.
+type RateLimitConfig struct {
+	// Search is the limit of the search and document read routes.
+	Search *RouteLimitConfig `toml:"search,omitempty"`
+
+	// Write is the limit of the document write routes.
+	Write *RouteLimitConfig `toml:"write,omitempty"`
+
+	// Admin is the limit of the `/admin` routes.
+	Admin *RouteLimitConfig `toml:"admin,omitempty"`
+}
+
+// RouteLimitConfig is the limit of a route class.
+type RouteLimitConfig struct {
+	// RequestsPerMinute is how many requests can be made per minute, 0 means
+	// that only the daily quota applies.
+	RequestsPerMinute int `toml:"requests_per_minute"`
+
+	// Burst is how many requests can be made at once, by default it is the
+	// same as RequestsPerMinute.
+	Burst *int `toml:"burst,omitempty"`
+
+	// DailyQuota is how many requests can be made per day (in UTC).
+	DailyQuota *int `toml:"daily_quota,omitempty"`
+}
+
+// For returns the limit of the route class, or `nil` if it is not limited.
+func (c RateLimitConfig) For(class string) *RouteLimitConfig {
+	switch class {
+	case auth.ActionSearch:
+		return c.Search
+
+	case auth.ActionWrite:
+		return c.Write
+
+	case auth.ActionAdmin:
+		return c.Admin
+
+	default:
+		return nil
+	}
+}
+
+type AuthConfig struct {
+	// Providers is the order that the authentication providers are tried in, from
+	// `basic`, `api_key`, `jwt`, `mtls` and `trusted_header`. By default, every
+	// configured provider is tried in that order, except mTLS which is first.
+	Providers []string `toml:"providers,omitempty"`
+
+	// APIKeysPath is the path to the JSON file that stores the API keys, which are
+	// sent as `Authorization: Bearer <token>`. If this is not defined, API keys are
+	// disabled. Keys are managed with `tsubasa keys` or the `/admin/keys` endpoints.
+	APIKeysPath *string `toml:"api_keys_path,omitempty"`
+
+	// JWT enables authenticating with JWTs from an identity provider, which are verified
+	// against a JSON Web Key Set. If this is not defined, JWTs are disabled.
+	JWT *auth.JWTConfig `toml:"jwt,omitempty"`
+
+	// MTLS enables authenticating with TLS client certificates, which requires
+	// the server to verify client certificates.
+	MTLS *auth.MTLSConfig `toml:"mtls,omitempty"`
+
+	// TrustedHeader enables trusting the user that a reverse proxy sets in a header.
+	TrustedHeader *auth.TrustedHeaderConfig `toml:"trusted_header,omitempty"`
+
+	// Lockout configures how clients are locked out after failed Basic
+	// authentication attempts.
+	Lockout *auth.LockoutConfig `toml:"lockout,omitempty"`
+
+	// Roles are named sets of indices, actions and visible fields, which are
+	// assigned to API keys and JWTs with the `role:<name>` scope.
+	Roles map[string]auth.Role `toml:"roles,omitempty"`
 }
 
 type ElasticConfig struct {
@@ -65,6 +378,34 @@ type ElasticConfig struct {
 	// then Tsubasa will configure it.
 	Indexes []string `toml:"indexes"`
 
+	// Schemas are the declared schemas for indexes, keyed by the index name. When
+	// Tsubasa creates an index that has a declared schema, it will be created with
+	// the mappings from it. Indexes declared here don't need to be in `indexes`.
+	//
+	// You can use `tsubasa schema infer <file.jsonl>` to generate one from sample documents.
+	Schemas map[string]schema.Index `toml:"schemas,omitempty"`
+
+	// Pipelines are the ingest pipelines (keyed by the pipeline id) that Tsubasa installs
+	// when it starts. Write endpoints can select one with the `pipeline` query parameter,
+	// other pipelines can't be used. Documents are validated against the index schema
+	// before the pipeline runs, so what the pipeline adds or changes isn't validated.
+	Pipelines map[string]PipelineConfig `toml:"pipelines,omitempty"`
+
+	// DriftCheckInterval is how often Tsubasa should compare the live mappings of the
+	// indexes to their expected schema (i.e. "15m"), the expected schema is the declared
+	// one or a snapshot of the mapping. Drifted mappings are logged as warnings and are
+	// available under `GET /admin/drift`. If this is not defined, mappings are only
+	// checked on demand.
+	DriftCheckInterval *string `toml:"drift_check_interval,omitempty"`
+
+	// DriftSnapshotPath is the path to the JSON file that stores the mapping snapshots
+	// of the indexes without a declared schema. An index is snapshotted the first time
+	// Tsubasa sees it, and the snapshot is kept across restarts, so drift that happens
+	// while Tsubasa is down is still reported. Remove an index from the file to accept
+	// its current mapping. If this is not defined, the mappings are snapshotted every
+	// time Tsubasa starts.
+	DriftSnapshotPath *string `toml:"drift_snapshot_path,omitempty"`
+
 	// The list of nodes to use when connecting to Elasticsearch.
 	Nodes []string `toml:"nodes"`
 
@@ -76,6 +417,20 @@ type ElasticConfig struct {
 	SkipSSLVerify bool `toml:"skip_ssl_verify"`
 }
 
+// PipelineConfig represents an ingest pipeline in the `[elastic.pipelines.<id>]` table.
+type PipelineConfig struct {
+	// Description is a brief description of what the pipeline does.
+	Description string `toml:"description,omitempty"`
+
+	// Processors is the list of processors the pipeline runs, in the same format
+	// as the Elasticsearch ingest pipeline API, i.e. `[{ lowercase = { field = "tag" } }]`.
+	Processors []map[string]interface{} `toml:"processors,omitempty"`
+
+	// Path is the path to a JSON file containing the pipeline definition. If
+	// this is defined, the `description` and `processors` fields are ignored.
+	Path *string `toml:"path,omitempty"`
+}
+
 // NewConfig initialized the configuration for Tsubasa.
 func NewConfig(path string) (*Config, error) {
 	logrus.Infof("Loading configuration from path '%s'...", path)
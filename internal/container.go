@@ -16,10 +16,18 @@
 package internal
 
 import (
+	"floofy.dev/tsubasa/internal/audit"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/ratelimit"
+	"floofy.dev/tsubasa/internal/tracing"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"net"
 	"os"
+	"strings"
+	"time"
 )
 
 // GlobalContainer represents the global container that is initialised by
@@ -36,6 +44,37 @@ type Container struct {
 
 	// Represents the configuration that was loaded
 	Config *Config
+
+	// Represents the store for responses of requests with an `Idempotency-Key`.
+	Idempotency *IdempotencyStore
+
+	// Represents the API key store if API keys are enabled.
+	APIKeys *auth.APIKeyStore
+
+	// Represents the JWT verifier if JWTs are enabled.
+	JWT *auth.JWTVerifier
+
+	// Represents the authentication providers that are tried in order, if this
+	// is empty, authentication is disabled.
+	Authenticators auth.Chain
+
+	// Represents the token buckets of the rate limits.
+	RateLimiter *ratelimit.Limiter
+
+	// Represents the daily quota counters.
+	Quotas *ratelimit.Quotas
+
+	// Represents the audit log if it is enabled.
+	Audit *audit.Logger
+
+	// Represents the reverse proxies that forwarding headers are trusted from.
+	TrustedProxies []*net.IPNet
+
+	// Represents the IP filters of `[ip_filters]`, keyed by path prefix.
+	IPFilters map[string]*IPFilter
+
+	// Represents the OpenTelemetry tracer provider if tracing is enabled.
+	Tracing *sdktrace.TracerProvider
 }
 
 // NewContainer creates a new Container object and initializes the GlobalContainer
@@ -45,6 +84,18 @@ func NewContainer(config *Config) *Container {
 		panic("Unable to create new container since one is already created.")
 	}
 
+	// Tracing is set up first, so the Elasticsearch client is traced.
+	var tracerProvider *sdktrace.TracerProvider
+	if config.Tracing != nil {
+		logrus.Info("Tracing is enabled, now installing OpenTelemetry...")
+
+		var err error
+		tracerProvider, err = tracing.NewProvider(*config.Tracing, Version)
+		if err != nil {
+			logrus.Fatalf("Unable to configure tracing: %v", err)
+		}
+	}
+
 	elastic, err := NewElasticService(config)
 	if err != nil {
 		logrus.Panic("Unable to create a connection to Elasticsearch", err)
@@ -72,11 +123,189 @@ func NewContainer(config *Config) *Container {
 		sc = client
 	}
 
+	idempotencyTTL := 24 * time.Hour
+	if config.IdempotencyTTL != nil {
+		idempotencyTTL, err = time.ParseDuration(*config.IdempotencyTTL)
+		if err != nil {
+			logrus.Fatalf("Invalid `idempotency_ttl` %q: %v", *config.IdempotencyTTL, err)
+		}
+	}
+
+	var apiKeys *auth.APIKeyStore
+	if config.Auth.APIKeysPath != nil {
+		logrus.Infof("API keys are enabled, loading them from %s...", *config.Auth.APIKeysPath)
+		apiKeys, err = auth.NewAPIKeyStore(*config.Auth.APIKeysPath)
+		if err != nil {
+			logrus.Fatalf("Unable to load API keys: %v", err)
+		}
+	}
+
+	for name, role := range config.Auth.Roles {
+		if err := role.Validate(); err != nil {
+			logrus.Fatalf("Invalid role `auth.roles.%s`: %v", name, err)
+		}
+	}
+
+	if config.CORS != nil {
+		// Route overrides inherit from `[cors]`, so the merged policy is checked.
+		policies := map[string]CORSPolicy{"cors": config.CORS.CORSPolicy}
+		for prefix := range config.CORS.Routes {
+			policies["cors.routes."+prefix] = config.CORS.For(prefix)
+		}
+
+		for name, policy := range policies {
+			if policy.MaxAge != nil {
+				if _, err := time.ParseDuration(*policy.MaxAge); err != nil {
+					logrus.Fatalf("Invalid `%s.max_age` %q: %v", name, *policy.MaxAge, err)
+				}
+			}
+
+			// Any website could make credentialed requests as the user otherwise.
+			if policy.AllowCredentials != nil && *policy.AllowCredentials && containsString(policy.AllowedOrigins, "*") {
+				logrus.Fatalf("`%s` can't allow every origin (`*`) with `allow_credentials`, list the allowed origins instead", name)
+			}
+		}
+	}
+
+	var jwtVerifier *auth.JWTVerifier
+	if config.Auth.JWT != nil {
+		logrus.Infof("JWT authentication is enabled for issuer %s, loading JWKS...", config.Auth.JWT.Issuer)
+		jwtVerifier, err = auth.NewJWTVerifier(*config.Auth.JWT)
+		if err != nil {
+			logrus.Fatalf("Unable to configure JWT authentication: %v", err)
+		}
+	}
+
+	authenticators, err := newAuthChain(config, apiKeys, jwtVerifier)
+	if err != nil {
+		logrus.Fatalf("Unable to configure authentication: %v", err)
+	}
+
+	trustedProxies, err := auth.ParseCIDRs(config.TrustedProxies)
+	if err != nil {
+		logrus.Fatalf("Invalid `trusted_proxies`: %v", err)
+	}
+
+	ipFilters := map[string]*IPFilter{}
+	for prefix, filterConfig := range config.IPFilters {
+		filter, err := NewIPFilter(filterConfig)
+		if err != nil {
+			logrus.Fatalf("Invalid `ip_filters.%s`: %v", prefix, err)
+		}
+
+		ipFilters[prefix] = filter
+	}
+
+	var auditLogger *audit.Logger
+	if config.Audit != nil {
+		logrus.Info("Audit log is enabled, now opening sink...")
+		auditLogger, err = newAuditLogger(config.Audit, elastic)
+		if err != nil {
+			logrus.Fatalf("Unable to create audit log: %v", err)
+		}
+	}
+
 	GlobalContainer = &Container{
-		Elastic: elastic,
-		Sentry:  sc,
-		Config:  config,
+		Elastic:        elastic,
+		Sentry:         sc,
+		Config:         config,
+		Idempotency:    NewIdempotencyStore(idempotencyTTL),
+		APIKeys:        apiKeys,
+		JWT:            jwtVerifier,
+		Authenticators: authenticators,
+		RateLimiter:    ratelimit.NewLimiter(),
+		Quotas:         ratelimit.NewQuotas(),
+		Audit:          auditLogger,
+		TrustedProxies: trustedProxies,
+		IPFilters:      ipFilters,
+		Tracing:        tracerProvider,
 	}
 
 	return GlobalContainer
 }
+
+// newAuthChain creates the chain of authentication providers from the configuration.
+func newAuthChain(config *Config, apiKeys *auth.APIKeyStore, jwtVerifier *auth.JWTVerifier) (auth.Chain, error) {
+	providers := map[string]auth.Authenticator{}
+	if config.Username != nil && config.Password != nil {
+		if !auth.IsPasswordHash(*config.Password) {
+			logrus.Warn("The Basic authentication password is stored in plaintext, use `tsubasa hash-password` to hash it!")
+		}
+
+		lockoutConfig := auth.LockoutConfig{}
+		if config.Auth.Lockout != nil {
+			lockoutConfig = *config.Auth.Lockout
+		}
+
+		lockout, err := auth.NewLockout(lockoutConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `auth.lockout`: %v", err)
+		}
+
+		providers["basic"] = &auth.BasicAuthenticator{
+			Username: *config.Username,
+			Password: *config.Password,
+			Lockout:  lockout,
+		}
+	}
+
+	if apiKeys != nil {
+		providers["api_key"] = &auth.APIKeyAuthenticator{Store: apiKeys}
+	}
+
+	if jwtVerifier != nil {
+		providers["jwt"] = jwtVerifier
+	}
+
+	if config.Auth.MTLS != nil {
+		if config.TLS == nil || config.TLS.ClientCAFile == nil {
+			logrus.Warn("`auth.mtls` is enabled, but client certificates are not verified without `tls.client_ca_file`")
+		}
+
+		authenticator, err := auth.NewMTLSAuthenticator(*config.Auth.MTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `auth.mtls`: %v", err)
+		}
+
+		providers["mtls"] = authenticator
+	}
+
+	if config.Auth.TrustedHeader != nil {
+		authenticator, err := auth.NewTrustedHeaderAuthenticator(*config.Auth.TrustedHeader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `auth.trusted_header`: %v", err)
+		}
+
+		providers["trusted_header"] = authenticator
+	}
+
+	order := config.Auth.Providers
+	if len(order) == 0 {
+		order = []string{"mtls", "api_key", "jwt", "trusted_header", "basic"}
+	}
+
+	chain := make(auth.Chain, 0, len(providers))
+	for _, name := range order {
+		authenticator, ok := providers[name]
+		if !ok {
+			if len(config.Auth.Providers) > 0 {
+				return nil, fmt.Errorf("provider %q in `auth.providers` is unknown or not configured", name)
+			}
+
+			continue
+		}
+
+		chain = append(chain, authenticator)
+	}
+
+	if len(chain) > 0 {
+		names := make([]string, 0, len(chain))
+		for _, authenticator := range chain {
+			names = append(names, authenticator.Name())
+		}
+
+		logrus.Infof("Authentication is enabled with providers [%s]", strings.Join(names, ", "))
+	}
+
+	return chain, nil
+}
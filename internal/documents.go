@@ -0,0 +1,810 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/internal/schema"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteOptions are the options for the document write paths.
+type WriteOptions struct {
+	// Pipeline is the ingest pipeline to run the documents through, it must be one
+	// of the pipelines declared in the configuration. The documents are validated
+	// before the pipeline runs, so its output isn't validated.
+	Pipeline string
+
+	// IfMatch is the version the document must be at for the write to succeed,
+	// this is used for optimistic concurrency control.
+	IfMatch *DocumentVersion
+
+	// CreateOnly makes the write fail if a document with the same id already exists.
+	CreateOnly bool
+}
+
+// DocumentVersion is the sequence number and primary term of a document, which
+// Elasticsearch uses for optimistic concurrency control. It is exposed to users
+// as an ETag, so it can be sent back with the `If-Match` header.
+type DocumentVersion struct {
+	SeqNo       int
+	PrimaryTerm int
+}
+
+// ETag returns the DocumentVersion as a quoted ETag, i.e. `"12-1"`.
+func (v DocumentVersion) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, v.SeqNo, v.PrimaryTerm)
+}
+
+// ParseDocumentVersion parses an ETag that was created with DocumentVersion.ETag.
+func ParseDocumentVersion(etag string) (*DocumentVersion, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return nil, fmt.Errorf("etag %s is not quoted", etag)
+	}
+
+	parts := strings.Split(etag[1:len(etag)-1], "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("etag %s is not a document version", etag)
+	}
+
+	seqNo, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("etag %s has an invalid sequence number", etag)
+	}
+
+	primaryTerm, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("etag %s has an invalid primary term", etag)
+	}
+
+	return &DocumentVersion{SeqNo: seqNo, PrimaryTerm: primaryTerm}, nil
+}
+
+// versionFromResponse returns the DocumentVersion from a get or index response.
+func versionFromResponse(d map[string]interface{}) *DocumentVersion {
+	seqNo, ok := d["_seq_no"].(float64)
+	if !ok {
+		return nil
+	}
+
+	primaryTerm, ok := d["_primary_term"].(float64)
+	if !ok {
+		return nil
+	}
+
+	return &DocumentVersion{SeqNo: int(seqNo), PrimaryTerm: int(primaryTerm)}
+}
+
+// etagFromResponse returns the ETag of the document from a get or index response,
+// or an empty string if the response has no version.
+func etagFromResponse(d map[string]interface{}) string {
+	if v := versionFromResponse(d); v != nil {
+		return v.ETag()
+	}
+
+	return ""
+}
+
+// GetDocument returns a single document from the index, without the fields that the
+// principal in the context is not allowed to see.
+func (es *ElasticService) GetDocument(ctx context.Context, index string, id string) *result.Result {
+	res, err := es.client.Get(index, id, es.client.Get.WithContext(ctx))
+	if err != nil {
+		Logger(ctx).Errorf("Unable to get document %s from index %s: %v", id, index, err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	defer res.Body.Close()
+
+	var d map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		Logger(ctx).Errorf("Unable to decode JSON payload from Elastic: %s", err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if res.StatusCode == 404 {
+		return result.Err(404, "UNKNOWN_DOCUMENT", fmt.Sprintf("Document '%s' does not exist in index '%s'.", id, index))
+	}
+
+	if res.IsError() {
+		Logger(ctx).Errorf("Unable to get document %s from index %s because: '%s'.", id, index, elasticErrorReason(d))
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if filters := searchFilters(ctx, index); len(filters) > 0 {
+		visible, err := es.matchesFilters(ctx, index, id, filters)
+		if err != nil {
+			Logger(ctx).Errorf("Unable to check filters of document %s from index %s: %v", id, index, err)
+			return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+		}
+
+		// The document is hidden as if it didn't exist, so its id can't be probed.
+		if !visible {
+			return result.Err(404, "UNKNOWN_DOCUMENT", fmt.Sprintf("Document '%s' does not exist in index '%s'.", id, index))
+		}
+	}
+
+	source, _ := d["_source"].(map[string]interface{})
+	return result.Ok(map[string]interface{}{
+		"id":      d["_id"],
+		"version": d["_version"],
+		"etag":    etagFromResponse(d),
+		"data":    searchFields(ctx, index).FilterSource(source),
+	})
+}
+
+// matchesFilters returns if the document with the id matches every filter.
+func (es *ElasticService) matchesFilters(ctx context.Context, index string, id string, filters []map[string]interface{}) (bool, error) {
+	clauses := []interface{}{map[string]interface{}{"ids": map[string]interface{}{"values": []string{id}}}}
+	for _, filter := range filters {
+		clauses = append(clauses, filter)
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"filter": clauses},
+		},
+	}); err != nil {
+		return false, err
+	}
+
+	res, err := es.client.Count(
+		es.client.Count.WithIndex(index),
+		es.client.Count.WithContext(ctx),
+		es.client.Count.WithBody(&buf))
+
+	if err != nil {
+		return false, err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return false, fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	var d struct {
+		Count int `json:"count"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return false, err
+	}
+
+	return d.Count > 0, nil
+}
+
+// checkWriteFilters checks that a document that is written by a principal with
+// filters matches them, and that the document it replaces matched them too. The
+// returned options pin the write to the version that was checked (or make it fail
+// if the document was created since), so the check can't race with other writes.
+func (es *ElasticService) checkWriteFilters(ctx context.Context, index string, id string, doc map[string]interface{}, filters []map[string]interface{}, options WriteOptions) (WriteOptions, *result.Result) {
+	if res := checkDocumentFilters(index, "Document", doc, filters); res != nil {
+		return options, res
+	}
+
+	// Elasticsearch generates a new id, so nothing is replaced.
+	if id == "" {
+		return options, nil
+	}
+
+	res, err := es.client.Get(index, id, es.client.Get.WithContext(ctx), es.client.Get.WithSource("false"))
+	if err != nil {
+		Logger(ctx).Errorf("Unable to get document %s from index %s: %v", id, index, err)
+		return options, result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	defer res.Body.Close()
+
+	var d map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		Logger(ctx).Errorf("Unable to decode JSON payload from Elastic: %s", err)
+		return options, result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if res.StatusCode == 404 {
+		if options.IfMatch != nil {
+			return options, result.Err(412, "VERSION_CONFLICT", fmt.Sprintf("Document '%s' in index '%s' was modified or already exists.", id, index))
+		}
+
+		options.CreateOnly = true
+		return options, nil
+	}
+
+	if res.IsError() {
+		Logger(ctx).Errorf("Unable to get document %s from index %s because: '%s'.", id, index, elasticErrorReason(d))
+		return options, result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	visible, err := es.matchesFilters(ctx, index, id, filters)
+	if err != nil {
+		Logger(ctx).Errorf("Unable to check filters of document %s from index %s: %v", id, index, err)
+		return options, result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if !visible {
+		return options, result.Err(403, "DOCUMENT_NOT_ALLOWED", fmt.Sprintf("Document '%s' in index '%s' doesn't match your filters, so it can't be replaced.", id, index))
+	}
+
+	version := versionFromResponse(d)
+	if options.IfMatch != nil && (version == nil || *options.IfMatch != *version) {
+		return options, result.Err(412, "VERSION_CONFLICT", fmt.Sprintf("Document '%s' in index '%s' was modified or already exists.", id, index))
+	}
+
+	options.IfMatch = version
+	return options, nil
+}
+
+// checkBulkWriteFilters checks that the documents that a bulk request replaces
+// match the filters, and returns the versions of the ones that exist.
+func (es *ElasticService) checkBulkWriteFilters(ctx context.Context, index string, idField string, docs []map[string]interface{}, filters []map[string]interface{}) (map[string]*DocumentVersion, *result.Result) {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		id, _ := documentID(doc[idField])
+		ids = append(ids, id)
+	}
+
+	versions, err := es.documentVersions(ctx, index, ids)
+	if err != nil {
+		Logger(ctx).Errorf("Unable to get documents from index %s: %v", index, err)
+		return nil, result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if len(versions) == 0 {
+		return versions, nil
+	}
+
+	existing := make([]string, 0, len(versions))
+	for id := range versions {
+		existing = append(existing, id)
+	}
+
+	visible, err := es.visibleIDs(ctx, index, existing, filters)
+	if err != nil {
+		Logger(ctx).Errorf("Unable to check filters of documents from index %s: %v", index, err)
+		return nil, result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	for i, id := range ids {
+		if _, ok := versions[id]; ok && !visible[id] {
+			return nil, result.Err(403, "DOCUMENT_NOT_ALLOWED", fmt.Sprintf("Document [%d] replaces document '%s' in index '%s', which doesn't match your filters.", i, id, index))
+		}
+	}
+
+	return versions, nil
+}
+
+// documentVersions returns the versions of the documents with the ids that exist.
+func (es *ElasticService) documentVersions(ctx context.Context, index string, ids []string) (map[string]*DocumentVersion, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"ids": ids}); err != nil {
+		return nil, err
+	}
+
+	res, err := es.client.Mget(&buf,
+		es.client.Mget.WithIndex(index),
+		es.client.Mget.WithContext(ctx),
+		es.client.Mget.WithSource("false"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	var d struct {
+		Docs []map[string]interface{} `json:"docs"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]*DocumentVersion, len(d.Docs))
+	for _, doc := range d.Docs {
+		if found, _ := doc["found"].(bool); !found {
+			continue
+		}
+
+		if id, ok := doc["_id"].(string); ok {
+			if version := versionFromResponse(doc); version != nil {
+				versions[id] = version
+			}
+		}
+	}
+
+	return versions, nil
+}
+
+// visibleIDs returns which of the documents with the ids match every filter.
+func (es *ElasticService) visibleIDs(ctx context.Context, index string, ids []string, filters []map[string]interface{}) (map[string]bool, error) {
+	clauses := []interface{}{map[string]interface{}{"ids": map[string]interface{}{"values": ids}}}
+	for _, filter := range filters {
+		clauses = append(clauses, filter)
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{
+		"size":    len(ids),
+		"_source": false,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"filter": clauses},
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	res, err := es.client.Search(
+		es.client.Search.WithIndex(index),
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithBody(&buf))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	var d struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+
+	visible := make(map[string]bool, len(d.Hits.Hits))
+	for _, hit := range d.Hits.Hits {
+		visible[hit.ID] = true
+	}
+
+	return visible, nil
+}
+
+// checkDocumentFilters checks that a document matches every filter before it is
+// written.
+func checkDocumentFilters(index string, name string, doc map[string]interface{}, filters []map[string]interface{}) *result.Result {
+	for _, filter := range filters {
+		matches, err := documentMatches(doc, filter)
+		if err != nil {
+			return result.Err(403, "FILTER_NOT_APPLICABLE", fmt.Sprintf("Unable to write into index '%s': %v.", index, err))
+		}
+
+		if !matches {
+			return result.Err(403, "DOCUMENT_NOT_ALLOWED", fmt.Sprintf("%s doesn't match your filters on index '%s'.", name, index))
+		}
+	}
+
+	return nil
+}
+
+// compileValidators compiles the JSON Schemas of the declared indexes.
+func compileValidators(schemas map[string]schema.Index) (map[string]*jsonschema.Schema, error) {
+	validators := map[string]*jsonschema.Schema{}
+	for index, s := range schemas {
+		if s.JSONSchema == nil {
+			continue
+		}
+
+		logrus.Debugf("Compiling JSON Schema %s for index %s...", *s.JSONSchema, index)
+		compiled, err := jsonschema.Compile(*s.JSONSchema)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile JSON Schema for index %s: %v", index, err)
+		}
+
+		validators[index] = compiled
+	}
+
+	return validators, nil
+}
+
+// ValidateDocument validates the document against the JSON Schema of the index, if
+// the index has one. It returns a result.Error for every path that failed validation,
+// the messages are prefixed with the given prefix.
+func (es *ElasticService) ValidateDocument(index string, prefix string, doc map[string]interface{}) []result.Error {
+	validator, ok := es.validators[index]
+	if !ok {
+		return nil
+	}
+
+	err := validator.Validate(doc)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []result.Error{result.NewError("INVALID_DOCUMENT", fmt.Sprintf("%s: %v", prefix, err))}
+	}
+
+	errs := make([]result.Error, 0)
+	collectValidationErrors(&errs, prefix, ve)
+
+	return errs
+}
+
+// collectValidationErrors collects the leaf validation errors, since those are the
+// ones that point to the actual path that failed validation.
+func collectValidationErrors(errs *[]result.Error, prefix string, ve *jsonschema.ValidationError) {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+
+		*errs = append(*errs, result.NewError("INVALID_DOCUMENT", fmt.Sprintf("%s%s: %s", prefix, location, ve.Message)))
+		return
+	}
+
+	for _, cause := range ve.Causes {
+		collectValidationErrors(errs, prefix, cause)
+	}
+}
+
+// deadLetterIndex returns the dead-letter index for the index, if any.
+func (es *ElasticService) deadLetterIndex(index string) (string, bool) {
+	s, ok := es.schemas[index]
+	if !ok || s.DeadLetterIndex == nil {
+		return "", false
+	}
+
+	return *s.DeadLetterIndex, true
+}
+
+// quarantine indexes the rejected document into the dead-letter index.
+func (es *ElasticService) quarantine(ctx context.Context, deadLetter string, index string, doc map[string]interface{}, errs []result.Error) error {
+	Logger(ctx).Warnf("Quarantining document that failed validation for index %s into %s", index, deadLetter)
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{
+		"index":       index,
+		"document":    doc,
+		"errors":      errs,
+		"rejected_at": time.Now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return err
+	}
+
+	res, err := es.client.Index(deadLetter, &buf, es.client.Index.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("received %s from Elasticsearch", res.Status())
+	}
+
+	return nil
+}
+
+// IndexDocument validates and indexes a single document. If the id is empty,
+// Elasticsearch will generate one.
+func (es *ElasticService) IndexDocument(ctx context.Context, index string, id string, doc map[string]interface{}, options WriteOptions) *result.Result {
+	if res := es.checkPipeline(options.Pipeline); res != nil {
+		return res
+	}
+
+	if filters := writeFilters(ctx, index); len(filters) > 0 {
+		var res *result.Result
+		if options, res = es.checkWriteFilters(ctx, index, id, doc, filters, options); res != nil {
+			return res
+		}
+	}
+
+	if errs := es.ValidateDocument(index, "document", doc); len(errs) > 0 {
+		deadLetter, ok := es.deadLetterIndex(index)
+		if !ok {
+			return result.Errs(422, errs...)
+		}
+
+		if err := es.quarantine(ctx, deadLetter, index, doc, errs); err != nil {
+			Logger(ctx).Errorf("Unable to quarantine document for index %s: %v", index, err)
+			return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+		}
+
+		return result.OkWithStatus(202, map[string]interface{}{
+			"quarantined":       true,
+			"dead_letter_index": deadLetter,
+			"errors":            errs,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+		Logger(ctx).Errorf("Unable to encode document %v: %v", doc, err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	opts := []func(*esapi.IndexRequest){es.client.Index.WithContext(ctx)}
+	if id != "" {
+		opts = append(opts, es.client.Index.WithDocumentID(id))
+	}
+
+	if options.Pipeline != "" {
+		opts = append(opts, es.client.Index.WithPipeline(options.Pipeline))
+	}
+
+	if options.IfMatch != nil {
+		opts = append(opts,
+			es.client.Index.WithIfSeqNo(options.IfMatch.SeqNo),
+			es.client.Index.WithIfPrimaryTerm(options.IfMatch.PrimaryTerm))
+	}
+
+	if options.CreateOnly {
+		opts = append(opts, es.client.Index.WithOpType("create"))
+	}
+
+	res, err := es.client.Index(index, &buf, opts...)
+	if err != nil {
+		Logger(ctx).Errorf("Unable to index document into index %s: %v", index, err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	defer res.Body.Close()
+
+	var d map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		Logger(ctx).Errorf("Unable to decode JSON payload from Elastic: %s", err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if res.StatusCode == 409 {
+		// A conflict on a write with preconditions means the precondition failed,
+		// otherwise the document already exists.
+		status := 409
+		if options.IfMatch != nil || options.CreateOnly {
+			status = 412
+		}
+
+		return result.Err(status, "VERSION_CONFLICT", fmt.Sprintf("Document '%s' in index '%s' was modified or already exists.", id, index))
+	}
+
+	if res.IsError() {
+		return writeError(ctx, index, res.StatusCode, d)
+	}
+
+	return result.OkWithStatus(res.StatusCode, map[string]interface{}{
+		"id":      d["_id"],
+		"result":  d["result"],
+		"version": d["_version"],
+		"etag":    etagFromResponse(d),
+	})
+}
+
+// documentID returns the document id from the value of an id field. Only non-empty
+// strings and numbers are ids; numbers are formatted without an exponent, so that
+// 1234567 isn't indexed as "1.234567e+06".
+func documentID(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// BulkIndex validates and indexes multiple documents. If idField is not empty, the
+// document id is taken from that field of each document. If any document fails
+// validation and the index has no dead-letter index, nothing is indexed. With
+// WriteOptions.CreateOnly, every document is created, so the ones that already
+// exist fail; WriteOptions.IfMatch isn't supported, since a version is per document.
+func (es *ElasticService) BulkIndex(ctx context.Context, index string, idField string, docs []map[string]interface{}, options WriteOptions) *result.Result {
+	if res := es.checkPipeline(options.Pipeline); res != nil {
+		return res
+	}
+
+	if options.IfMatch != nil {
+		return result.Err(400, "IF_MATCH_NOT_SUPPORTED", "Header If-Match can't be used on bulk writes, since every document has its own version.")
+	}
+
+	valid := make([]map[string]interface{}, 0, len(docs))
+	errs := make([]result.Error, 0)
+	quarantined := 0
+
+	filters := writeFilters(ctx, index)
+	deadLetter, hasDeadLetter := es.deadLetterIndex(index)
+	for i, doc := range docs {
+		if idField != "" {
+			value, ok := doc[idField]
+			if !ok {
+				return result.Err(406, "MISSING_ID_FIELD", fmt.Sprintf("Document [%d] is missing id field '%s'.", i, idField))
+			}
+
+			if _, ok := documentID(value); !ok {
+				return result.Err(406, "INVALID_ID_FIELD", fmt.Sprintf("Document [%d] has id field '%s' that isn't a string or number.", i, idField))
+			}
+		}
+
+		if res := checkDocumentFilters(index, fmt.Sprintf("Document [%d]", i), doc, filters); res != nil {
+			return res
+		}
+
+		docErrs := es.ValidateDocument(index, fmt.Sprintf("[%d]", i), doc)
+		if len(docErrs) == 0 {
+			valid = append(valid, doc)
+			continue
+		}
+
+		if !hasDeadLetter {
+			errs = append(errs, docErrs...)
+			continue
+		}
+
+		if err := es.quarantine(ctx, deadLetter, index, doc, docErrs); err != nil {
+			Logger(ctx).Errorf("Unable to quarantine document for index %s: %v", index, err)
+			return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+		}
+
+		quarantined++
+	}
+
+	if len(errs) > 0 {
+		return result.Errs(422, errs...)
+	}
+
+	// Documents of principals with filters are only created, or replace documents
+	// at the version that was checked against the filters.
+	var versions map[string]*DocumentVersion
+	if len(filters) > 0 && idField != "" && len(valid) > 0 {
+		var res *result.Result
+		if versions, res = es.checkBulkWriteFilters(ctx, index, idField, valid, filters); res != nil {
+			return res
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, doc := range valid {
+		op := "index"
+		if options.CreateOnly {
+			op = "create"
+		}
+
+		action := map[string]interface{}{}
+		if idField != "" {
+			id, _ := documentID(doc[idField])
+			action["_id"] = id
+
+			if len(filters) > 0 && !options.CreateOnly {
+				if version, ok := versions[id]; ok {
+					action["if_seq_no"] = version.SeqNo
+					action["if_primary_term"] = version.PrimaryTerm
+				} else {
+					op = "create"
+				}
+			}
+		}
+
+		if err := encoder.Encode(map[string]interface{}{op: action}); err != nil {
+			Logger(ctx).Errorf("Unable to encode bulk action: %v", err)
+			return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+		}
+
+		if err := encoder.Encode(doc); err != nil {
+			Logger(ctx).Errorf("Unable to encode document %v: %v", doc, err)
+			return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+		}
+	}
+
+	items := make([]map[string]interface{}, 0, len(valid))
+	if len(valid) == 0 {
+		return result.Ok(map[string]interface{}{
+			"errors":      false,
+			"quarantined": quarantined,
+			"items":       items,
+		})
+	}
+
+	opts := []func(*esapi.BulkRequest){
+		es.client.Bulk.WithIndex(index),
+		es.client.Bulk.WithContext(ctx),
+	}
+
+	if options.Pipeline != "" {
+		opts = append(opts, es.client.Bulk.WithPipeline(options.Pipeline))
+	}
+
+	res, err := es.client.Bulk(&buf, opts...)
+
+	if err != nil {
+		Logger(ctx).Errorf("Unable to bulk index documents into index %s: %v", index, err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		var e map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+			Logger(ctx).Errorf("Unable to decode JSON payload from Elastic when received a non-acceptable status code: %s", err)
+			return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+		}
+
+		return writeError(ctx, index, res.StatusCode, e)
+	}
+
+	var d struct {
+		Took   float64                             `json:"took"`
+		Errors bool                                `json:"errors"`
+		Items  []map[string]map[string]interface{} `json:"items"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		Logger(ctx).Errorf("Unable to decode JSON payload from Elastic: %s", err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	for _, item := range d.Items {
+		for _, op := range item {
+			i := map[string]interface{}{
+				"id":     op["_id"],
+				"status": op["status"],
+			}
+
+			if e, ok := op["error"].(map[string]interface{}); ok {
+				i["error"] = fmt.Sprintf("%s: %s", e["type"], e["reason"])
+			} else {
+				i["result"] = op["result"]
+			}
+
+			items = append(items, i)
+		}
+	}
+
+	return result.Ok(map[string]interface{}{
+		"took":        d.Took,
+		"errors":      d.Errors,
+		"quarantined": quarantined,
+		"items":       items,
+	})
+}
+
+// writeError converts an error response from Elasticsearch on a write path into a
+// Result. Bad requests (i.e. an unknown ingest pipeline) are passed to the user.
+func writeError(ctx context.Context, index string, status int, body map[string]interface{}) *result.Result {
+	reason := elasticErrorReason(body)
+	if status == 400 {
+		return result.Err(400, "ELASTIC_BAD_REQUEST", reason)
+	}
+
+	Logger(ctx).Errorf("Unable to write into index %s because: '%s'.", index, reason)
+	return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+}
@@ -0,0 +1,243 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"floofy.dev/tsubasa/internal/schema"
+	"github.com/elastic/go-elasticsearch/v8"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeElastic records the requests sent to it and answers them with the
+// response of the longest route that is a prefix of "METHOD /path".
+type fakeElastic struct {
+	mu        sync.Mutex
+	requests  []string
+	bodies    map[string]string
+	queries   map[string]string
+	responses map[string]string
+}
+
+func (f *fakeElastic) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	route := req.Method + " " + req.URL.Path
+
+	f.mu.Lock()
+	f.requests = append(f.requests, route)
+	f.bodies[route] = string(body)
+	f.queries[route] = req.URL.RawQuery
+	f.mu.Unlock()
+
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	matched := ""
+	for prefix := range f.responses {
+		if strings.HasPrefix(route, prefix) && len(prefix) > len(matched) {
+			matched = prefix
+		}
+	}
+
+	if matched != "" {
+		_, _ = w.Write([]byte(f.responses[matched]))
+		return
+	}
+
+	w.WriteHeader(404)
+	_, _ = w.Write([]byte(`{"error": {"type": "not_found", "reason": "no route"}}`))
+}
+
+// newTestElastic returns an ElasticService whose client talks to the fake.
+func newTestElastic(t *testing.T, fake *fakeElastic) *ElasticService {
+	if fake.bodies == nil {
+		fake.bodies = map[string]string{}
+		fake.queries = map[string]string{}
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &ElasticService{client: client, schemas: map[string]schema.Index{}}
+}
+
+// withSchema compiles a JSON Schema for the index, with an optional dead-letter index.
+func withSchema(t *testing.T, es *ElasticService, index string, jsonSchema string, deadLetter string) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := ioutil.WriteFile(path, []byte(jsonSchema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := schema.Index{JSONSchema: &path}
+	if deadLetter != "" {
+		s.DeadLetterIndex = &deadLetter
+	}
+
+	es.schemas[index] = s
+	validators, err := compileValidators(es.schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es.validators = validators
+}
+
+const productSchema = `{
+	"type": "object",
+	"required": ["title"],
+	"properties": {
+		"title": {"type": "string"},
+		"price": {"type": "number", "minimum": 0}
+	}
+}`
+
+func TestDocumentID(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		id    string
+		ok    bool
+	}{
+		{"abc", "abc", true},
+		{"", "", false},
+		{float64(1234567), "1234567", true},
+		{1.5, "1.5", true},
+		{json.Number("12345678901234567890"), "12345678901234567890", true},
+		{true, "", false},
+		{nil, "", false},
+		{map[string]interface{}{"a": "b"}, "", false},
+		{[]interface{}{"a"}, "", false},
+	}
+
+	for _, test := range tests {
+		if id, ok := documentID(test.value); id != test.id || ok != test.ok {
+			t.Errorf("documentID(%#v) = %q, %v; want %q, %v", test.value, id, ok, test.id, test.ok)
+		}
+	}
+}
+
+func TestValidateDocument(t *testing.T) {
+	es := newTestElastic(t, &fakeElastic{})
+	withSchema(t, es, "products", productSchema, "")
+
+	if errs := es.ValidateDocument("products", "document", decodeJson(t, `{"title": "shoes", "price": 5}`)); len(errs) != 0 {
+		t.Errorf("valid document got errors %v", errs)
+	}
+
+	if errs := es.ValidateDocument("other", "document", decodeJson(t, `{}`)); len(errs) != 0 {
+		t.Errorf("index without a schema got errors %v", errs)
+	}
+
+	errs := es.ValidateDocument("products", "[3]", decodeJson(t, `{"price": -1}`))
+	if len(errs) != 2 {
+		t.Fatalf("expected an error for title and price, got %v", errs)
+	}
+
+	messages := errs[0].Message + "\n" + errs[1].Message
+	for _, want := range []string{"[3]/: missing properties", "[3]/price: must be >= 0"} {
+		if !strings.Contains(messages, want) {
+			t.Errorf("errors %q don't contain %q", messages, want)
+		}
+	}
+}
+
+func TestIndexDocumentQuarantine(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{
+		"POST /products-dead/_doc": `{"_id": "x", "result": "created"}`,
+	}}
+
+	es := newTestElastic(t, fake)
+	withSchema(t, es, "products", productSchema, "")
+
+	res := es.IndexDocument(context.TODO(), "products", "", decodeJson(t, `{"price": 5}`), WriteOptions{})
+	if res.StatusCode != 422 || len(fake.requests) != 0 {
+		t.Fatalf("invalid document without a dead-letter index: status %d, requests %v", res.StatusCode, fake.requests)
+	}
+
+	withSchema(t, es, "products", productSchema, "products-dead")
+	res = es.IndexDocument(context.TODO(), "products", "", decodeJson(t, `{"price": 5}`), WriteOptions{})
+	if res.StatusCode != 202 {
+		t.Fatalf("invalid document with a dead-letter index: status %d", res.StatusCode)
+	}
+
+	if len(fake.requests) != 1 || fake.requests[0] != "POST /products-dead/_doc" {
+		t.Fatalf("expected the document to be quarantined, got requests %v", fake.requests)
+	}
+
+	quarantined := decodeJson(t, fake.bodies["POST /products-dead/_doc"])
+	if quarantined["index"] != "products" || quarantined["document"].(map[string]interface{})["price"] != float64(5) {
+		t.Errorf("quarantined body = %v", quarantined)
+	}
+
+	if errs, ok := quarantined["errors"].([]interface{}); !ok || len(errs) != 1 {
+		t.Errorf("quarantined errors = %v", quarantined["errors"])
+	}
+}
+
+func TestBulkIndexQuarantine(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{
+		"POST /products-dead/_doc": `{"_id": "x", "result": "created"}`,
+		"POST /products/_bulk":     `{"took": 1, "errors": false, "items": [{"index": {"_id": "1234567", "status": 201, "result": "created"}}]}`,
+	}}
+
+	es := newTestElastic(t, fake)
+	withSchema(t, es, "products", productSchema, "")
+
+	docs := []map[string]interface{}{
+		decodeJson(t, `{"id": 1234567, "title": "shoes"}`),
+		decodeJson(t, `{"id": 2, "price": 5}`),
+	}
+
+	res := es.BulkIndex(context.TODO(), "products", "id", docs, WriteOptions{})
+	if res.StatusCode != 422 || len(fake.requests) != 0 {
+		t.Fatalf("invalid documents without a dead-letter index: status %d, requests %v", res.StatusCode, fake.requests)
+	}
+
+	withSchema(t, es, "products", productSchema, "products-dead")
+	res = es.BulkIndex(context.TODO(), "products", "id", docs, WriteOptions{})
+	if res.StatusCode != 200 {
+		t.Fatalf("bulk with a dead-letter index: status %d (%v)", res.StatusCode, res.Errors)
+	}
+
+	if quarantined := res.Data.(map[string]interface{})["quarantined"]; quarantined != 1 {
+		t.Errorf("quarantined = %v", quarantined)
+	}
+
+	bulk := fake.bodies["POST /products/_bulk"]
+	if !strings.Contains(bulk, `{"index":{"_id":"1234567"}}`) || strings.Contains(bulk, `"price":5`) {
+		t.Errorf("bulk body = %s", bulk)
+	}
+}
+
+func TestBulkIndexInvalidID(t *testing.T) {
+	es := newTestElastic(t, &fakeElastic{})
+	for _, doc := range []string{`{"id": {"nested": 1}}`, `{"id": true}`, `{"id": ""}`} {
+		res := es.BulkIndex(context.TODO(), "products", "id", []map[string]interface{}{decodeJson(t, doc)}, WriteOptions{})
+		if res.StatusCode != 406 {
+			t.Errorf("document %s: status %d", doc, res.StatusCode)
+		}
+	}
+}
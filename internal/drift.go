@@ -0,0 +1,280 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"floofy.dev/tsubasa/internal/schema"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// DriftReport is the result of comparing the expected schema of an index
+// to its live mapping.
+type DriftReport struct {
+	schema.Drift
+
+	// Index is the index that was checked.
+	Index string `json:"index"`
+
+	// Source is where the expected schema came from, either `declared` if it was
+	// declared in the configuration file or `snapshot` if it was snapshotted from
+	// the live mapping (see `elastic.drift_snapshot_path`).
+	Source string `json:"source"`
+
+	// Drifted returns if the live mapping has drifted from the expected schema.
+	Drifted bool `json:"drifted"`
+
+	// CheckedAt is when this report was generated.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// driftState holds the mapping snapshots and the latest reports.
+type driftState struct {
+	mu        sync.RWMutex
+	path      *string
+	snapshots map[string]map[string]string
+	reports   map[string]*DriftReport
+}
+
+// Mapping returns the live mapping of the index.
+func (es *ElasticService) Mapping(index string) (map[string]interface{}, error) {
+	res, err := es.client.Indices.GetMapping(es.client.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("unable to get mapping for index %s: %s", index, res.Status())
+	}
+
+	var data map[string]map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	// An alias is answered with the mapping of the index it points to, which
+	// is only a single mapping if the alias points to a single index.
+	concrete, ok := data[index]
+	if !ok && len(data) > 1 {
+		return nil, fmt.Errorf("index %s is an alias of %d indexes, so it has no single mapping", index, len(data))
+	}
+
+	if !ok {
+		for _, mapping := range data {
+			concrete = mapping
+		}
+	}
+
+	mappings, ok := concrete["mappings"].(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}, nil
+	}
+
+	return mappings, nil
+}
+
+// snapshotMappings snapshots the live mappings of the indexes that don't have
+// a declared schema, so they can be used as the expected schema later on. If
+// the snapshots are persisted, only the indexes without one are snapshotted.
+func (es *ElasticService) snapshotMappings() {
+	snapshots := map[string]map[string]string{}
+	if es.drift.path != nil {
+		var err error
+		if snapshots, err = loadSnapshots(*es.drift.path); err != nil {
+			logrus.Errorf("Unable to load mapping snapshots from %s: %v", *es.drift.path, err)
+			return
+		}
+	} else {
+		logrus.Warn("`elastic.drift_snapshot_path` is not defined, so mappings are snapshotted on every start and drift from before is not reported")
+	}
+
+	changed := false
+	for _, index := range es.indexes {
+		if s, ok := es.schemas[index]; ok && s.HasFields() {
+			continue
+		}
+
+		if _, ok := snapshots[index]; ok {
+			continue
+		}
+
+		mapping, err := es.Mapping(index)
+		if err != nil {
+			logrus.Errorf("Unable to snapshot mapping for index %s: %v", index, err)
+			continue
+		}
+
+		snapshots[index] = schema.Flatten(mapping)
+		changed = true
+	}
+
+	es.drift.mu.Lock()
+	es.drift.snapshots = snapshots
+	es.drift.mu.Unlock()
+
+	if es.drift.path != nil && changed {
+		if err := saveSnapshots(*es.drift.path, snapshots); err != nil {
+			logrus.Errorf("Unable to save mapping snapshots to %s: %v", *es.drift.path, err)
+		}
+	}
+}
+
+// loadSnapshots loads the mapping snapshots from the file at the path, the file
+// doesn't need to exist yet.
+func loadSnapshots(path string) (map[string]map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]map[string]string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := map[string]map[string]string{}
+	if err := json.Unmarshal(contents, &snapshots); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+func saveSnapshots(path string, snapshots map[string]map[string]string) error {
+	contents, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, contents, 0o644)
+}
+
+// CheckDrift compares the expected schema of the index to its live mapping. The
+// index must be one that Tsubasa keeps track of.
+func (es *ElasticService) CheckDrift(index string) (*DriftReport, error) {
+	var expected map[string]string
+	source := "declared"
+
+	if s, ok := es.schemas[index]; ok && s.HasFields() {
+		expected = schema.Flatten(s.Mapping())
+	} else {
+		es.drift.mu.RLock()
+		snapshot, ok := es.drift.snapshots[index]
+		es.drift.mu.RUnlock()
+
+		if !ok {
+			return nil, fmt.Errorf("index %s has no declared schema or snapshot", index)
+		}
+
+		expected = snapshot
+		source = "snapshot"
+	}
+
+	mapping, err := es.Mapping(index)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := schema.Diff(expected, schema.Flatten(mapping))
+	report := &DriftReport{
+		Drift:     drift,
+		Index:     index,
+		Source:    source,
+		Drifted:   drift.HasDrifted(),
+		CheckedAt: time.Now(),
+	}
+
+	es.drift.mu.Lock()
+	es.drift.reports[index] = report
+	es.drift.mu.Unlock()
+
+	if report.Drifted {
+		logrus.Warnf("Mapping for index %s has drifted from its %s schema: %d added, %d missing, %d conflicting field(s)",
+			index,
+			source,
+			len(drift.Added),
+			len(drift.Missing),
+			len(drift.Conflicts))
+
+		for _, f := range drift.Added {
+			logrus.Warnf("   => [%s] added field %s (%s)", index, f.Path, f.Actual)
+		}
+
+		for _, f := range drift.Missing {
+			logrus.Warnf("   => [%s] missing field %s (%s)", index, f.Path, f.Expected)
+		}
+
+		for _, f := range drift.Conflicts {
+			logrus.Warnf("   => [%s] conflicting field %s (expected %s, got %s)", index, f.Path, f.Expected, f.Actual)
+		}
+	}
+
+	return report, nil
+}
+
+// CheckAllDrift runs CheckDrift on every index Tsubasa keeps track of.
+func (es *ElasticService) CheckAllDrift() []*DriftReport {
+	reports := make([]*DriftReport, 0, len(es.indexes))
+	for _, index := range es.indexes {
+		report, err := es.CheckDrift(index)
+		if err != nil {
+			logrus.Errorf("Unable to check mapping drift for index %s: %v", index, err)
+			continue
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// LastDriftReports returns the latest drift reports from the periodic or
+// on-demand checks.
+func (es *ElasticService) LastDriftReports() []*DriftReport {
+	es.drift.mu.RLock()
+	defer es.drift.mu.RUnlock()
+
+	reports := make([]*DriftReport, 0, len(es.drift.reports))
+	for _, index := range es.indexes {
+		if report, ok := es.drift.reports[index]; ok {
+			reports = append(reports, report)
+		}
+	}
+
+	return reports
+}
+
+// TracksIndex returns if the index is one that Tsubasa keeps track of.
+func (es *ElasticService) TracksIndex(index string) bool {
+	return containsString(es.indexes, index)
+}
+
+func (es *ElasticService) checkDriftEvery(interval time.Duration) {
+	logrus.Infof("Checking for mapping drift every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		logrus.Debug("Running periodic mapping drift check...")
+		es.CheckAllDrift()
+	}
+}
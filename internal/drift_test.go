@@ -0,0 +1,140 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"floofy.dev/tsubasa/internal/schema"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const productsMapping = `{"products-v2": {"mappings": {"properties": {
+	"title": {"type": "text"},
+	"price": {"type": "float"},
+	"color": {"type": "keyword"}
+}}}}`
+
+func TestMappingResolvesAliases(t *testing.T) {
+	es := newTestElastic(t, &fakeElastic{responses: map[string]string{
+		"GET /products/_mapping":    productsMapping,
+		"GET /products-v2/_mapping": productsMapping,
+		"GET /everything/_mapping":  `{"a": {"mappings": {}}, "b": {"mappings": {}}}`,
+	}})
+
+	for _, index := range []string{"products", "products-v2"} {
+		mapping, err := es.Mapping(index)
+		if err != nil {
+			t.Fatalf("Mapping(%s): %v", index, err)
+		}
+
+		if fields := schema.Flatten(mapping); len(fields) != 3 || fields["price"] != "float" {
+			t.Errorf("Mapping(%s) = %v", index, fields)
+		}
+	}
+
+	if _, err := es.Mapping("everything"); err == nil {
+		t.Error("alias of multiple indexes should fail")
+	}
+}
+
+func TestCheckDriftDeclared(t *testing.T) {
+	es := newTestElastic(t, &fakeElastic{responses: map[string]string{
+		"GET /products/_mapping": productsMapping,
+	}})
+
+	es.indexes = []string{"products"}
+	es.schemas["products"] = schema.Index{Fields: map[string]schema.Field{
+		"title": {Type: "text"},
+		"price": {Type: "double"},
+		"sku":   {Type: "keyword"},
+	}}
+
+	es.drift = &driftState{snapshots: map[string]map[string]string{}, reports: map[string]*DriftReport{}}
+
+	report, err := es.CheckDrift("products")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := schema.Drift{
+		Added:     []schema.FieldDrift{{Path: "color", Actual: "keyword"}},
+		Missing:   []schema.FieldDrift{{Path: "sku", Expected: "keyword"}},
+		Conflicts: []schema.FieldDrift{{Path: "price", Expected: "double", Actual: "float"}},
+	}
+
+	if !report.Drifted || report.Source != "declared" || !reflect.DeepEqual(report.Drift, want) {
+		t.Errorf("CheckDrift() = %+v", report)
+	}
+
+	if reports := es.LastDriftReports(); len(reports) != 1 || reports[0] != report {
+		t.Errorf("LastDriftReports() = %v", reports)
+	}
+}
+
+func TestCheckDriftSnapshot(t *testing.T) {
+	fake := &fakeElastic{responses: map[string]string{
+		"GET /products/_mapping": productsMapping,
+	}}
+
+	es := newTestElastic(t, fake)
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+
+	es.indexes = []string{"products"}
+	es.drift = &driftState{path: &path, snapshots: map[string]map[string]string{}, reports: map[string]*DriftReport{}}
+
+	if _, err := es.CheckDrift("products"); err == nil {
+		t.Fatal("index without a schema or snapshot should fail")
+	}
+
+	es.snapshotMappings()
+	report, err := es.CheckDrift("products")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Drifted || report.Source != "snapshot" {
+		t.Errorf("CheckDrift() right after the snapshot = %+v", report)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("snapshots weren't saved: %v", err)
+	}
+
+	if string(contents) == "{}" {
+		t.Error("saved snapshots are empty")
+	}
+
+	// A persisted snapshot is kept, so drift from before a restart is reported.
+	fake.responses["GET /products/_mapping"] = `{"products-v2": {"mappings": {"properties": {"title": {"type": "keyword"}}}}}`
+	fake.requests = nil
+
+	es.snapshotMappings()
+	if len(fake.requests) != 0 {
+		t.Errorf("persisted snapshot was taken again: %v", fake.requests)
+	}
+
+	report, err = es.CheckDrift("products")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Missing) != 2 || len(report.Conflicts) != 1 || report.Conflicts[0].Path != "title" {
+		t.Errorf("CheckDrift() after the mapping changed = %+v", report.Drift)
+	}
+}
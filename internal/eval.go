@@ -0,0 +1,216 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"floofy.dev/tsubasa/internal/eval"
+	"fmt"
+)
+
+// Evaluate runs every query of the judgments with the template, and computes the
+// relevance metrics of their hits. Queries go through the same checks and filters
+// as SearchRaw, but they aren't recorded by the slow query log or the analytics.
+func (es *ElasticService) Evaluate(ctx context.Context, template eval.Template, judgments eval.Judgments, options eval.Options) (*eval.Report, error) {
+	if err := template.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := judgments.Validate(); err != nil {
+		return nil, err
+	}
+
+	if options.K < 1 {
+		return nil, fmt.Errorf("k must be positive, received %d", options.K)
+	}
+
+	if options.RankEval {
+		return es.rankEval(ctx, template, judgments, options)
+	}
+
+	queries := make([]eval.QueryResult, 0, len(judgments))
+	for _, query := range judgments.Queries() {
+		// Aggregations don't change the hits, so they aren't computed.
+		body := template.Render(query)
+		body["size"] = options.K
+		delete(body, "aggs")
+		delete(body, "aggregations")
+
+		d, _, res := es.search(ctx, template.Index, body)
+		if res != nil {
+			return nil, fmt.Errorf("unable to search query %q: %s", query, res.Errors[0].Message)
+		}
+
+		queries = append(queries, eval.Score(query, hitIDs(d), judgments[query], options))
+	}
+
+	return eval.NewReport(template, options, queries), nil
+}
+
+// hitIDs returns the document IDs of the hits of a search response.
+func hitIDs(d map[string]interface{}) []string {
+	hits, _ := d["hits"].(map[string]interface{})
+	rawHits, _ := hits["hits"].([]interface{})
+
+	ids := make([]string, 0, len(rawHits))
+	for _, rawHit := range rawHits {
+		if hit, ok := rawHit.(map[string]interface{}); ok {
+			if id, ok := hit["_id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids
+}
+
+// rankEvalMetrics are the `_rank_eval` metrics of eval.Metrics, every one of them
+// is a separate request.
+func rankEvalMetrics(options eval.Options) map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		"ndcg": {"dcg": map[string]interface{}{
+			"k":         options.K,
+			"normalize": true,
+		}},
+		"precision": {"precision": map[string]interface{}{
+			"k":                         options.K,
+			"relevant_rating_threshold": options.RelevantGrade,
+		}},
+		"mrr": {"mean_reciprocal_rank": map[string]interface{}{
+			"k":                         options.K,
+			"relevant_rating_threshold": options.RelevantGrade,
+		}},
+	}
+}
+
+// rankEval evaluates the template with the `_rank_eval` API of Elasticsearch.
+func (es *ElasticService) rankEval(ctx context.Context, template eval.Template, judgments eval.Judgments, options eval.Options) (*eval.Report, error) {
+	queries := judgments.Queries()
+	fields := searchFields(ctx, template.Index)
+	requests := make([]interface{}, 0, len(queries))
+	for i, query := range queries {
+		// The metrics set the number of hits, and `_rank_eval` doesn't allow
+		// aggregations.
+		body := template.Render(query)
+		delete(body, "size")
+		delete(body, "aggs")
+		delete(body, "aggregations")
+
+		if err := fields.CheckQuery(body); err != nil {
+			return nil, fmt.Errorf("unable to search query %q: %v", query, err)
+		}
+
+		body, err := applyFilters(body, searchFilters(ctx, template.Index))
+		if err != nil {
+			return nil, fmt.Errorf("unable to search query %q: %v", query, err)
+		}
+
+		ratings := make([]interface{}, 0, len(judgments[query]))
+		for id, grade := range judgments[query] {
+			ratings = append(ratings, map[string]interface{}{"_index": template.Index, "_id": id, "rating": grade})
+		}
+
+		// Queries can have any text, so they are referred to by their position.
+		requests = append(requests, map[string]interface{}{
+			"id":      fmt.Sprint(i),
+			"request": body,
+			"ratings": ratings,
+		})
+	}
+
+	results := make([]eval.QueryResult, len(queries))
+	for i, query := range queries {
+		results[i] = eval.QueryResult{Query: query, Hits: make([]string, 0)}
+	}
+
+	for name, metric := range rankEvalMetrics(options) {
+		details, err := es.rankEvalMetric(ctx, template.Index, requests, metric)
+		if err != nil {
+			return nil, fmt.Errorf("unable to evaluate %s: %v", name, err)
+		}
+
+		for i := range results {
+			detail := details[fmt.Sprint(i)]
+			switch name {
+			case "ndcg":
+				results[i].NDCG = detail.MetricScore
+			case "precision":
+				results[i].Precision = detail.MetricScore
+			case "mrr":
+				results[i].MRR = detail.MetricScore
+			}
+
+			results[i].Unrated = len(detail.UnratedDocs)
+			if len(detail.Hits) > len(results[i].Hits) {
+				results[i].Hits = make([]string, 0, len(detail.Hits))
+				for _, hit := range detail.Hits {
+					results[i].Hits = append(results[i].Hits, hit.Hit.ID)
+				}
+			}
+		}
+	}
+
+	return eval.NewReport(template, options, results), nil
+}
+
+type rankEvalDetail struct {
+	MetricScore float64       `json:"metric_score"`
+	UnratedDocs []interface{} `json:"unrated_docs"`
+	Hits        []struct {
+		Hit struct {
+			ID string `json:"_id"`
+		} `json:"hit"`
+	} `json:"hits"`
+}
+
+// rankEvalMetric runs the requests through `_rank_eval` with a single metric, and
+// returns the details of every request.
+func (es *ElasticService) rankEvalMetric(ctx context.Context, index string, requests []interface{}, metric map[string]interface{}) (map[string]rankEvalDetail, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"requests": requests, "metric": metric}); err != nil {
+		return nil, err
+	}
+
+	res, err := es.client.RankEval(&buf,
+		es.client.RankEval.WithIndex(index),
+		es.client.RankEval.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("received %s from Elasticsearch", res.String())
+	}
+
+	var data struct {
+		Details  map[string]rankEvalDetail `json:"details"`
+		Failures map[string]interface{}    `json:"failures"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	for id, failure := range data.Failures {
+		return nil, fmt.Errorf("request %s failed: %v", id, failure)
+	}
+
+	return data.Details, nil
+}
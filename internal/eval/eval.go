@@ -0,0 +1,345 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eval evaluates the relevance of searches offline, against judgment lists
+// of how relevant documents are to queries.
+package eval
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+)
+
+// QueryPlaceholder is replaced with the query text in the strings of a template.
+const QueryPlaceholder = "{{query}}"
+
+// Judgments are the grades of documents for every query, i.e.
+// `{"red shoes": {"doc-1": 3, "doc-7": 0}}`. Documents that aren't graded for a
+// query are not relevant to it.
+type Judgments map[string]map[string]int
+
+// LoadJudgments loads the judgments from a JSON file.
+func LoadJudgments(path string) (Judgments, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var judgments Judgments
+	if err := json.Unmarshal(contents, &judgments); err != nil {
+		return nil, fmt.Errorf("judgments in %s are not a JSON object of queries to document grades: %v", path, err)
+	}
+
+	return judgments, judgments.Validate()
+}
+
+// Validate checks that there are judgments and that grades aren't negative.
+func (j Judgments) Validate() error {
+	if len(j) == 0 {
+		return errors.New("there are no judgments")
+	}
+
+	for query, grades := range j {
+		for id, grade := range grades {
+			if grade < 0 {
+				return fmt.Errorf("grade of document %q for query %q is negative", id, query)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Queries returns the queries of the judgments in order.
+func (j Judgments) Queries() []string {
+	queries := make([]string, 0, len(j))
+	for query := range j {
+		queries = append(queries, query)
+	}
+
+	sort.Strings(queries)
+	return queries
+}
+
+// Template is a search configuration that is evaluated, which is the search body
+// that every query is run with.
+type Template struct {
+	// Name is the name of the template in reports, it defaults to the file name.
+	Name string `json:"name,omitempty"`
+
+	// Index is the index that is searched.
+	Index string `json:"index"`
+
+	// Body is the search body, where QueryPlaceholder is replaced with the query
+	// text, i.e. `{"query": {"match": {"title": "{{query}}"}}}`.
+	Body map[string]interface{} `json:"body"`
+}
+
+// LoadTemplate loads a template from a JSON file.
+func LoadTemplate(path string) (Template, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Template{}, err
+	}
+
+	var template Template
+	if err := json.Unmarshal(contents, &template); err != nil {
+		return Template{}, fmt.Errorf("template in %s is not a JSON object: %v", path, err)
+	}
+
+	if template.Name == "" {
+		template.Name = path
+	}
+
+	return template, template.Validate()
+}
+
+// Validate checks that the template has an index and a body.
+func (t Template) Validate() error {
+	if t.Index == "" {
+		return errors.New("template doesn't have an `index`")
+	}
+
+	if len(t.Body) == 0 {
+		return errors.New("template doesn't have a `body`")
+	}
+
+	return nil
+}
+
+// Render returns the search body of the query.
+func (t Template) Render(query string) map[string]interface{} {
+	return render(t.Body, query).(map[string]interface{})
+}
+
+func render(value interface{}, query string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.ReplaceAll(v, QueryPlaceholder, query)
+
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			rendered[key] = render(inner, query)
+		}
+
+		return rendered
+
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, inner := range v {
+			rendered[i] = render(inner, query)
+		}
+
+		return rendered
+
+	default:
+		return v
+	}
+}
+
+// Options are the options of an evaluation.
+type Options struct {
+	// K is the number of top hits that the metrics are computed from.
+	K int `json:"k"`
+
+	// RelevantGrade is the lowest grade of a relevant document for the precision
+	// and the reciprocal rank.
+	RelevantGrade int `json:"relevant_grade"`
+
+	// RankEval evaluates with the Elasticsearch `_rank_eval` API, rather than
+	// running every search.
+	RankEval bool `json:"rank_eval"`
+}
+
+// DefaultOptions are the options that are used when they aren't given.
+var DefaultOptions = Options{K: 10, RelevantGrade: 1}
+
+// Metrics are the relevance metrics of a query, or their mean over every query.
+type Metrics struct {
+	// NDCG is the normalized discounted cumulative gain at K.
+	NDCG float64 `json:"ndcg"`
+
+	// Precision is the share of the retrieved top K hits that are relevant.
+	Precision float64 `json:"precision"`
+
+	// MRR is the reciprocal rank of the first relevant hit in the top K, or its
+	// mean over every query.
+	MRR float64 `json:"mrr"`
+}
+
+func (m Metrics) sub(other Metrics) Metrics {
+	return Metrics{
+		NDCG:      m.NDCG - other.NDCG,
+		Precision: m.Precision - other.Precision,
+		MRR:       m.MRR - other.MRR,
+	}
+}
+
+// QueryResult is the evaluation of a query.
+type QueryResult struct {
+	Metrics
+	Query string `json:"query"`
+
+	// Hits are the IDs of the top K hits.
+	Hits []string `json:"hits"`
+
+	// Unrated is how many of the hits don't have a grade for the query.
+	Unrated int `json:"unrated"`
+}
+
+// Score computes the metrics of the ranked hits of the query.
+func Score(query string, hits []string, grades map[string]int, options Options) QueryResult {
+	if len(hits) > options.K {
+		hits = hits[:options.K]
+	}
+
+	res := QueryResult{Query: query, Hits: hits}
+
+	dcg, relevant := 0.0, 0
+	for i, id := range hits {
+		grade, ok := grades[id]
+		if !ok {
+			res.Unrated++
+		}
+
+		dcg += gain(grade, i)
+		if grade >= options.RelevantGrade {
+			relevant++
+			if res.MRR == 0 {
+				res.MRR = 1 / float64(i+1)
+			}
+		}
+	}
+
+	if len(hits) > 0 {
+		res.Precision = float64(relevant) / float64(len(hits))
+	}
+
+	ideal := make([]int, 0, len(grades))
+	for _, grade := range grades {
+		ideal = append(ideal, grade)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+	if len(ideal) > options.K {
+		ideal = ideal[:options.K]
+	}
+
+	idcg := 0.0
+	for i, grade := range ideal {
+		idcg += gain(grade, i)
+	}
+
+	if idcg > 0 {
+		res.NDCG = dcg / idcg
+	}
+
+	return res
+}
+
+// gain is the discounted gain of a hit with the grade at the 0-based position,
+// which is the same as the `dcg` metric of Elasticsearch.
+func gain(grade int, position int) float64 {
+	return (math.Pow(2, float64(grade)) - 1) / math.Log2(float64(position+2))
+}
+
+// Report is the evaluation of a template.
+type Report struct {
+	Metrics
+	Name    string        `json:"name"`
+	Index   string        `json:"index"`
+	Options Options       `json:"options"`
+	Queries []QueryResult `json:"queries"`
+}
+
+// NewReport creates the report of the results of every query, with their mean
+// metrics.
+func NewReport(template Template, options Options, queries []QueryResult) *Report {
+	report := &Report{
+		Name:    template.Name,
+		Index:   template.Index,
+		Options: options,
+		Queries: queries,
+	}
+
+	for _, query := range queries {
+		report.NDCG += query.NDCG
+		report.Precision += query.Precision
+		report.MRR += query.MRR
+	}
+
+	if len(queries) > 0 {
+		report.NDCG /= float64(len(queries))
+		report.Precision /= float64(len(queries))
+		report.MRR /= float64(len(queries))
+	}
+
+	return report
+}
+
+// QueryDiff is the difference of a query between two reports.
+type QueryDiff struct {
+	Query     string  `json:"query"`
+	Baseline  Metrics `json:"baseline"`
+	Candidate Metrics `json:"candidate"`
+	Delta     Metrics `json:"delta"`
+}
+
+// Comparison compares the report of a candidate template with the baseline.
+type Comparison struct {
+	Baseline  *Report `json:"baseline"`
+	Candidate *Report `json:"candidate"`
+	Delta     Metrics `json:"delta"`
+
+	// Queries are the differences of every query, by the NDCG delta in ascending
+	// order, so the regressions come first.
+	Queries []QueryDiff `json:"queries"`
+}
+
+// Compare compares the candidate report with the baseline report.
+func Compare(baseline *Report, candidate *Report) *Comparison {
+	candidates := make(map[string]Metrics, len(candidate.Queries))
+	for _, query := range candidate.Queries {
+		candidates[query.Query] = query.Metrics
+	}
+
+	queries := make([]QueryDiff, 0, len(baseline.Queries))
+	for _, query := range baseline.Queries {
+		metrics := candidates[query.Query]
+		queries = append(queries, QueryDiff{
+			Query:     query.Query,
+			Baseline:  query.Metrics,
+			Candidate: metrics,
+			Delta:     metrics.sub(query.Metrics),
+		})
+	}
+
+	sort.SliceStable(queries, func(i, j int) bool {
+		return queries[i].Delta.NDCG < queries[j].Delta.NDCG
+	})
+
+	return &Comparison{
+		Baseline:  baseline,
+		Candidate: candidate,
+		Delta:     candidate.Metrics.sub(baseline.Metrics),
+		Queries:   queries,
+	}
+}
@@ -0,0 +1,174 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eval
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+var grades = map[string]int{"a": 3, "b": 2, "c": 0, "d": 1}
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func nearMetrics(a Metrics, b Metrics) bool {
+	return near(a.NDCG, b.NDCG) && near(a.Precision, b.Precision) && near(a.MRR, b.MRR)
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		hits    []string
+		grades  map[string]int
+		options Options
+		metrics Metrics
+		unrated int
+	}{
+		{
+			// DCG = 0 + 7/log2(3) + 1/2, IDCG = 7 + 3/log2(3) + 1/2.
+			name:    "mixed ranking",
+			hits:    []string{"c", "a", "d"},
+			grades:  grades,
+			options: Options{K: 3, RelevantGrade: 1},
+			metrics: Metrics{NDCG: 0.5234343216411389, Precision: 2.0 / 3, MRR: 0.5},
+		},
+		{
+			name:    "ideal ranking",
+			hits:    []string{"a", "b", "d"},
+			grades:  grades,
+			options: Options{K: 3, RelevantGrade: 1},
+			metrics: Metrics{NDCG: 1, Precision: 1, MRR: 1},
+		},
+		{
+			name:    "nothing relevant",
+			hits:    []string{"c", "x"},
+			grades:  grades,
+			options: Options{K: 3, RelevantGrade: 1},
+			metrics: Metrics{},
+			unrated: 1,
+		},
+		{
+			// Only the top 2 hits count, DCG = 7/log2(3), IDCG = 7 + 3/log2(3).
+			name:    "cut off at k",
+			hits:    []string{"c", "a", "d", "b"},
+			grades:  grades,
+			options: Options{K: 2, RelevantGrade: 1},
+			metrics: Metrics{NDCG: 0.4966392596877323, Precision: 0.5, MRR: 0.5},
+		},
+		{
+			// DCG = 1 + 7/log2(3), IDCG = 7 + 3/log2(3) + 1/2.
+			name:    "higher relevant grade",
+			hits:    []string{"d", "a"},
+			grades:  grades,
+			options: Options{K: 10, RelevantGrade: 2},
+			metrics: Metrics{NDCG: 0.5766666455144387, Precision: 0.5, MRR: 0.5},
+		},
+		{
+			name:    "no hits",
+			hits:    []string{},
+			grades:  grades,
+			options: DefaultOptions,
+			metrics: Metrics{},
+		},
+		{
+			name:    "no grades",
+			hits:    []string{"a", "b"},
+			grades:  map[string]int{},
+			options: DefaultOptions,
+			metrics: Metrics{},
+			unrated: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := Score("q", test.hits, test.grades, test.options)
+			if !nearMetrics(res.Metrics, test.metrics) {
+				t.Errorf("Score() = %+v, want %+v", res.Metrics, test.metrics)
+			}
+
+			if res.Unrated != test.unrated {
+				t.Errorf("Unrated = %d, want %d", res.Unrated, test.unrated)
+			}
+
+			if len(res.Hits) > test.options.K {
+				t.Errorf("Hits = %v, longer than k", res.Hits)
+			}
+		})
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	report := NewReport(Template{Name: "baseline", Index: "products"}, DefaultOptions, []QueryResult{
+		{Query: "q1", Metrics: Metrics{NDCG: 0.5, Precision: 0.5, MRR: 0.5}},
+		{Query: "q2", Metrics: Metrics{NDCG: 1, Precision: 0, MRR: 1}},
+	})
+
+	if !nearMetrics(report.Metrics, Metrics{NDCG: 0.75, Precision: 0.25, MRR: 0.75}) || report.Name != "baseline" {
+		t.Errorf("NewReport() = %+v", report)
+	}
+
+	if empty := NewReport(Template{}, DefaultOptions, nil); empty.Metrics != (Metrics{}) {
+		t.Errorf("NewReport() without queries = %+v", empty.Metrics)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := NewReport(Template{Name: "baseline"}, DefaultOptions, []QueryResult{
+		{Query: "q1", Metrics: Metrics{NDCG: 0.5, Precision: 0.5, MRR: 0.5}},
+		{Query: "q2", Metrics: Metrics{NDCG: 1, Precision: 1, MRR: 1}},
+		{Query: "q3", Metrics: Metrics{NDCG: 0.2, Precision: 0.1, MRR: 0.25}},
+	})
+
+	// The candidate has no result for q3, so it scores 0 on it.
+	candidate := NewReport(Template{Name: "candidate"}, DefaultOptions, []QueryResult{
+		{Query: "q1", Metrics: Metrics{NDCG: 0.8, Precision: 0.5, MRR: 1}},
+		{Query: "q2", Metrics: Metrics{NDCG: 0.6, Precision: 0.5, MRR: 0.5}},
+	})
+
+	comparison := Compare(baseline, candidate)
+
+	// The deltas are between the means of each report, baseline (1.7/3, 1.6/3, 1.75/3)
+	// and candidate (0.7, 0.5, 0.75).
+	if !nearMetrics(comparison.Delta, Metrics{NDCG: 0.7 - 1.7/3, Precision: 0.5 - 1.6/3, MRR: 0.75 - 1.75/3}) {
+		t.Errorf("Delta = %+v", comparison.Delta)
+	}
+
+	// Regressions come first.
+	order := make([]string, 0, len(comparison.Queries))
+	for _, query := range comparison.Queries {
+		order = append(order, query.Query)
+	}
+
+	if !reflect.DeepEqual(order, []string{"q2", "q3", "q1"}) {
+		t.Errorf("queries are ordered %v", order)
+	}
+
+	want := map[string]Metrics{
+		"q1": {NDCG: 0.3, Precision: 0, MRR: 0.5},
+		"q2": {NDCG: -0.4, Precision: -0.5, MRR: -0.5},
+		"q3": {NDCG: -0.2, Precision: -0.1, MRR: -0.25},
+	}
+
+	for _, query := range comparison.Queries {
+		if !nearMetrics(query.Delta, want[query.Query]) {
+			t.Errorf("%s delta = %+v, want %+v", query.Query, query.Delta, want[query.Query])
+		}
+	}
+}
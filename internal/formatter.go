@@ -17,19 +17,60 @@ package internal
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// LogFormat is the output format of the Formatter.
+type LogFormat string
+
+var (
+	// TextLogFormat is the coloured format for humans.
+	TextLogFormat LogFormat = "text"
+
+	// JSONLogFormat writes every entry as a JSON object on its own line.
+	JSONLogFormat LogFormat = "json"
+
+	// LogfmtLogFormat writes every entry as `key=value` pairs on its own line.
+	LogfmtLogFormat LogFormat = "logfmt"
+)
+
+// ParseLogFormat returns the LogFormat of the name, which is "text", "json" or "logfmt".
+func ParseLogFormat(name string) (LogFormat, error) {
+	switch LogFormat(strings.ToLower(name)) {
+	case TextLogFormat:
+		return TextLogFormat, nil
+
+	case JSONLogFormat:
+		return JSONLogFormat, nil
+
+	case LogfmtLogFormat:
+		return LogfmtLogFormat, nil
+
+	default:
+		return "", fmt.Errorf("unknown log format %q, expected \"text\", \"json\" or \"logfmt\"", name)
+	}
+}
+
 type Formatter struct {
 	// DisableColors is when we need to disable colour output.
 	//
 	// This can be overrided using the `TSUBASA_DISABLE_COLORS` environment
 	// variable.
 	DisableColors bool
+
+	// Output is the format of the log entries, by default it is TextLogFormat.
+	//
+	// This can be overrided using the `TSUBASA_LOG_FORMAT` environment
+	// variable.
+	Output LogFormat
 }
 
 var format = "Jan 02, 2006 - 15:04:05 MST"
@@ -41,8 +82,16 @@ func NewFormatter() *Formatter {
 		disabledColors = true
 	}
 
+	output := TextLogFormat
+	if name := os.Getenv("TSUBASA_LOG_FORMAT"); name != "" {
+		if parsed, err := ParseLogFormat(name); err == nil {
+			output = parsed
+		}
+	}
+
 	f := &Formatter{
 		DisableColors: disabledColors,
+		Output:        output,
 	}
 
 	return f
@@ -50,6 +99,20 @@ func NewFormatter() *Formatter {
 
 // Format renders a single log entry for logrus.
 func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	switch f.Output {
+	case JSONLogFormat:
+		return f.formatJSON(entry)
+
+	case LogfmtLogFormat:
+		return f.formatLogfmt(entry)
+
+	default:
+		return f.formatText(entry)
+	}
+}
+
+// formatText renders the entry in the coloured format for humans.
+func (f *Formatter) formatText(entry *logrus.Entry) ([]byte, error) {
 	fields := make(logrus.Fields)
 	for k, v := range entry.Data {
 		fields[k] = v
@@ -74,8 +137,8 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 	}
 
 	if len(fields) != 0 {
-		for f, v := range fields {
-			fmt.Fprintf(b, "[%s=%v] ", f, v)
+		for _, f := range sortedKeys(fields) {
+			fmt.Fprintf(b, "[%s=%v] ", f, fields[f])
 		}
 	}
 
@@ -112,6 +175,101 @@ func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// structuredFields returns the fields of a JSON or logfmt entry. The fields of the
+// entry that clash with the built-in ones are prefixed with `fields.`.
+func (f *Formatter) structuredFields(entry *logrus.Entry) logrus.Fields {
+	fields := logrus.Fields{
+		"time":  entry.Time.Format(time.RFC3339Nano),
+		"level": entry.Level.String(),
+		"msg":   strings.TrimSpace(entry.Message),
+	}
+
+	if entry.HasCaller() {
+		fields["caller"] = fmt.Sprintf("%s:%d", entry.Caller.File, entry.Caller.Line)
+		fields["func"] = entry.Caller.Function
+	}
+
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		if _, ok := fields[k]; ok {
+			k = "fields." + k
+		}
+
+		fields[k] = v
+	}
+
+	return fields
+}
+
+// formatJSON renders the entry as a JSON object.
+func (f *Formatter) formatJSON(entry *logrus.Entry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(f.structuredFields(entry)); err != nil {
+		return nil, fmt.Errorf("unable to encode log entry: %v", err)
+	}
+
+	return b.Bytes(), nil
+}
+
+// formatLogfmt renders the entry as `key=value` pairs, starting with the time,
+// level and message.
+func (f *Formatter) formatLogfmt(entry *logrus.Entry) ([]byte, error) {
+	fields := f.structuredFields(entry)
+	keys := []string{"time", "level", "msg"}
+	for _, key := range sortedKeys(fields) {
+		if key != "time" && key != "level" && key != "msg" {
+			keys = append(keys, key)
+		}
+	}
+
+	b := &bytes.Buffer{}
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(fields[key]))
+	}
+
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// logfmtValue returns the value as a logfmt value, it is quoted if it has spaces,
+// quotes, `=` or control characters.
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" {
+		return `""`
+	}
+
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+
+	return s
+}
+
+func sortedKeys(fields logrus.Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
 func (f *Formatter) getColourForLevel(level logrus.Level) string {
 	if f.DisableColors {
 		return ""
@@ -0,0 +1,127 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"testing"
+	"time"
+)
+
+func testEntry() *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Time = time.Date(2022, 6, 1, 12, 30, 0, 500000000, time.UTC)
+	entry.Level = logrus.WarnLevel
+	entry.Message = " reindex done \n"
+	entry.Data = logrus.Fields{
+		"index": "products",
+		"err":   errors.New("boom"),
+		"level": "x",
+		"note":  "has space",
+	}
+
+	return entry
+}
+
+func TestFormatterOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		formatter *Formatter
+		want      string
+	}{
+		{
+			name:      "text",
+			formatter: &Formatter{DisableColors: true},
+			want:      "[Jun 01, 2022 - 12:30:00 UTC] [WARN] [err=boom] [index=products] [level=x] [note=has space] reindex done\n",
+		},
+		{
+			name:      "coloured text",
+			formatter: &Formatter{},
+			want: "\x1b[38;2;134;134;134m[Jun 01, 2022 - 12:30:00 UTC] \x1b[0m" +
+				"\x1b[1m\x1b[38;2;243;243;134m[WARN] \x1b[0m" +
+				"[err=boom] [index=products] [level=x] [note=has space] reindex done\n",
+		},
+		{
+			name:      "json",
+			formatter: &Formatter{Output: JSONLogFormat},
+			want:      `{"err":"boom","fields.level":"x","index":"products","level":"warning","msg":"reindex done","note":"has space","time":"2022-06-01T12:30:00.5Z"}` + "\n",
+		},
+		{
+			name:      "logfmt",
+			formatter: &Formatter{Output: LogfmtLogFormat},
+			want:      `time=2022-06-01T12:30:00.5Z level=warning msg="reindex done" err=boom fields.level=x index=products note="has space"` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := test.formatter.Format(testEntry())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(out) != test.want {
+				t.Errorf("Format() = %q\nwant %q", out, test.want)
+			}
+		})
+	}
+}
+
+func TestLogfmtValue(t *testing.T) {
+	tests := map[interface{}]string{
+		"plain":      "plain",
+		"":           `""`,
+		"a b":        `"a b"`,
+		"a=b":        `"a=b"`,
+		`say "hi"`:   `"say \"hi\""`,
+		"line\nnext": `"line\nnext"`,
+		42:           "42",
+		true:         "true",
+	}
+
+	for value, want := range tests {
+		if got := logfmtValue(value); got != want {
+			t.Errorf("logfmtValue(%#v) = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	for name, want := range map[string]LogFormat{"text": TextLogFormat, "JSON": JSONLogFormat, "logfmt": LogfmtLogFormat} {
+		if got, err := ParseLogFormat(name); err != nil || got != want {
+			t.Errorf("ParseLogFormat(%q) = %q, %v", name, got, err)
+		}
+	}
+
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Error("ParseLogFormat(\"xml\") didn't fail")
+	}
+}
+
+func TestNewFormatterEnvironment(t *testing.T) {
+	t.Setenv("TSUBASA_DISABLE_COLORS", "1")
+	t.Setenv("TSUBASA_LOG_FORMAT", "logfmt")
+
+	if f := NewFormatter(); !f.DisableColors || f.Output != LogfmtLogFormat {
+		t.Errorf("NewFormatter() = %+v", f)
+	}
+
+	t.Setenv("TSUBASA_LOG_FORMAT", "xml")
+	if f := NewFormatter(); f.Output != TextLogFormat {
+		t.Errorf("unknown TSUBASA_LOG_FORMAT should fall back to text, got %q", f.Output)
+	}
+}
@@ -0,0 +1,117 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotentResponse is a response that was stored for an `Idempotency-Key`, so
+// it can be replayed when the request is retried.
+type IdempotentResponse struct {
+	// BodyHash is the hash of the request body, so the key can't be reused
+	// with a different request.
+	BodyHash string
+
+	// Done returns if the request has finished, if not, the request is still
+	// in-flight and the response isn't available yet.
+	Done bool
+
+	// StatusCode is the status code of the response.
+	StatusCode int
+
+	// Header is the header of the response.
+	Header http.Header
+
+	// Body is the body of the response.
+	Body []byte
+
+	expiresAt time.Time
+}
+
+// IdempotencyStore is an in-memory store of the responses to requests that were
+// sent with an `Idempotency-Key` header.
+type IdempotencyStore struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	responses map[string]*IdempotentResponse
+	lastSweep time.Time
+}
+
+// NewIdempotencyStore creates a new IdempotencyStore that keeps responses for the given TTL.
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:       ttl,
+		responses: map[string]*IdempotentResponse{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Begin returns the stored response for the key, if there is none, the key is
+// reserved for an in-flight request and `nil` is returned.
+func (s *IdempotencyStore) Begin(key string, bodyHash string) *IdempotentResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, res := range s.responses {
+			if now.After(res.expiresAt) {
+				delete(s.responses, k)
+			}
+		}
+
+		s.lastSweep = now
+	}
+
+	if res, ok := s.responses[key]; ok && now.Before(res.expiresAt) {
+		copied := *res
+		return &copied
+	}
+
+	s.responses[key] = &IdempotentResponse{
+		BodyHash:  bodyHash,
+		expiresAt: now.Add(s.ttl),
+	}
+
+	return nil
+}
+
+// Complete stores the response for the key that was reserved with Begin.
+func (s *IdempotencyStore) Complete(key string, statusCode int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, ok := s.responses[key]
+	if !ok {
+		return
+	}
+
+	res.Done = true
+	res.StatusCode = statusCode
+	res.Header = header
+	res.Body = body
+}
+
+// Release removes the key that was reserved with Begin, so the request can be retried.
+func (s *IdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.responses, key)
+}
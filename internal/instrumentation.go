@@ -0,0 +1,226 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"floofy.dev/tsubasa/internal/metrics"
+	"floofy.dev/tsubasa/internal/schema"
+	"floofy.dev/tsubasa/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// instrumentedTransport records the latency and errors of every Elasticsearch call,
+// and traces it as a child of the span in the request context.
+type instrumentedTransport struct {
+	next http.RoundTripper
+
+	// indexes are the indexes that can be used as metric labels.
+	indexes map[string]bool
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation, index := elasticOperation(req)
+	indexLabel := metricIndexLabel(t.indexes, index)
+
+	ctx, span := tracing.Tracer().Start(req.Context(), "elasticsearch "+operation, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.system", "elasticsearch"),
+		attribute.String("db.operation", operation),
+		attribute.String("http.method", req.Method),
+	)
+
+	if index != "" {
+		span.SetAttributes(attribute.String("elasticsearch.index", index))
+	}
+
+	// Elasticsearch continues the trace with the `traceparent` header, and shows
+	// the request ID in its slow logs and tasks with `X-Opaque-Id`.
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if id := RequestID(ctx); id != "" && req.Header.Get("X-Opaque-Id") == "" {
+		req.Header.Set("X-Opaque-Id", id)
+	}
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	metrics.ElasticDuration.WithLabelValues(operation, indexLabel).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		errorType := transportErrorType(err)
+		metrics.ElasticErrors.WithLabelValues(operation, indexLabel, errorType).Inc()
+
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorType)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+
+	// HEAD requests return 404 when the index or document doesn't exist, which is
+	// not a failure.
+	if res.StatusCode >= 400 && !(req.Method == http.MethodHead && res.StatusCode == 404) {
+		errorType := elasticErrorType(res)
+		metrics.ElasticErrors.WithLabelValues(operation, indexLabel, errorType).Inc()
+
+		span.SetStatus(codes.Error, errorType)
+	}
+
+	return res, nil
+}
+
+// metricIndexes returns the indexes that can be used as metric labels, which are
+// the indexes Tsubasa keeps track of and their dead-letter indexes.
+func metricIndexes(indexes []string, schemas map[string]schema.Index) map[string]bool {
+	labels := make(map[string]bool, len(indexes))
+	for _, index := range indexes {
+		labels[index] = true
+	}
+
+	for _, s := range schemas {
+		if s.DeadLetterIndex != nil {
+			labels[*s.DeadLetterIndex] = true
+		}
+	}
+
+	return labels
+}
+
+// metricIndexLabel returns the metric label for the index. Requests can name any
+// index (or a comma list or pattern of them), so the indexes that aren't declared
+// in the configuration are all labeled `other`, to keep the cardinality bounded.
+func metricIndexLabel(indexes map[string]bool, index string) string {
+	if index == "" || indexes[index] {
+		return index
+	}
+
+	return "other"
+}
+
+// metricIndex returns the metric label for the index.
+func (es *ElasticService) metricIndex(index string) string {
+	return metricIndexLabel(es.metricIndexes, index)
+}
+
+// elasticOperation returns the operation (i.e. `search`, `bulk`) and the index of
+// an Elasticsearch request from its path.
+func elasticOperation(req *http.Request) (string, string) {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	index := ""
+	if segments[0] != "" && !strings.HasPrefix(segments[0], "_") {
+		index = segments[0]
+	}
+
+	operation := ""
+	for _, segment := range segments {
+		if strings.HasPrefix(segment, "_") {
+			operation = strings.TrimPrefix(segment, "_")
+		}
+	}
+
+	switch {
+	case operation == "doc" || operation == "create":
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			operation = "get"
+		case http.MethodDelete:
+			operation = "delete"
+		default:
+			operation = "index"
+		}
+
+	case operation == "" && index == "":
+		operation = "info"
+
+	case operation == "":
+		switch req.Method {
+		case http.MethodHead:
+			operation = "indices.exists"
+		case http.MethodPut:
+			operation = "indices.create"
+		case http.MethodDelete:
+			operation = "indices.delete"
+		default:
+			operation = "indices.get"
+		}
+	}
+
+	return operation, index
+}
+
+// elasticErrorType returns the `error.type` of a failed Elasticsearch response,
+// the body is read and replaced, so it can still be read by the caller.
+func elasticErrorType(res *http.Response) string {
+	fallback := "http_" + http.StatusText(res.StatusCode)
+	fallback = strings.ToLower(strings.ReplaceAll(fallback, " ", "_"))
+	if res.Body == nil {
+		return fallback
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return fallback
+	}
+
+	var data struct {
+		Error json.RawMessage `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &data); err != nil || data.Error == nil {
+		return fallback
+	}
+
+	var e struct {
+		Type string `json:"type"`
+	}
+
+	if err := json.Unmarshal(data.Error, &e); err != nil || e.Type == "" {
+		return fallback
+	}
+
+	return e.Type
+}
+
+// transportErrorType returns the error type of a request that didn't get a response.
+func transportErrorType(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+
+	return "transport"
+}
@@ -0,0 +1,71 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"floofy.dev/tsubasa/internal/auth"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilter is a parsed IPFilterConfig.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter parses the allow and deny lists of the configuration.
+func NewIPFilter(config IPFilterConfig) (*IPFilter, error) {
+	allow, err := auth.ParseCIDRs(config.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("`allow`: %v", err)
+	}
+
+	deny, err := auth.ParseCIDRs(config.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("`deny`: %v", err)
+	}
+
+	return &IPFilter{allow: allow, deny: deny}, nil
+}
+
+// Allowed returns if the address (an IP, or `host:port`) can make requests.
+func (f *IPFilter) Allowed(address string) bool {
+	if auth.ContainsIP(f.deny, address) {
+		return false
+	}
+
+	return len(f.allow) == 0 || auth.ContainsIP(f.allow, address)
+}
+
+// IPFilterFor returns the IP filter of the longest prefix in `[ip_filters]` that
+// matches the path, or nil if none of them do.
+func (c *Container) IPFilterFor(path string) *IPFilter {
+	longest := ""
+	for prefix := range c.IPFilters {
+		matches := path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+		if matches && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+
+	if longest == "" {
+		return nil
+	}
+
+	return c.IPFilters[longest]
+}
@@ -0,0 +1,105 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import "testing"
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  IPFilterConfig
+		allowed map[string]bool
+	}{
+		{
+			name:   "allow list",
+			config: IPFilterConfig{Allow: []string{"10.0.0.0/8", "198.51.100.7"}},
+			allowed: map[string]bool{
+				"10.1.2.3":         true,
+				"10.1.2.3:4000":    true,
+				"198.51.100.7":     true,
+				"198.51.100.8":     false,
+				"[2001:db8::1]:80": false,
+				"not-an-ip":        false,
+			},
+		},
+		{
+			name:   "deny wins over allow",
+			config: IPFilterConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.66"}},
+			allowed: map[string]bool{
+				"10.0.0.1":  true,
+				"10.0.0.66": false,
+			},
+		},
+		{
+			name:   "deny list only",
+			config: IPFilterConfig{Deny: []string{"2001:db8::/32"}},
+			allowed: map[string]bool{
+				"198.51.100.8":     true,
+				"[2001:db8::1]:80": false,
+				"2001:db8::1":      false,
+				"2001:db9::1":      true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewIPFilter(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for address, allowed := range test.allowed {
+				if filter.Allowed(address) != allowed {
+					t.Errorf("Allowed(%q) = %v", address, !allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestNewIPFilterMalformed(t *testing.T) {
+	for _, config := range []IPFilterConfig{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Allow: []string{"localhost"}},
+		{Deny: []string{"10.0.0"}},
+	} {
+		if _, err := NewIPFilter(config); err == nil {
+			t.Errorf("NewIPFilter(%+v) didn't fail", config)
+		}
+	}
+}
+
+func TestIPFilterFor(t *testing.T) {
+	admin := &IPFilter{}
+	drift := &IPFilter{}
+	c := &Container{IPFilters: map[string]*IPFilter{"/admin": admin, "/admin/drift": drift}}
+
+	tests := map[string]*IPFilter{
+		"/admin":              admin,
+		"/admin/keys":         admin,
+		"/admin/drift":        drift,
+		"/admin/drift/orders": drift,
+		"/administrator":      nil,
+		"/":                   nil,
+	}
+
+	for path, want := range tests {
+		if got := c.IPFilterFor(path); got != want {
+			t.Errorf("IPFilterFor(%q) = %p, want %p", path, got, want)
+		}
+	}
+}
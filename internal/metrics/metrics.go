@@ -0,0 +1,105 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// Registry is the registry of Tsubasa's metrics, it also has the Go runtime and
+// process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the handled requests by method, route pattern and status.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsubasa",
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by method, route pattern and status.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration is the latency of the handled requests by method, route pattern and status.
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tsubasa",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by method, route pattern and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// HTTPInFlight is the number of requests that are being handled.
+	HTTPInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "tsubasa",
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests that are being handled.",
+	})
+
+	// ElasticDuration is the latency of the Elasticsearch calls by operation and index.
+	ElasticDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tsubasa",
+		Name:      "elastic_request_duration_seconds",
+		Help:      "Latency of Elasticsearch calls by operation and index.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "index"})
+
+	// ElasticErrors counts the failed Elasticsearch calls by operation, index and
+	// error type (i.e. `search_phase_execution_exception`, or `transport`).
+	ElasticErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tsubasa",
+		Name:      "elastic_errors_total",
+		Help:      "Number of failed Elasticsearch calls by operation, index and error type.",
+	}, []string{"operation", "index", "type"})
+
+	// SearchHits is the number of hits that searches returned by index.
+	SearchHits = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tsubasa",
+		Name:      "search_hits_returned",
+		Help:      "Number of hits returned by searches by index.",
+		Buckets:   []float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	}, []string{"index"})
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tsubasa",
+		Name:      "build_info",
+		Help:      "Build information of Tsubasa, the value is always 1.",
+	}, []string{"version", "commit_sha", "build_date"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		HTTPInFlight,
+		ElasticDuration,
+		ElasticErrors,
+		SearchHits,
+		buildInfo,
+	)
+}
+
+// SetBuildInfo sets the `tsubasa_build_info` metric.
+func SetBuildInfo(version string, commitSHA string, buildDate string) {
+	buildInfo.WithLabelValues(version, commitSHA, buildDate).Set(1)
+}
+
+// Handler returns the handler that serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
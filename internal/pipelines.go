@@ -0,0 +1,161 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"floofy.dev/tsubasa/internal/result"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// body returns the request body for the ingest pipeline API.
+func (p PipelineConfig) body() (io.Reader, error) {
+	if p.Path != nil {
+		contents, err := ioutil.ReadFile(*p.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		return bytes.NewReader(contents), nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{
+		"description": p.Description,
+		"processors":  p.Processors,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+func (es *ElasticService) createPipelines() {
+	if len(es.pipelines) == 0 {
+		return
+	}
+
+	logrus.Info("Now installing ingest pipelines...")
+	for id, pipeline := range es.pipelines {
+		body, err := pipeline.body()
+		if err != nil {
+			logrus.Errorf("  => Unable to read pipeline %s: %v", id, err)
+			continue
+		}
+
+		res, err := es.client.Ingest.PutPipeline(id, body, es.client.Ingest.PutPipeline.WithErrorTrace())
+		if err != nil {
+			logrus.Errorf("  => Unable to install pipeline %s: %v", id, err)
+			continue
+		}
+
+		if res.IsError() {
+			logrus.Errorf("  => Unable to install pipeline %s: %s", id, res.String())
+			res.Body.Close()
+			continue
+		}
+
+		res.Body.Close()
+		logrus.Infof("  => Pipeline %s is installed!", id)
+	}
+}
+
+// Pipelines returns the ids of the ingest pipelines that are declared in the configuration.
+func (es *ElasticService) Pipelines() []string {
+	ids := make([]string, 0, len(es.pipelines))
+	for id := range es.pipelines {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// checkPipeline returns a Result if the pipeline of a write isn't declared in the
+// configuration, so writes can't run arbitrary pipelines that exist in the cluster.
+func (es *ElasticService) checkPipeline(id string) *result.Result {
+	if id == "" {
+		return nil
+	}
+
+	if _, ok := es.pipelines[id]; !ok {
+		return result.Err(400, "UNKNOWN_PIPELINE", fmt.Sprintf("Pipeline '%s' is not declared in the configuration.", id))
+	}
+
+	return nil
+}
+
+// SimulatePipeline runs the declared ingest pipeline against the sample documents
+// without indexing them, so pipelines can be tested.
+func (es *ElasticService) SimulatePipeline(ctx context.Context, id string, docs []interface{}) *result.Result {
+	if res := es.checkPipeline(id); res != nil {
+		return res
+	}
+
+	samples := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		samples = append(samples, map[string]interface{}{"_source": doc})
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"docs": samples}); err != nil {
+		Logger(ctx).Errorf("Unable to encode sample documents: %v", err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	res, err := es.client.Ingest.Simulate(&buf,
+		es.client.Ingest.Simulate.WithPipelineID(id),
+		es.client.Ingest.Simulate.WithContext(ctx))
+
+	if err != nil {
+		Logger(ctx).Errorf("Unable to simulate pipeline %s: %v", id, err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	defer res.Body.Close()
+
+	var d map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		Logger(ctx).Errorf("Unable to decode JSON payload from Elastic: %s", err)
+		return result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
+	}
+
+	if res.IsError() {
+		if res.StatusCode == 404 {
+			return result.Err(404, "UNKNOWN_PIPELINE", fmt.Sprintf("Pipeline '%s' does not exist.", id))
+		}
+
+		return result.Err(400, "PIPELINE_SIMULATION_FAILED", elasticErrorReason(d))
+	}
+
+	return result.Ok(d["docs"])
+}
+
+// elasticErrorReason returns the `type: reason` of an error response from Elasticsearch.
+func elasticErrorReason(body map[string]interface{}) string {
+	e, ok := body["error"].(map[string]interface{})
+	if !ok {
+		return "Unknown error from Elasticsearch."
+	}
+
+	return fmt.Sprintf("%s: %s", e["type"], e["reason"])
+}
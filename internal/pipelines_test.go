@@ -0,0 +1,90 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func newPipelineElastic(t *testing.T) (*ElasticService, *fakeElastic) {
+	fake := &fakeElastic{responses: map[string]string{
+		"POST /products/_doc":              `{"_id": "1", "result": "created", "_version": 1, "_seq_no": 0, "_primary_term": 1}`,
+		"POST /products/_bulk":             `{"took": 1, "errors": false, "items": [{"index": {"_id": "1", "status": 201, "result": "created"}}]}`,
+		"POST /_ingest/pipeline/normalize": `{"docs": [{"doc": {"_source": {"title": "shoes"}}}]}`,
+	}}
+
+	es := newTestElastic(t, fake)
+	es.pipelines = map[string]PipelineConfig{"normalize": {}}
+
+	return es, fake
+}
+
+func TestPipelinesRejectUndeclared(t *testing.T) {
+	es, fake := newPipelineElastic(t)
+	options := WriteOptions{Pipeline: "drop-everything"}
+	doc := map[string]interface{}{"title": "Shoes"}
+
+	results := map[string]int{
+		"IndexDocument":    es.IndexDocument(context.TODO(), "products", "", doc, options).StatusCode,
+		"BulkIndex":        es.BulkIndex(context.TODO(), "products", "", []map[string]interface{}{doc}, options).StatusCode,
+		"SimulatePipeline": es.SimulatePipeline(context.TODO(), "drop-everything", []interface{}{doc}).StatusCode,
+	}
+
+	for name, status := range results {
+		if status != 400 {
+			t.Errorf("%s with an undeclared pipeline: status %d", name, status)
+		}
+	}
+
+	if len(fake.requests) != 0 {
+		t.Errorf("undeclared pipelines reached Elasticsearch: %v", fake.requests)
+	}
+}
+
+func TestPipelinesAcceptDeclared(t *testing.T) {
+	es, fake := newPipelineElastic(t)
+	options := WriteOptions{Pipeline: "normalize"}
+	doc := map[string]interface{}{"title": "Shoes"}
+
+	if res := es.IndexDocument(context.TODO(), "products", "", doc, options); res.StatusCode != 200 {
+		t.Errorf("IndexDocument: status %d (%v)", res.StatusCode, res.Errors)
+	}
+
+	if res := es.BulkIndex(context.TODO(), "products", "", []map[string]interface{}{doc}, options); res.StatusCode != 200 {
+		t.Errorf("BulkIndex: status %d (%v)", res.StatusCode, res.Errors)
+	}
+
+	for _, route := range []string{"POST /products/_doc", "POST /products/_bulk"} {
+		if !strings.Contains(fake.queries[route], "pipeline=normalize") {
+			t.Errorf("%s was sent without the pipeline: %q", route, fake.queries[route])
+		}
+	}
+
+	res := es.SimulatePipeline(context.TODO(), "normalize", []interface{}{doc})
+	if res.StatusCode != 200 {
+		t.Fatalf("SimulatePipeline: status %d (%v)", res.StatusCode, res.Errors)
+	}
+
+	if body := fake.bodies["POST /_ingest/pipeline/normalize/_simulate"]; !strings.Contains(body, `"_source":{"title":"Shoes"}`) {
+		t.Errorf("simulate body = %s", body)
+	}
+
+	if pipelines := es.Pipelines(); len(pipelines) != 1 || pipelines[0] != "normalize" {
+		t.Errorf("Pipelines() = %v", pipelines)
+	}
+}
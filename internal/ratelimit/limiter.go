@@ -0,0 +1,128 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is how many requests can be made in a period, as a token bucket that
+// is refilled with Requests tokens over Period. The bucket holds Burst tokens,
+// or Requests tokens if Burst is 0.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// PerMinute returns a Limit of the requests per minute.
+func PerMinute(requests int) Limit {
+	return Limit{Requests: requests, Period: time.Minute}
+}
+
+// Decision is the result of taking a token from a bucket.
+type Decision struct {
+	// Allowed is if the request can be made.
+	Allowed bool
+
+	// Limit is the size of the bucket.
+	Limit int
+
+	// Remaining is how many tokens are left in the bucket.
+	Remaining int
+
+	// Reset is when the bucket will be full again.
+	Reset time.Duration
+
+	// RetryAfter is when the next token is available, if the request was not allowed.
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// Limiter is a set of in-memory token buckets, which are keyed by i.e. the
+// credential. Buckets that are full are removed once in a while.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter creates a new Limiter.
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: map[string]*bucket{}, lastSweep: time.Now(), now: time.Now}
+}
+
+// Take takes a token from the bucket of the key, which is refilled with the limit.
+func (l *Limiter) Take(key string, limit Limit) Decision {
+	now := l.now()
+	size := float64(limit.Requests)
+	if limit.Burst > 0 {
+		size = float64(limit.Burst)
+	}
+
+	perToken := limit.Period / time.Duration(limit.Requests)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: size, last: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last)
+	b.tokens = math.Min(size, b.tokens+elapsed.Seconds()/perToken.Seconds())
+	b.last = now
+
+	decision := Decision{Limit: int(size)}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+
+	decision.Remaining = int(b.tokens)
+	decision.Reset = time.Duration((size - b.tokens) * float64(perToken))
+	b.full = now.Add(decision.Reset)
+
+	return decision
+}
+
+// sweep removes the buckets that are full, at most once a minute.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
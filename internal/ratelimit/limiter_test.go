@@ -0,0 +1,118 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when it's advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter() (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2022, 1, 2, 12, 0, 0, 0, time.UTC)}
+	l := NewLimiter()
+	l.now = clock.Now
+	l.lastSweep = clock.now
+
+	return l, clock
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := PerMinute(60)
+
+	for i := 0; i < 60; i++ {
+		if d := l.Take("a", limit); !d.Allowed || d.Remaining != 59-i {
+			t.Fatalf("request %d: %+v", i, d)
+		}
+	}
+
+	d := l.Take("a", limit)
+	if d.Allowed || d.Remaining != 0 || d.RetryAfter != time.Second || d.Reset != time.Minute {
+		t.Fatalf("empty bucket: %+v", d)
+	}
+
+	if d := l.Take("b", limit); !d.Allowed {
+		t.Fatalf("other keys have their own bucket: %+v", d)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if d := l.Take("a", limit); !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("a token should be refilled after a second: %+v", d)
+	}
+
+	clock.Advance(30 * time.Second)
+	if d := l.Take("a", limit); !d.Allowed || d.Remaining != 29 || d.Reset != 30500*time.Millisecond {
+		t.Fatalf("30 tokens should be refilled after 30 seconds: %+v", d)
+	}
+
+	clock.Advance(time.Hour)
+	if d := l.Take("a", limit); !d.Allowed || d.Remaining != 59 {
+		t.Fatalf("bucket shouldn't be refilled past its size: %+v", d)
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l, clock := newTestLimiter()
+	limit := Limit{Requests: 60, Period: time.Minute, Burst: 5}
+
+	for i := 0; i < 5; i++ {
+		if d := l.Take("a", limit); !d.Allowed || d.Limit != 5 {
+			t.Fatalf("request %d: %+v", i, d)
+		}
+	}
+
+	if d := l.Take("a", limit); d.Allowed || d.RetryAfter != time.Second {
+		t.Fatalf("burst should be exhausted: %+v", d)
+	}
+
+	clock.Advance(time.Second)
+	if d := l.Take("a", limit); !d.Allowed {
+		t.Fatalf("tokens are refilled at the rate, not the burst: %+v", d)
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter()
+
+	l.Take("a", PerMinute(60))
+	clock.Advance(30 * time.Second)
+	l.Take("b", PerMinute(1))
+
+	// Bucket a is full again, but b is only full a minute after it was used.
+	clock.Advance(40 * time.Second)
+	l.Take("c", PerMinute(1))
+
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket a wasn't removed")
+	}
+
+	if len(l.buckets) != 2 {
+		t.Errorf("buckets = %v", l.buckets)
+	}
+}
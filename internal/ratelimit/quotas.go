@@ -0,0 +1,74 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Usage is the result of using a daily quota.
+type Usage struct {
+	// Allowed is if the quota was not exceeded.
+	Allowed bool
+
+	// Quota is how many requests can be made in a day.
+	Quota int
+
+	// Remaining is how many requests are left for the day.
+	Remaining int
+
+	// Reset is when the quota is reset, at midnight UTC.
+	Reset time.Duration
+}
+
+// Quotas counts how many requests were made by each key today (in UTC). The
+// counters are kept in memory, so they are reset when Tsubasa restarts.
+type Quotas struct {
+	mu     sync.Mutex
+	day    string
+	counts map[string]int
+	now    func() time.Time
+}
+
+// NewQuotas creates a new Quotas.
+func NewQuotas() *Quotas {
+	return &Quotas{counts: map[string]int{}, now: time.Now}
+}
+
+// Use counts a request by the key, if the key has not exceeded the quota.
+func (q *Quotas) Use(key string, quota int) Usage {
+	now := q.now().UTC()
+	day := now.Format("2006-01-02")
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.day != day {
+		q.day = day
+		q.counts = map[string]int{}
+	}
+
+	usage := Usage{Quota: quota, Reset: midnight.Sub(now)}
+	if q.counts[key] < quota {
+		q.counts[key]++
+		usage.Allowed = true
+	}
+
+	usage.Remaining = quota - q.counts[key]
+	return usage
+}
@@ -0,0 +1,48 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotasResetAtMidnight(t *testing.T) {
+	// The quota is kept per day in UTC, no matter the local time zone.
+	clock := &fakeClock{now: time.Date(2022, 1, 2, 23, 59, 0, 0, time.UTC).In(time.FixedZone("UTC+2", 2*60*60))}
+	q := NewQuotas()
+	q.now = clock.Now
+
+	for i := 0; i < 2; i++ {
+		if u := q.Use("a", 2); !u.Allowed || u.Remaining != 1-i || u.Reset != time.Minute {
+			t.Fatalf("request %d: %+v", i, u)
+		}
+	}
+
+	if u := q.Use("a", 2); u.Allowed || u.Remaining != 0 {
+		t.Fatalf("quota should be exceeded: %+v", u)
+	}
+
+	if u := q.Use("b", 2); !u.Allowed {
+		t.Fatalf("other keys have their own quota: %+v", u)
+	}
+
+	clock.Advance(2 * time.Minute)
+	u := q.Use("a", 2)
+	if !u.Allowed || u.Remaining != 1 || u.Reset != 24*time.Hour-time.Minute {
+		t.Fatalf("quota should be reset the next day: %+v", u)
+	}
+}
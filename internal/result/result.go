@@ -32,6 +32,10 @@ type Result struct {
 	// This is usually used in the result.Err() or result.Errs()
 	// function fields.
 	Errors []Error `json:"errors,omitempty"`
+
+	// RequestID is the `X-Request-Id` of the request that failed, so errors can be
+	// found in the server logs. This is only set on errors.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // Error represents the error that occurred in the resulted action.
@@ -0,0 +1,124 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import "sort"
+
+// Drift represents the difference between an expected mapping and the
+// live mapping of an index.
+type Drift struct {
+	// Added are the fields that are in the live mapping, but not in the expected one.
+	Added []FieldDrift `json:"added"`
+
+	// Missing are the fields that are in the expected mapping, but not in the live one.
+	Missing []FieldDrift `json:"missing"`
+
+	// Conflicts are the fields that are in both mappings with different types.
+	Conflicts []FieldDrift `json:"conflicts"`
+}
+
+// FieldDrift is a single field that has drifted.
+type FieldDrift struct {
+	// Path is the dotted path to the field, i.e. `variants.color`.
+	Path string `json:"path"`
+
+	// Expected is the type that was expected, empty if the field was added.
+	Expected string `json:"expected,omitempty"`
+
+	// Actual is the type in the live mapping, empty if the field is missing.
+	Actual string `json:"actual,omitempty"`
+}
+
+// HasDrifted returns if any field has drifted.
+func (d Drift) HasDrifted() bool {
+	return len(d.Added) > 0 || len(d.Missing) > 0 || len(d.Conflicts) > 0
+}
+
+// Flatten flattens an Elasticsearch mapping (the object that holds `properties`)
+// into a map of the dotted field paths to their types. Multi-fields are ignored
+// since they are not part of a declared schema.
+func Flatten(mapping map[string]interface{}) map[string]string {
+	fields := map[string]string{}
+	flatten(fields, "", mapping)
+
+	return fields
+}
+
+func flatten(fields map[string]string, prefix string, mapping map[string]interface{}) {
+	props, ok := mapping["properties"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	for name, raw := range props {
+		field, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		t, ok := field["type"].(string)
+		if !ok {
+			t = "object"
+		}
+
+		fields[path] = t
+		flatten(fields, path, field)
+	}
+}
+
+// Diff compares the expected flattened mapping to the actual one.
+func Diff(expected map[string]string, actual map[string]string) Drift {
+	drift := Drift{
+		Added:     []FieldDrift{},
+		Missing:   []FieldDrift{},
+		Conflicts: []FieldDrift{},
+	}
+
+	for path, t := range actual {
+		e, ok := expected[path]
+		if !ok {
+			drift.Added = append(drift.Added, FieldDrift{Path: path, Actual: t})
+			continue
+		}
+
+		if e != t {
+			drift.Conflicts = append(drift.Conflicts, FieldDrift{Path: path, Expected: e, Actual: t})
+		}
+	}
+
+	for path, t := range expected {
+		if _, ok := actual[path]; !ok {
+			drift.Missing = append(drift.Missing, FieldDrift{Path: path, Expected: t})
+		}
+	}
+
+	sortDrift(drift.Added)
+	sortDrift(drift.Missing)
+	sortDrift(drift.Conflicts)
+
+	return drift
+}
+
+func sortDrift(fields []FieldDrift) {
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Path < fields[j].Path
+	})
+}
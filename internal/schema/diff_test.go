@@ -0,0 +1,125 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	mapping := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"title": map[string]interface{}{
+				"type":   "text",
+				"fields": map[string]interface{}{"raw": map[string]interface{}{"type": "keyword"}},
+			},
+			"author": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"name": map[string]interface{}{"type": "keyword"},
+				},
+			},
+			"variants": map[string]interface{}{
+				"type": "nested",
+				"properties": map[string]interface{}{
+					"color": map[string]interface{}{"type": "keyword"},
+				},
+			},
+		},
+	}
+
+	want := map[string]string{
+		"title":          "text",
+		"author":         "object",
+		"author.name":    "keyword",
+		"variants":       "nested",
+		"variants.color": "keyword",
+	}
+
+	if fields := Flatten(mapping); !reflect.DeepEqual(fields, want) {
+		t.Errorf("Flatten() = %v", fields)
+	}
+
+	if fields := Flatten(map[string]interface{}{}); len(fields) != 0 {
+		t.Errorf("Flatten() of an empty mapping = %v", fields)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected map[string]string
+		actual   map[string]string
+		drift    Drift
+	}{
+		{
+			name:     "same mapping",
+			expected: map[string]string{"title": "text", "price": "double"},
+			actual:   map[string]string{"title": "text", "price": "double"},
+			drift:    Drift{Added: []FieldDrift{}, Missing: []FieldDrift{}, Conflicts: []FieldDrift{}},
+		},
+		{
+			name:     "added fields",
+			expected: map[string]string{"title": "text"},
+			actual:   map[string]string{"title": "text", "tags": "keyword", "author.name": "keyword"},
+			drift: Drift{
+				Added:     []FieldDrift{{Path: "author.name", Actual: "keyword"}, {Path: "tags", Actual: "keyword"}},
+				Missing:   []FieldDrift{},
+				Conflicts: []FieldDrift{},
+			},
+		},
+		{
+			name:     "missing and conflicting fields",
+			expected: map[string]string{"title": "text", "price": "double", "sku": "keyword"},
+			actual:   map[string]string{"title": "keyword", "price": "double"},
+			drift: Drift{
+				Added:     []FieldDrift{},
+				Missing:   []FieldDrift{{Path: "sku", Expected: "keyword"}},
+				Conflicts: []FieldDrift{{Path: "title", Expected: "text", Actual: "keyword"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drift := Diff(test.expected, test.actual)
+			if !reflect.DeepEqual(drift, test.drift) {
+				t.Errorf("Diff() = %+v, want %+v", drift, test.drift)
+			}
+
+			if drift.HasDrifted() != (test.name != "same mapping") {
+				t.Errorf("HasDrifted() = %v", drift.HasDrifted())
+			}
+		})
+	}
+}
+
+func TestIndexMappingRoundTrip(t *testing.T) {
+	index := Index{Fields: map[string]Field{
+		"title":    {Type: "text"},
+		"at":       {Type: "date", Format: "yyyy-MM-dd HH:mm:ss"},
+		"variants": {Type: "nested", Properties: map[string]Field{"color": {Type: "keyword"}}},
+	}}
+
+	want := map[string]string{"title": "text", "at": "date", "variants": "nested", "variants.color": "keyword"}
+	if fields := Flatten(index.Mapping()); !reflect.DeepEqual(fields, want) {
+		t.Errorf("Flatten(Mapping()) = %v", fields)
+	}
+
+	if drift := Diff(Flatten(index.Mapping()), want); drift.HasDrifted() {
+		t.Errorf("declared mapping drifted from itself: %+v", drift)
+	}
+}
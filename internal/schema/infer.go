@@ -0,0 +1,328 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDistinctValues is the maximum amount of distinct string values to keep
+// track of per field when computing the cardinality.
+const maxDistinctValues = 10000
+
+// maxKeywordLength is the length where a string is considered free text,
+// no matter what the cardinality is.
+const maxKeywordLength = 256
+
+// dateLayouts maps the Go layouts we detect dates with to the Elasticsearch
+// date format, an empty format means it is handled by Elasticsearch's
+// default `strict_date_optional_time` format.
+var dateLayouts = []struct {
+	layout string
+	format string
+}{
+	{time.RFC3339Nano, ""},
+	{"2006-01-02T15:04:05", ""},
+	{"2006-01-02", ""},
+	{"2006-01-02 15:04:05", "yyyy-MM-dd HH:mm:ss"},
+}
+
+var geoPointRegex = regexp.MustCompile(`^\s*-?\d{1,2}(\.\d+)?\s*,\s*-?\d{1,3}(\.\d+)?\s*$`)
+
+// InferOptions are the options for Infer.
+type InferOptions struct {
+	// SampleSize is the maximum amount of documents to sample, zero
+	// means every document is sampled.
+	SampleSize int
+
+	// KeywordRatio is the maximum ratio of distinct values to total values
+	// a string field can have to be considered a `keyword` rather than `text`.
+	KeywordRatio float64
+}
+
+// Infer reads newline-delimited JSON documents from the reader and proposes
+// an Index schema from them. It returns the proposed schema and the amount
+// of documents that were sampled.
+func Infer(r io.Reader, options InferOptions) (*Index, int, error) {
+	if options.KeywordRatio <= 0 {
+		options.KeywordRatio = 0.5
+	}
+
+	root := newFieldStats()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	line := 0
+	sampled := 0
+	for scanner.Scan() {
+		line++
+		if options.SampleSize > 0 && sampled >= options.SampleSize {
+			break
+		}
+
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		var doc map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, sampled, fmt.Errorf("line %d is not a JSON object: %v", line, err)
+		}
+
+		root.observeObject(doc, false)
+		sampled++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, sampled, err
+	}
+
+	if sampled == 0 {
+		return nil, 0, fmt.Errorf("no documents were found to sample")
+	}
+
+	return &Index{Fields: root.resolveChildren(options)}, sampled, nil
+}
+
+type fieldStats struct {
+	values     int
+	strings    int
+	integers   int
+	floats     int
+	booleans   int
+	geoPoints  int
+	objects    int
+	nested     bool
+	whitespace bool
+	long       bool
+	dates      map[string]int
+	distinct   map[string]struct{}
+	children   map[string]*fieldStats
+}
+
+func newFieldStats() *fieldStats {
+	return &fieldStats{
+		dates:    map[string]int{},
+		distinct: map[string]struct{}{},
+		children: map[string]*fieldStats{},
+	}
+}
+
+func (s *fieldStats) child(name string) *fieldStats {
+	c, ok := s.children[name]
+	if !ok {
+		c = newFieldStats()
+		s.children[name] = c
+	}
+
+	return c
+}
+
+func (s *fieldStats) observeObject(object map[string]interface{}, inArray bool) {
+	s.objects++
+	if inArray {
+		s.nested = true
+	}
+
+	for key, value := range object {
+		s.child(key).observe(value, false)
+	}
+}
+
+func (s *fieldStats) observe(value interface{}, inArray bool) {
+	switch v := value.(type) {
+	case nil:
+		return
+
+	case bool:
+		s.values++
+		s.booleans++
+
+	case json.Number:
+		s.values++
+		if _, err := v.Int64(); err == nil {
+			s.integers++
+		} else {
+			s.floats++
+		}
+
+	case string:
+		s.values++
+		s.observeString(v)
+
+	case map[string]interface{}:
+		if isGeoPoint(v) {
+			s.values++
+			s.geoPoints++
+			return
+		}
+
+		s.observeObject(v, inArray)
+
+	case []interface{}:
+		// Elasticsearch has no array type, every field can hold multiple values,
+		// so we only need to look at what the elements are.
+		for _, element := range v {
+			s.observe(element, true)
+		}
+	}
+}
+
+func (s *fieldStats) observeString(value string) {
+	s.strings++
+	if geoPointRegex.MatchString(value) {
+		s.geoPoints++
+	}
+
+	for _, l := range dateLayouts {
+		if _, err := time.Parse(l.layout, value); err == nil {
+			s.dates[l.format]++
+			break
+		}
+	}
+
+	if strings.ContainsAny(value, " \t\n") {
+		s.whitespace = true
+	}
+
+	if len(value) > maxKeywordLength {
+		s.long = true
+	}
+
+	if len(s.distinct) < maxDistinctValues {
+		s.distinct[value] = struct{}{}
+	}
+}
+
+func (s *fieldStats) resolveChildren(options InferOptions) map[string]Field {
+	fields := make(map[string]Field, len(s.children))
+	for name, child := range s.children {
+		if field, ok := child.resolve(options); ok {
+			fields[name] = field
+		}
+	}
+
+	return fields
+}
+
+func (s *fieldStats) resolve(options InferOptions) (Field, bool) {
+	if s.objects > 0 {
+		t := "object"
+		if s.nested {
+			t = "nested"
+		}
+
+		return Field{Type: t, Properties: s.resolveChildren(options)}, true
+	}
+
+	if s.values == 0 {
+		// Only `null` values were seen, so we can't tell what it is.
+		return Field{}, false
+	}
+
+	if s.geoPoints == s.values {
+		return Field{Type: "geo_point"}, true
+	}
+
+	if s.strings > 0 {
+		// Mixed scalar types can only be represented as keywords.
+		if s.strings != s.values {
+			return Field{Type: "keyword"}, true
+		}
+
+		if total := sumDates(s.dates); total == s.strings {
+			return Field{Type: "date", Format: dateFormat(s.dates)}, true
+		}
+
+		ratio := float64(len(s.distinct)) / float64(s.strings)
+		if s.long || (s.whitespace && ratio > options.KeywordRatio) {
+			return Field{Type: "text"}, true
+		}
+
+		return Field{Type: "keyword"}, true
+	}
+
+	if s.booleans > 0 {
+		if s.booleans != s.values {
+			return Field{Type: "keyword"}, true
+		}
+
+		return Field{Type: "boolean"}, true
+	}
+
+	if s.floats > 0 {
+		return Field{Type: "double"}, true
+	}
+
+	return Field{Type: "long"}, true
+}
+
+func isGeoPoint(object map[string]interface{}) bool {
+	if len(object) != 2 {
+		return false
+	}
+
+	_, hasLat := object["lat"].(json.Number)
+	_, hasLon := object["lon"].(json.Number)
+
+	return hasLat && hasLon
+}
+
+func sumDates(dates map[string]int) int {
+	total := 0
+	for _, count := range dates {
+		total += count
+	}
+
+	return total
+}
+
+func dateFormat(dates map[string]int) string {
+	formats := make([]string, 0, len(dates))
+	custom := false
+
+	for format := range dates {
+		if format == "" {
+			continue
+		}
+
+		custom = true
+		formats = append(formats, format)
+	}
+
+	if !custom {
+		return ""
+	}
+
+	sort.Strings(formats)
+	if _, ok := dates[""]; ok {
+		formats = append(formats, "strict_date_optional_time")
+	}
+
+	return strings.Join(formats, "||")
+}
@@ -0,0 +1,132 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInfer(t *testing.T) {
+	tests := []struct {
+		name   string
+		docs   string
+		fields map[string]Field
+	}{
+		{
+			name:   "numbers",
+			docs:   `{"count": 1, "price": 1}` + "\n" + `{"count": 2, "price": 2.5}`,
+			fields: map[string]Field{"count": {Type: "long"}, "price": {Type: "double"}},
+		},
+		{
+			name:   "booleans",
+			docs:   `{"active": true, "mixed": true}` + "\n" + `{"active": false, "mixed": "yes"}`,
+			fields: map[string]Field{"active": {Type: "boolean"}, "mixed": {Type: "keyword"}},
+		},
+		{
+			name:   "default date format",
+			docs:   `{"at": "2022-01-02T15:04:05Z"}` + "\n" + `{"at": "2022-01-03"}`,
+			fields: map[string]Field{"at": {Type: "date"}},
+		},
+		{
+			name:   "custom date format",
+			docs:   `{"at": "2022-01-02 15:04:05"}`,
+			fields: map[string]Field{"at": {Type: "date", Format: "yyyy-MM-dd HH:mm:ss"}},
+		},
+		{
+			name:   "mixed date formats",
+			docs:   `{"at": "2022-01-02 15:04:05"}` + "\n" + `{"at": "2022-01-02"}`,
+			fields: map[string]Field{"at": {Type: "date", Format: "yyyy-MM-dd HH:mm:ss||strict_date_optional_time"}},
+		},
+		{
+			name:   "dates mixed with other strings",
+			docs:   `{"at": "2022-01-02"}` + "\n" + `{"at": "tomorrow"}`,
+			fields: map[string]Field{"at": {Type: "keyword"}},
+		},
+		{
+			name: "keyword and text",
+			docs: strings.Join([]string{
+				`{"color": "dark red", "title": "red running shoes"}`,
+				`{"color": "dark red", "title": "blue suede shoes"}`,
+				`{"color": "dark red", "title": "green rain boots"}`,
+				`{"color": "blue", "title": "black leather boots"}`,
+			}, "\n"),
+			fields: map[string]Field{"color": {Type: "keyword"}, "title": {Type: "text"}},
+		},
+		{
+			name:   "long strings are text",
+			docs:   `{"body": "` + strings.Repeat("a", maxKeywordLength+1) + `"}` + "\n" + `{"body": "a"}`,
+			fields: map[string]Field{"body": {Type: "text"}},
+		},
+		{
+			name:   "geo points",
+			docs:   `{"location": {"lat": 41.12, "lon": -71.34}, "origin": "41.12,-71.34"}`,
+			fields: map[string]Field{"location": {Type: "geo_point"}, "origin": {Type: "geo_point"}},
+		},
+		{
+			name: "objects and nested objects",
+			docs: `{"author": {"name": "noel", "age": 20}, "tags": [{"name": "a"}, {"name": "b"}]}`,
+			fields: map[string]Field{
+				"author": {Type: "object", Properties: map[string]Field{"name": {Type: "keyword"}, "age": {Type: "long"}}},
+				"tags":   {Type: "nested", Properties: map[string]Field{"name": {Type: "keyword"}}},
+			},
+		},
+		{
+			name:   "arrays of scalars",
+			docs:   `{"scores": [1, 2, 3]}`,
+			fields: map[string]Field{"scores": {Type: "long"}},
+		},
+		{
+			name:   "null fields are skipped",
+			docs:   `{"title": "a", "missing": null}` + "\n\n" + `{"title": "b", "missing": null}`,
+			fields: map[string]Field{"title": {Type: "keyword"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index, _, err := Infer(strings.NewReader(test.docs), InferOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(index.Fields, test.fields) {
+				t.Errorf("Infer() = %+v, want %+v", index.Fields, test.fields)
+			}
+		})
+	}
+}
+
+func TestInferSampleSize(t *testing.T) {
+	docs := `{"a": 1}` + "\n" + `{"a": 2}` + "\n" + `{"a": "three"}`
+	index, sampled, err := Infer(strings.NewReader(docs), InferOptions{SampleSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sampled != 2 || index.Fields["a"].Type != "long" {
+		t.Errorf("Infer() sampled %d documents, a = %+v", sampled, index.Fields["a"])
+	}
+}
+
+func TestInferErrors(t *testing.T) {
+	for _, docs := range []string{"", "\n\n", `{"a": 1}` + "\n" + `[1, 2]`, `{"a": `} {
+		if _, _, err := Infer(strings.NewReader(docs), InferOptions{}); err == nil {
+			t.Errorf("Infer(%q) didn't fail", docs)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Index represents a declared index schema in the `[elastic.schemas.<index>]`
+// table of the configuration file.
+type Index struct {
+	// Fields is the list of fields (keyed by the field name) that
+	// this index has.
+	Fields map[string]Field `toml:"fields"`
+
+	// JSONSchema is the path to a JSON Schema file that every document written to
+	// this index is validated against before it is indexed.
+	JSONSchema *string `toml:"json_schema,omitempty"`
+
+	// DeadLetterIndex is the index that documents failing JSON Schema validation are
+	// quarantined in, rather than being rejected. The original document and the
+	// validation errors are kept so they can be inspected and replayed later.
+	DeadLetterIndex *string `toml:"dead_letter_index,omitempty"`
+}
+
+// Field represents a single field in an Index. Objects and nested arrays
+// of objects define their children with the Properties field.
+type Field struct {
+	// Type is the Elasticsearch field type, i.e. `keyword`, `text`, `date`...
+	Type string `toml:"type"`
+
+	// Format is the date format to use, this is only used if Type is `date`.
+	Format string `toml:"format,omitempty"`
+
+	// Properties are the child fields of an `object` or `nested` field.
+	Properties map[string]Field `toml:"properties,omitempty"`
+}
+
+// HasFields returns if this Index has declared any fields. Indexes can be declared
+// for their JSON Schema only, so they shouldn't be treated as a declared mapping.
+func (i Index) HasFields() bool {
+	return len(i.Fields) > 0
+}
+
+// Mapping returns the Elasticsearch mapping body for this Index.
+func (i Index) Mapping() map[string]interface{} {
+	return map[string]interface{}{
+		"properties": properties(i.Fields),
+	}
+}
+
+// Mapping returns the Elasticsearch mapping for this Field.
+func (f Field) Mapping() map[string]interface{} {
+	mapping := map[string]interface{}{}
+
+	// `object` is the default type for fields with properties, so
+	// Elasticsearch doesn't require it to be specified.
+	if f.Type != "" && !(f.Type == "object" && len(f.Properties) > 0) {
+		mapping["type"] = f.Type
+	}
+
+	if f.Format != "" {
+		mapping["format"] = f.Format
+	}
+
+	if len(f.Properties) > 0 {
+		mapping["properties"] = properties(f.Properties)
+	}
+
+	return mapping
+}
+
+func properties(fields map[string]Field) map[string]interface{} {
+	props := make(map[string]interface{}, len(fields))
+	for name, field := range fields {
+		props[name] = field.Mapping()
+	}
+
+	return props
+}
+
+// Encode renders the Index as the `[elastic.schemas.<name>]` table of the
+// configuration file. Fields without properties are rendered as inline tables
+// to keep the output readable.
+func (i Index) Encode(name string) string {
+	b := &strings.Builder{}
+	encodeTable(b, "elastic.schemas."+tomlKey(name)+".fields", i.Fields)
+
+	return b.String()
+}
+
+func encodeTable(b *strings.Builder, path string, fields map[string]Field) {
+	names := sortedNames(fields)
+
+	fmt.Fprintf(b, "[%s]\n", path)
+	for _, name := range names {
+		field := fields[name]
+		if len(field.Properties) > 0 {
+			continue
+		}
+
+		fmt.Fprintf(b, "%s = { type = %s", tomlKey(name), strconv.Quote(field.Type))
+		if field.Format != "" {
+			fmt.Fprintf(b, ", format = %s", strconv.Quote(field.Format))
+		}
+
+		b.WriteString(" }\n")
+	}
+
+	for _, name := range names {
+		field := fields[name]
+		if len(field.Properties) == 0 {
+			continue
+		}
+
+		fieldPath := path + "." + tomlKey(name)
+		fmt.Fprintf(b, "\n[%s]\ntype = %s\n\n", fieldPath, strconv.Quote(field.Type))
+		encodeTable(b, fieldPath+".properties", field.Properties)
+	}
+}
+
+func sortedNames(fields map[string]Field) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+var bareKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKey(key string) string {
+	if bareKeyRegex.MatchString(key) {
+		return key
+	}
+
+	return strconv.Quote(key)
+}
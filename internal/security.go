@@ -0,0 +1,459 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"floofy.dev/tsubasa/internal/auth"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unfilterableKeys are the top-level search keys that can read documents (or their
+// terms) outside the query, so they can't be used when a filter is mandatory.
+var unfilterableKeys = []string{"knn", "suggest"}
+
+// searchFields returns the fields that the principal in the context can see on the index.
+func searchFields(ctx context.Context, index string) auth.FieldFilter {
+	principal := auth.PrincipalFromContext(ctx)
+	if principal == nil {
+		return nil
+	}
+
+	return principal.Fields(auth.ActionSearch, index)
+}
+
+// searchFilters returns the queries that searches by the principal in the context
+// on the index must be filtered with.
+func searchFilters(ctx context.Context, index string) []map[string]interface{} {
+	principal := auth.PrincipalFromContext(ctx)
+	if principal == nil {
+		return nil
+	}
+
+	return principal.QueryFilters(auth.ActionSearch, index)
+}
+
+// writeFilters returns the queries that documents written by the principal in the
+// context into the index must match.
+func writeFilters(ctx context.Context, index string) []map[string]interface{} {
+	principal := auth.PrincipalFromContext(ctx)
+	if principal == nil {
+		return nil
+	}
+
+	return principal.QueryFilters(auth.ActionWrite, index)
+}
+
+// applyFilters returns a copy of the search body where the query is wrapped in a
+// `bool` query with the filters as non-scoring `filter` clauses. Aggregations run
+// on the documents that match the query, so they are filtered too, except `global`
+// aggregations which are rejected.
+func applyFilters(body map[string]interface{}, filters []map[string]interface{}) (map[string]interface{}, error) {
+	if len(filters) == 0 {
+		return body, nil
+	}
+
+	for _, key := range unfilterableKeys {
+		if _, ok := body[key]; ok {
+			return nil, fmt.Errorf("'%s' can't be used on filtered indexes", key)
+		}
+	}
+
+	for _, key := range []string{"aggs", "aggregations"} {
+		if hasGlobalAggregation(body[key]) {
+			return nil, fmt.Errorf("'global' aggregations can't be used on filtered indexes")
+		}
+	}
+
+	if key := findUnfilterable(body); key != "" {
+		return nil, fmt.Errorf("'%s' can't be used on filtered indexes", key)
+	}
+
+	query, ok := body["query"]
+	if !ok {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+
+	clauses := make([]interface{}, 0, len(filters))
+	for _, filter := range filters {
+		clauses = append(clauses, filter)
+	}
+
+	filtered := make(map[string]interface{}, len(body)+1)
+	for key, value := range body {
+		filtered[key] = value
+	}
+
+	filtered["query"] = map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":   []interface{}{query},
+			"filter": clauses,
+		},
+	}
+
+	return filtered, nil
+}
+
+func hasGlobalAggregation(value interface{}) bool {
+	aggs, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	for _, agg := range aggs {
+		definition, ok := agg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if _, ok := definition["global"]; ok {
+			return true
+		}
+
+		if hasGlobalAggregation(definition["aggs"]) || hasGlobalAggregation(definition["aggregations"]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findUnfilterable returns the name of the first query or aggregation in the value
+// that reads documents the filters don't apply to, which are lookups that fetch
+// another document (`terms` lookups, `indexed_shape` of shape queries, `percolate`
+// with an `id` and `more_like_this` with `_id` or `_index` documents) and the
+// `background_filter` of significant terms aggregations.
+func findUnfilterable(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			if key := findUnfilterable(element); key != "" {
+				return key
+			}
+		}
+
+	case map[string]interface{}:
+		for key, inner := range v {
+			switch key {
+			case "terms":
+				if body, ok := inner.(map[string]interface{}); ok {
+					for _, terms := range body {
+						if lookup, ok := terms.(map[string]interface{}); ok && hasAnyKey(lookup, "index", "id") {
+							return "terms lookup"
+						}
+					}
+				}
+
+			case "geo_shape", "shape":
+				if body, ok := inner.(map[string]interface{}); ok {
+					for _, shape := range body {
+						if params, ok := shape.(map[string]interface{}); ok {
+							if _, ok := params["indexed_shape"]; ok {
+								return key + ".indexed_shape"
+							}
+						}
+					}
+				}
+
+			case "percolate":
+				if body, ok := inner.(map[string]interface{}); ok {
+					if hasAnyKey(body, "index", "id") {
+						return "percolate lookup"
+					}
+				}
+
+			case "more_like_this":
+				if body, ok := inner.(map[string]interface{}); ok {
+					if referencesDocument(body["like"]) || referencesDocument(body["unlike"]) {
+						return "more_like_this document"
+					}
+				}
+
+			case "significant_terms", "significant_text":
+				if body, ok := inner.(map[string]interface{}); ok {
+					if _, ok := body["background_filter"]; ok {
+						return key + ".background_filter"
+					}
+				}
+			}
+
+			if found := findUnfilterable(inner); found != "" {
+				return found
+			}
+		}
+	}
+
+	return ""
+}
+
+// referencesDocument returns if the `like` or `unlike` of a `more_like_this` query
+// references a stored document, rather than text or an artificial document.
+func referencesDocument(value interface{}) bool {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, element := range v {
+			if referencesDocument(element) {
+				return true
+			}
+		}
+
+	case map[string]interface{}:
+		return hasAnyKey(v, "_id", "_index")
+	}
+
+	return false
+}
+
+func hasAnyKey(m map[string]interface{}, keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := m[key]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errUnsupportedWriteFilter is returned when a filter can't be checked against a
+// document before it is written.
+var errUnsupportedWriteFilter = errors.New("only `term`, `terms`, `bool` and `match_all` filters can be enforced on writes")
+
+// documentMatches returns if the document matches the filter, which is evaluated
+// locally so documents can be checked before they are written. Only exact queries
+// are supported, since analyzed queries depend on the mapping.
+func documentMatches(doc map[string]interface{}, filter map[string]interface{}) (bool, error) {
+	if len(filter) != 1 {
+		return false, errUnsupportedWriteFilter
+	}
+
+	for kind, body := range filter {
+		params, ok := body.(map[string]interface{})
+		if !ok {
+			return false, errUnsupportedWriteFilter
+		}
+
+		switch kind {
+		case "match_all":
+			return true, nil
+
+		case "term":
+			field, value, err := singleField(params)
+			if err != nil {
+				return false, err
+			}
+
+			if m, ok := value.(map[string]interface{}); ok {
+				value = m["value"]
+			}
+
+			return fieldHasAny(doc, field, []interface{}{value}), nil
+
+		case "terms":
+			field, value, err := singleField(params)
+			if err != nil {
+				return false, err
+			}
+
+			values, ok := value.([]interface{})
+			if !ok {
+				return false, errUnsupportedWriteFilter
+			}
+
+			return fieldHasAny(doc, field, values), nil
+
+		case "bool":
+			return boolMatches(doc, params)
+		}
+	}
+
+	return false, errUnsupportedWriteFilter
+}
+
+func boolMatches(doc map[string]interface{}, params map[string]interface{}) (bool, error) {
+	required := 0
+	for key, value := range params {
+		clauses, err := boolClauses(value)
+		if err != nil {
+			return false, err
+		}
+
+		switch key {
+		case "must", "filter":
+			required++
+			for _, clause := range clauses {
+				if ok, err := documentMatches(doc, clause); err != nil || !ok {
+					return false, err
+				}
+			}
+
+		case "must_not":
+			for _, clause := range clauses {
+				if ok, err := documentMatches(doc, clause); err != nil || ok {
+					return false, err
+				}
+			}
+
+		case "should", "minimum_should_match", "boost", "_name":
+
+		default:
+			return false, errUnsupportedWriteFilter
+		}
+	}
+
+	should, err := boolClauses(params["should"])
+	if err != nil || len(should) == 0 {
+		return err == nil, err
+	}
+
+	// Like Elasticsearch, one `should` clause must match if there are no required
+	// clauses, or if `minimum_should_match` says so.
+	minimum := 0
+	if required == 0 {
+		minimum = 1
+	}
+
+	switch m := params["minimum_should_match"].(type) {
+	case nil:
+	case float64:
+		minimum = int(m)
+	case int64:
+		minimum = int(m)
+	default:
+		return false, errUnsupportedWriteFilter
+	}
+
+	matched := 0
+	for _, clause := range should {
+		ok, err := documentMatches(doc, clause)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			matched++
+		}
+	}
+
+	return matched >= minimum, nil
+}
+
+// boolClauses returns the clauses of a `bool` query key, which is either a query
+// or an array of queries.
+func boolClauses(value interface{}) ([]map[string]interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+
+	case map[string]interface{}:
+		return []map[string]interface{}{v}, nil
+
+	case []interface{}:
+		clauses := make([]map[string]interface{}, 0, len(v))
+		for _, element := range v {
+			clause, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, errUnsupportedWriteFilter
+			}
+
+			clauses = append(clauses, clause)
+		}
+
+		return clauses, nil
+
+	case []map[string]interface{}:
+		return v, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// singleField returns the field and value of a `term` or `terms` query, ignoring
+// its options.
+func singleField(params map[string]interface{}) (string, interface{}, error) {
+	field, value := "", interface{}(nil)
+	for key, inner := range params {
+		if key == "boost" || key == "_name" {
+			continue
+		}
+
+		if field != "" {
+			return "", nil, errUnsupportedWriteFilter
+		}
+
+		field, value = key, inner
+	}
+
+	if field == "" {
+		return "", nil, errUnsupportedWriteFilter
+	}
+
+	return field, value, nil
+}
+
+// fieldHasAny returns if the dotted field of the document has any of the values.
+// Arrays match if any of their elements match, like in Elasticsearch.
+func fieldHasAny(doc map[string]interface{}, field string, values []interface{}) bool {
+	var current interface{} = doc
+	for _, part := range strings.Split(field, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		current, ok = object[part]
+		if !ok {
+			return false
+		}
+	}
+
+	actual := []interface{}{current}
+	if array, ok := current.([]interface{}); ok {
+		actual = array
+	}
+
+	for _, a := range actual {
+		// Nulls aren't indexed, so they never match a term.
+		if a == nil {
+			continue
+		}
+
+		for _, v := range values {
+			if normalizeTerm(a) == normalizeTerm(v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalizeTerm formats a term so numbers from JSON and TOML compare equal.
+func normalizeTerm(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
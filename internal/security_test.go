@@ -0,0 +1,167 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeJson(t *testing.T, value string) map[string]interface{} {
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestApplyFilters(t *testing.T) {
+	filters := []map[string]interface{}{{"term": map[string]interface{}{"tenant": "a"}}}
+
+	filtered, err := applyFilters(decodeJson(t, `{"query": {"match": {"title": "shoes"}}, "size": 5}`), filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := decodeJson(t, `{
+		"query": {"bool": {"must": [{"match": {"title": "shoes"}}], "filter": [{"term": {"tenant": "a"}}]}},
+		"size": 5
+	}`)
+
+	if encoded, _ := json.Marshal(filtered); string(encoded) != mustEncode(t, want) {
+		t.Errorf("applyFilters() = %s", encoded)
+	}
+
+	filtered, err = applyFilters(decodeJson(t, `{}`), filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	must := filtered["query"].(map[string]interface{})["bool"].(map[string]interface{})["must"].([]interface{})
+	if !reflect.DeepEqual(must[0], map[string]interface{}{"match_all": map[string]interface{}{}}) {
+		t.Errorf("body without a query should match all, got %v", must)
+	}
+
+	body := decodeJson(t, `{"knn": {}}`)
+	if unfiltered, err := applyFilters(body, nil); err != nil || !reflect.DeepEqual(unfiltered, body) {
+		t.Errorf("body without filters was changed to %v (%v)", unfiltered, err)
+	}
+}
+
+func mustEncode(t *testing.T, value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(encoded)
+}
+
+func TestApplyFiltersRejected(t *testing.T) {
+	filters := []map[string]interface{}{{"term": map[string]interface{}{"tenant": "a"}}}
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"knn", `{"knn": {"field": "vector"}}`, "'knn'"},
+		{"suggest", `{"suggest": {"s": {"text": "x", "term": {"field": "title"}}}}`, "'suggest'"},
+		{"global aggregation", `{"aggs": {"all": {"global": {}}}}`, "'global'"},
+		{"nested global aggregation", `{"aggs": {"a": {"terms": {"field": "x"}, "aggs": {"all": {"global": {}}}}}}`, "'global'"},
+		{"terms lookup", `{"query": {"terms": {"tenant": {"index": "products", "id": "1", "path": "tenant"}}}}`, "terms lookup"},
+		{"nested terms lookup", `{"query": {"bool": {"should": [{"terms": {"tenant": {"id": "1", "path": "tenant"}}}]}}}`, "terms lookup"},
+		{"significant terms background", `{"aggs": {"s": {"significant_terms": {"field": "tag", "background_filter": {"match_all": {}}}}}}`, "significant_terms.background_filter"},
+		{"indexed shape", `{"query": {"geo_shape": {"area": {"indexed_shape": {"index": "shapes", "id": "1"}}}}}`, "geo_shape.indexed_shape"},
+		{"indexed shape of shape", `{"query": {"bool": {"filter": {"shape": {"area": {"indexed_shape": {"id": "1"}}}}}}}`, "shape.indexed_shape"},
+		{"percolate lookup", `{"query": {"percolate": {"field": "query", "index": "products", "id": "1"}}}`, "percolate lookup"},
+		{"percolate id", `{"query": {"percolate": {"field": "query", "id": "1"}}}`, "percolate lookup"},
+		{"more_like_this id", `{"query": {"more_like_this": {"fields": ["title"], "like": [{"_id": "1"}]}}}`, "more_like_this document"},
+		{"more_like_this index", `{"query": {"more_like_this": {"like": {"_index": "other", "_id": "1"}}}}`, "more_like_this document"},
+		{"more_like_this unlike", `{"query": {"more_like_this": {"like": "shoes", "unlike": [{"_id": "2"}]}}}`, "more_like_this document"},
+		{"significant text background", `{"aggs": {"s": {"significant_text": {"field": "body", "background_filter": {"match_all": {}}}}}}`, "significant_text.background_filter"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := applyFilters(decodeJson(t, test.body), filters)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("applyFilters() = %v, want error containing %q", err, test.err)
+			}
+		})
+	}
+
+	for _, body := range []string{
+		`{"query": {"terms": {"tenant": ["a", "b"]}}}`,
+		`{"query": {"geo_shape": {"area": {"shape": {"type": "point", "coordinates": [1, 2]}}}}}`,
+		`{"query": {"percolate": {"field": "query", "document": {"title": "shoes"}}}}`,
+		`{"query": {"more_like_this": {"fields": ["title"], "like": ["shoes", {"doc": {"title": "boots"}}]}}}`,
+	} {
+		if _, err := applyFilters(decodeJson(t, body), filters); err != nil {
+			t.Errorf("%s was rejected: %v", body, err)
+		}
+	}
+}
+
+func TestDocumentMatches(t *testing.T) {
+	doc := decodeJson(t, `{"tenant": "a", "org": {"id": 42}, "tags": ["x", "y"], "deleted": null}`)
+	tests := []struct {
+		name   string
+		filter string
+		want   bool
+		err    bool
+	}{
+		{"term", `{"term": {"tenant": "a"}}`, true, false},
+		{"term mismatch", `{"term": {"tenant": "b"}}`, false, false},
+		{"term with value", `{"term": {"tenant": {"value": "a"}}}`, true, false},
+		{"nested number", `{"term": {"org.id": 42}}`, true, false},
+		{"number as string", `{"term": {"org.id": "42"}}`, true, false},
+		{"missing field", `{"term": {"owner": "a"}}`, false, false},
+		{"array", `{"term": {"tags": "y"}}`, true, false},
+		{"null", `{"term": {"deleted": null}}`, false, false},
+		{"terms", `{"terms": {"tenant": ["b", "a"]}}`, true, false},
+		{"terms mismatch", `{"terms": {"tenant": ["b", "c"]}}`, false, false},
+		{"match_all", `{"match_all": {}}`, true, false},
+		{"bool filter", `{"bool": {"filter": [{"term": {"tenant": "a"}}, {"term": {"tags": "x"}}]}}`, true, false},
+		{"bool filter mismatch", `{"bool": {"filter": [{"term": {"tenant": "a"}}, {"term": {"tags": "z"}}]}}`, false, false},
+		{"bool should", `{"bool": {"should": [{"term": {"tenant": "b"}}, {"term": {"tenant": "a"}}], "minimum_should_match": 1}}`, true, false},
+		{"bool should mismatch", `{"bool": {"should": [{"term": {"tenant": "b"}}, {"term": {"tenant": "c"}}]}}`, false, false},
+		{"bool must_not", `{"bool": {"must_not": {"term": {"tenant": "a"}}}}`, false, false},
+		{"match", `{"match": {"tenant": "a"}}`, false, true},
+		{"range", `{"bool": {"filter": {"range": {"org.id": {"gte": 1}}}}}`, false, true},
+		{"terms lookup", `{"terms": {"tenant": {"index": "x", "id": "1", "path": "tenant"}}}`, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := documentMatches(doc, decodeJson(t, test.filter))
+			if (err != nil) != test.err {
+				t.Fatalf("documentMatches() error = %v, want error %v", err, test.err)
+			}
+
+			if got != test.want {
+				t.Errorf("documentMatches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Filters from TOML have integers rather than floats.
+	if ok, err := documentMatches(doc, map[string]interface{}{"term": map[string]interface{}{"org.id": int64(42)}}); !ok || err != nil {
+		t.Errorf("int64 term didn't match: %v", err)
+	}
+}
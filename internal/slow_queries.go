@@ -0,0 +1,80 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/slowlog"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// newSlowQueryTracker creates the slow query tracker from the `[slow_queries]` table.
+func newSlowQueryTracker(config *SlowQueryConfig) (*slowlog.Tracker, error) {
+	threshold := 500 * time.Millisecond
+	if config.Threshold != nil {
+		var err error
+		threshold, err = time.ParseDuration(*config.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `slow_queries.threshold` %q: %v", *config.Threshold, err)
+		}
+	}
+
+	maxShapes := 1000
+	if config.MaxShapes != nil {
+		maxShapes = *config.MaxShapes
+	}
+
+	logrus.Infof("Slow query log is enabled for searches slower than %s", threshold)
+	return slowlog.NewTracker(threshold, maxShapes), nil
+}
+
+// recordSlowQuery logs the shape of the search and records it, if it was slow.
+func (es *ElasticService) recordSlowQuery(ctx context.Context, index string, query map[string]interface{}, took float64, elapsed time.Duration, hits int) {
+	tookDuration := time.Duration(took * float64(time.Millisecond))
+	if !es.SlowQueries.Slow(tookDuration, elapsed) {
+		return
+	}
+
+	caller := ""
+	if principal := auth.PrincipalFromContext(ctx); principal != nil {
+		caller = principal.Name
+	}
+
+	stats := es.SlowQueries.Record(slowlog.Query{
+		Index:     index,
+		Query:     query,
+		Took:      tookDuration,
+		Request:   elapsed,
+		Hits:      hits,
+		Caller:    caller,
+		RequestID: RequestID(ctx),
+	})
+
+	shape, _ := json.Marshal(stats.Shape)
+	Logger(ctx).WithFields(logrus.Fields{
+		"index":       index,
+		"fingerprint": stats.Fingerprint,
+		"shape":       string(shape),
+		"took_ms":     took,
+		"request_ms":  elapsed.Milliseconds(),
+		"hits":        hits,
+		"caller":      caller,
+	}).Warnf("Slow query on index %s took %vms (fingerprint %s, seen %d times)", index, took, stats.Fingerprint, stats.Count)
+}
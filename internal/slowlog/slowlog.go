@@ -0,0 +1,217 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slowlog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Placeholder is the value that the values of a query are replaced with.
+const Placeholder = "?"
+
+// Shape returns the shape of a query, which is the query with every value replaced
+// by Placeholder, so queries that only differ by their values have the same shape.
+// Arrays of values are collapsed into a single placeholder.
+func Shape(query interface{}) interface{} {
+	switch v := query.(type) {
+	case map[string]interface{}:
+		shape := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			shape[key] = Shape(inner)
+		}
+
+		return shape
+
+	case []interface{}:
+		shape := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			s := Shape(element)
+			if s == Placeholder && len(shape) > 0 && shape[len(shape)-1] == Placeholder {
+				continue
+			}
+
+			shape = append(shape, s)
+		}
+
+		return shape
+
+	default:
+		return Placeholder
+	}
+}
+
+// Fingerprint returns the shape of the query and a hash of it.
+func Fingerprint(query interface{}) (interface{}, string) {
+	shape := Shape(query)
+
+	// Maps are encoded with sorted keys, so equal shapes have equal hashes.
+	data, _ := json.Marshal(shape)
+	sum := sha256.Sum256(data)
+
+	return shape, hex.EncodeToString(sum[:8])
+}
+
+// Query is a single slow query.
+type Query struct {
+	Index     string
+	Query     interface{}
+	Took      time.Duration
+	Request   time.Duration
+	Hits      int
+	Caller    string
+	RequestID string
+}
+
+// Stats are the aggregated stats of a query shape on an index.
+type Stats struct {
+	Fingerprint string      `json:"fingerprint"`
+	Index       string      `json:"index"`
+	Shape       interface{} `json:"shape"`
+	Count       int64       `json:"count"`
+	TotalMs     float64     `json:"total_ms"`
+	AverageMs   float64     `json:"average_ms"`
+	MaxMs       float64     `json:"max_ms"`
+	TotalHits   int64       `json:"total_hits"`
+	FirstSeen   time.Time   `json:"first_seen"`
+	LastSeen    time.Time   `json:"last_seen"`
+	LastCaller  string      `json:"last_caller,omitempty"`
+	LastRequest string      `json:"last_request_id,omitempty"`
+}
+
+// Tracker aggregates slow queries by their fingerprint. It keeps at most a maximum
+// number of shapes, when it is full, the shape with the lowest total time is
+// forgotten.
+type Tracker struct {
+	Threshold time.Duration
+
+	max    int
+	mu     sync.Mutex
+	shapes map[string]*Stats
+}
+
+// NewTracker creates a new Tracker.
+func NewTracker(threshold time.Duration, max int) *Tracker {
+	return &Tracker{
+		Threshold: threshold,
+		max:       max,
+		shapes:    map[string]*Stats{},
+	}
+}
+
+// Slow returns if the query took long enough to be recorded.
+func (t *Tracker) Slow(took time.Duration, request time.Duration) bool {
+	return took >= t.Threshold || request >= t.Threshold
+}
+
+// Record records the slow query, and returns the stats of its shape.
+func (t *Tracker) Record(query Query) Stats {
+	shape, fingerprint := Fingerprint(query.Query)
+	key := query.Index + "/" + fingerprint
+	ms := float64(query.Request.Microseconds()) / 1000
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.shapes[key]
+	if !ok {
+		if t.max > 0 && len(t.shapes) >= t.max {
+			t.evict()
+		}
+
+		stats = &Stats{
+			Fingerprint: fingerprint,
+			Index:       query.Index,
+			Shape:       shape,
+			FirstSeen:   now,
+		}
+
+		t.shapes[key] = stats
+	}
+
+	stats.Count++
+	stats.TotalMs += ms
+	stats.AverageMs = stats.TotalMs / float64(stats.Count)
+	if ms > stats.MaxMs {
+		stats.MaxMs = ms
+	}
+
+	stats.TotalHits += int64(query.Hits)
+	stats.LastSeen = now
+	stats.LastCaller = query.Caller
+	stats.LastRequest = query.RequestID
+
+	return *stats
+}
+
+// evict forgets the shape with the lowest total time.
+func (t *Tracker) evict() {
+	lowest := ""
+	for key, stats := range t.shapes {
+		if lowest == "" || stats.TotalMs < t.shapes[lowest].TotalMs {
+			lowest = key
+		}
+	}
+
+	delete(t.shapes, lowest)
+}
+
+// Top returns at most limit shapes, sorted by "total" time (the default), "count",
+// "max" or "average" time.
+func (t *Tracker) Top(limit int, sortBy string) []Stats {
+	t.mu.Lock()
+	shapes := make([]Stats, 0, len(t.shapes))
+	for _, stats := range t.shapes {
+		shapes = append(shapes, *stats)
+	}
+	t.mu.Unlock()
+
+	value := func(s Stats) float64 {
+		switch sortBy {
+		case "count":
+			return float64(s.Count)
+		case "max":
+			return s.MaxMs
+		case "average":
+			return s.AverageMs
+		default:
+			return s.TotalMs
+		}
+	}
+
+	sort.Slice(shapes, func(i, j int) bool {
+		return value(shapes[i]) > value(shapes[j])
+	})
+
+	if limit > 0 && len(shapes) > limit {
+		shapes = shapes[:limit]
+	}
+
+	return shapes
+}
+
+// Reset forgets every shape.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.shapes = map[string]*Stats{}
+}
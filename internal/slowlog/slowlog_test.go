@@ -0,0 +1,181 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slowlog
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func decode(t *testing.T, value string) interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestShape(t *testing.T) {
+	tests := []struct {
+		query string
+		shape string
+	}{
+		{`{"match": {"title": "shoes"}}`, `{"match": {"title": "?"}}`},
+		{`{"terms": {"tags": ["a", "b", "c"]}}`, `{"terms": {"tags": ["?"]}}`},
+		{`{"range": {"price": {"gte": 10, "lt": 20.5}}}`, `{"range": {"price": {"gte": "?", "lt": "?"}}}`},
+		{`{"exists": {"field": null}}`, `{"exists": {"field": "?"}}`},
+		{
+			`{"bool": {"must": [{"term": {"a": 1}}, {"term": {"b": true}}], "filter": []}}`,
+			`{"bool": {"must": [{"term": {"a": "?"}}, {"term": {"b": "?"}}], "filter": []}}`,
+		},
+		{`{"mixed": [1, 2, {"x": 3}, 4, 5]}`, `{"mixed": ["?", {"x": "?"}, "?"]}`},
+	}
+
+	for _, test := range tests {
+		if shape := Shape(decode(t, test.query)); !reflect.DeepEqual(shape, decode(t, test.shape)) {
+			t.Errorf("Shape(%s) = %v, want %s", test.query, shape, test.shape)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	_, a := Fingerprint(decode(t, `{"match": {"title": "shoes"}, "size": 10}`))
+	_, b := Fingerprint(decode(t, `{"size": 50, "match": {"title": "boots"}}`))
+	_, c := Fingerprint(decode(t, `{"match": {"description": "shoes"}, "size": 10}`))
+
+	if a != b {
+		t.Errorf("queries that only differ by their values have fingerprints %s and %s", a, b)
+	}
+
+	if a == c {
+		t.Errorf("queries on different fields have the same fingerprint %s", a)
+	}
+
+	if len(a) != 16 {
+		t.Errorf("fingerprint %s isn't 16 characters", a)
+	}
+}
+
+func TestTrackerSlow(t *testing.T) {
+	tracker := NewTracker(100*time.Millisecond, 10)
+	tests := []struct {
+		took    time.Duration
+		request time.Duration
+		slow    bool
+	}{
+		{10 * time.Millisecond, 20 * time.Millisecond, false},
+		{99 * time.Millisecond, 99 * time.Millisecond, false},
+		{100 * time.Millisecond, 100 * time.Millisecond, true},
+		{10 * time.Millisecond, 150 * time.Millisecond, true},
+		{150 * time.Millisecond, 0, true},
+	}
+
+	for _, test := range tests {
+		if slow := tracker.Slow(test.took, test.request); slow != test.slow {
+			t.Errorf("Slow(%s, %s) = %v", test.took, test.request, slow)
+		}
+	}
+}
+
+func TestTrackerRecord(t *testing.T) {
+	tracker := NewTracker(0, 10)
+	tracker.Record(Query{Index: "products", Query: decode(t, `{"match": {"title": "a"}}`), Request: 100 * time.Millisecond, Hits: 2, Caller: "a"})
+	stats := tracker.Record(Query{Index: "products", Query: decode(t, `{"match": {"title": "b"}}`), Request: 300 * time.Millisecond, Hits: 3, Caller: "b", RequestID: "r2"})
+
+	if stats.Count != 2 || stats.TotalMs != 400 || stats.AverageMs != 200 || stats.MaxMs != 300 || stats.TotalHits != 5 {
+		t.Errorf("Record() = %+v", stats)
+	}
+
+	if stats.LastCaller != "b" || stats.LastRequest != "r2" || stats.FirstSeen.After(stats.LastSeen) {
+		t.Errorf("Record() = %+v", stats)
+	}
+
+	// The same shape on another index is tracked separately.
+	tracker.Record(Query{Index: "orders", Query: decode(t, `{"match": {"title": "a"}}`), Request: time.Second})
+	if top := tracker.Top(0, ""); len(top) != 2 || top[0].Index != "orders" {
+		t.Errorf("Top() = %+v", top)
+	}
+
+	tracker.Reset()
+	if top := tracker.Top(0, ""); len(top) != 0 {
+		t.Errorf("Top() after Reset() = %+v", top)
+	}
+}
+
+func TestTrackerEviction(t *testing.T) {
+	tracker := NewTracker(0, 2)
+	record := func(field string, request time.Duration) {
+		tracker.Record(Query{Index: "products", Query: map[string]interface{}{"match": map[string]interface{}{field: "x"}}, Request: request})
+	}
+
+	record("title", 300*time.Millisecond)
+	record("tags", 100*time.Millisecond)
+	record("title", 300*time.Millisecond)
+
+	// The tracker is full, so the shape with the lowest total time is forgotten.
+	record("color", 200*time.Millisecond)
+
+	top := tracker.Top(0, "")
+	if len(top) != 2 {
+		t.Fatalf("Top() = %+v", top)
+	}
+
+	_, title := Fingerprint(map[string]interface{}{"match": map[string]interface{}{"title": "?"}})
+	_, color := Fingerprint(map[string]interface{}{"match": map[string]interface{}{"color": "?"}})
+	if top[0].Fingerprint != title || top[1].Fingerprint != color {
+		t.Errorf("Top() after eviction = %+v", top)
+	}
+}
+
+func TestTrackerTop(t *testing.T) {
+	tracker := NewTracker(0, 10)
+	record := func(field string, requests ...time.Duration) {
+		for _, request := range requests {
+			tracker.Record(Query{Index: "products", Query: map[string]interface{}{field: "x"}, Request: request})
+		}
+	}
+
+	// total: a=300, b=250, c=240; count: c=3; max: b=250; average: b=250.
+	record("a", 150*time.Millisecond, 150*time.Millisecond)
+	record("b", 250*time.Millisecond)
+	record("c", 80*time.Millisecond, 80*time.Millisecond, 80*time.Millisecond)
+
+	tests := map[string][]float64{
+		"":        {300, 250, 240},
+		"count":   {240, 300, 250},
+		"max":     {250, 300, 240},
+		"average": {250, 300, 240},
+	}
+
+	for sortBy, want := range tests {
+		top := tracker.Top(0, sortBy)
+		totals := make([]float64, 0, len(top))
+		for _, stats := range top {
+			totals = append(totals, stats.TotalMs)
+		}
+
+		if !reflect.DeepEqual(totals, want) {
+			t.Errorf("Top(0, %q) totals = %v, want %v", sortBy, totals, want)
+		}
+	}
+
+	if top := tracker.Top(1, "count"); len(top) != 1 || top[0].Count != 3 {
+		t.Errorf("Top(1, \"count\") = %+v", top)
+	}
+}
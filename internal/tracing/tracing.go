@@ -0,0 +1,136 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+// Config represents the `[tracing]` table, which exports OpenTelemetry traces of
+// the requests and the Elasticsearch calls that they make.
+type Config struct {
+	// Exporter is where the spans are exported to, either "otlp" (OTLP over HTTP)
+	// or "stdout". By default, it is "otlp".
+	Exporter *string `toml:"exporter,omitempty"`
+
+	// Endpoint is the `host:port` of the OTLP collector, by default it is
+	// "localhost:4318".
+	Endpoint *string `toml:"endpoint,omitempty"`
+
+	// Insecure sends the spans to the OTLP collector over HTTP rather than HTTPS.
+	Insecure bool `toml:"insecure,omitempty"`
+
+	// Headers are sent with every export to the OTLP collector, i.e. for authentication.
+	Headers map[string]string `toml:"headers,omitempty"`
+
+	// ServiceName is the `service.name` of the spans, by default it is "tsubasa".
+	ServiceName *string `toml:"service_name,omitempty"`
+
+	// SampleRatio is the ratio of traces that are sampled, from 0 to 1. Traces that
+	// were sampled by the caller are always sampled. By default, it is 1.
+	SampleRatio *float64 `toml:"sample_ratio,omitempty"`
+}
+
+// Tracer returns the tracer of Tsubasa's spans. If tracing is not enabled, the
+// spans are not recorded.
+func Tracer() trace.Tracer {
+	return otel.Tracer("floofy.dev/tsubasa")
+}
+
+// NewProvider creates the tracer provider from the configuration, and installs it
+// (and the W3C trace context propagator) globally.
+func NewProvider(config Config, version string) (*sdktrace.TracerProvider, error) {
+	exporterName := "otlp"
+	if config.Exporter != nil {
+		exporterName = *config.Exporter
+	}
+
+	var exporter sdktrace.SpanExporter
+	switch exporterName {
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if config.Endpoint != nil {
+			opts = append(opts, otlptracehttp.WithEndpoint(*config.Endpoint))
+		}
+
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		if len(config.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+		}
+
+		client, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = client
+
+	case "stdout":
+		client, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = client
+
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, expected \"otlp\" or \"stdout\"", exporterName)
+	}
+
+	serviceName := "tsubasa"
+	if config.ServiceName != nil {
+		serviceName = *config.ServiceName
+	}
+
+	ratio := 1.0
+	if config.SampleRatio != nil {
+		if *config.SampleRatio < 0 || *config.SampleRatio > 1 {
+			return nil, fmt.Errorf("`sample_ratio` must be between 0 and 1, received %v", *config.SampleRatio)
+		}
+
+		ratio = *config.SampleRatio
+	}
+
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+		semconv.ServiceVersionKey.String(version),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider, nil
+}
@@ -0,0 +1,59 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/analytics"
+	"net/http"
+)
+
+// Visitor attaches the user and session IDs from the `[analytics]` headers to the
+// request context, so they are recorded with the searches.
+func Visitor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		config := internal.GlobalContainer.Config.Analytics
+		if config == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		userHeader := "X-User-Id"
+		if config.UserHeader != nil {
+			userHeader = *config.UserHeader
+		}
+
+		sessionHeader := "X-Session-Id"
+		if config.SessionHeader != nil {
+			sessionHeader = *config.SessionHeader
+		}
+
+		visitor := analytics.Visitor{
+			UserID:    truncate(req.Header.Get(userHeader), 256),
+			SessionID: truncate(req.Header.Get(sessionHeader), 256),
+		}
+
+		next.ServeHTTP(w, req.WithContext(analytics.WithVisitor(req.Context(), visitor)))
+	})
+}
+
+func truncate(value string, max int) string {
+	if len(value) > max {
+		return value[:max]
+	}
+
+	return value
+}
@@ -0,0 +1,146 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/audit"
+	"floofy.dev/tsubasa/internal/auth"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Audit returns a middleware that records requests of the route class (`search`,
+// `write` or `admin`) in the audit log, with who made them, what they touched
+// and how they ended. Searches are only audited if `audit.include_searches` is set.
+func Audit(class string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logger := internal.GlobalContainer.Audit
+			config := internal.GlobalContainer.Config.Audit
+			if logger == nil || (class == auth.ActionSearch && !config.IncludeSearches) {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			var body []byte
+			if req.Body != nil {
+				b, err := ioutil.ReadAll(req.Body)
+				if err == nil {
+					body = b
+				}
+
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+
+			var response bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			ww.Tee(&response)
+
+			start := time.Now()
+			next.ServeHTTP(ww, req)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				host = req.RemoteAddr
+			}
+
+			record := audit.Record{
+				Time:           start.UTC(),
+				Principal:      "anonymous",
+				Provider:       "anonymous",
+				IP:             host,
+				Action:         class,
+				Method:         req.Method,
+				Route:          chi.RouteContext(req.Context()).RoutePattern(),
+				Path:           req.URL.Path,
+				Index:          chi.URLParam(req, "index"),
+				DocumentIDs:    documentIDs(req, response.Bytes()),
+				Status:         status,
+				LatencyMs:      float64(time.Since(start).Microseconds()) / 1000,
+				IdempotencyKey: req.Header.Get("Idempotency-Key"),
+				RequestID:      internal.RequestID(req.Context()),
+			}
+
+			if principal := auth.PrincipalFromContext(req.Context()); principal != nil {
+				record.Principal = principal.Name
+				record.Provider = principal.Provider
+				record.CredentialID = principal.ID
+			}
+
+			if len(body) > 0 {
+				hash := sha256.Sum256(body)
+				record.QueryHash = hex.EncodeToString(hash[:])
+
+				if config.IncludeBody {
+					var decoded interface{}
+					if err := json.Unmarshal(body, &decoded); err == nil {
+						record.Body = decoded
+					}
+				}
+			}
+
+			logger.Log(record)
+		})
+	}
+}
+
+// documentIDs returns the ids of the documents that the request touched, from the
+// `{id}` URL parameter or the `id` and `items[].id` of the response data.
+func documentIDs(req *http.Request, response []byte) []string {
+	if id := chi.URLParam(req, "id"); id != "" {
+		return []string{id}
+	}
+
+	var res struct {
+		Data struct {
+			ID    string `json:"id"`
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		} `json:"data"`
+	}
+
+	if err := json.Unmarshal(response, &res); err != nil {
+		return nil
+	}
+
+	ids := make([]string, 0, len(res.Data.Items)+1)
+	if res.Data.ID != "" {
+		ids = append(ids, res.Data.ID)
+	}
+
+	for _, item := range res.Data.Items {
+		if item.ID != "" {
+			ids = append(ids, item.ID)
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,126 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/util"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Auth authenticates the request with the chain of authentication providers and
+// attaches the auth.Principal to the request context. If no providers are
+// configured, every request is anonymous.
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		chain := internal.GlobalContainer.Authenticators
+		if len(chain) == 0 {
+			next.ServeHTTP(w, withPrincipal(req, auth.Anonymous()))
+			return
+		}
+
+		principal, authenticator, err := chain.Authenticate(req)
+		if err == auth.ErrNoCredentials {
+			for _, challenge := range chain.Challenges() {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+
+			// A bearer token that none of the providers understand is invalid,
+			// rather than missing.
+			if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+				util.WriteJson(w, http.StatusUnauthorized, result.Err(http.StatusUnauthorized, "INVALID_TOKEN", "Invalid bearer token."))
+				return
+			}
+
+			res := result.Err(http.StatusUnauthorized, "UNABLE_TO_OBTAIN", "Server has enabled authentication and I couldn't grab the credentials. :(")
+			util.WriteJson(w, http.StatusUnauthorized, res)
+			return
+		}
+
+		if err != nil {
+			internal.Logger(req.Context()).Debugf("Unable to authenticate request with provider %s: %v", authenticator.Name(), err)
+			if challenge := authenticator.Challenge(); challenge != "" {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+
+			status, code, message := http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid credentials."
+			if authErr, ok := err.(*auth.Error); ok {
+				code, message = authErr.Code, authErr.Message
+				if authErr.RetryAfter > 0 {
+					status = http.StatusTooManyRequests
+					w.Header().Set("Retry-After", strconv.Itoa(seconds(authErr.RetryAfter)))
+				}
+			}
+
+			util.WriteJson(w, status, result.Err(status, code, message))
+			return
+		}
+
+		principal.ResolveRoles(internal.GlobalContainer.Config.Auth.Roles)
+		next.ServeHTTP(w, withPrincipal(req, principal))
+	})
+}
+
+// withPrincipal attaches the principal to the request context and to its logger,
+// and adds it to the access log entry of the request.
+func withPrincipal(req *http.Request, principal *auth.Principal) *http.Request {
+	addAccessLogField(req.Context(), "principal", principal.Name)
+	addAccessLogField(req.Context(), "provider", principal.Provider)
+
+	ctx := auth.WithPrincipal(req.Context(), principal)
+	ctx = internal.WithLogger(ctx, internal.Logger(ctx).WithField("principal", principal.Name))
+	return req.WithContext(ctx)
+}
+
+// PeerAddress records the address of the peer that made the connection, so it is
+// known after proxy headers replace `http.Request.RemoteAddr`. This must run
+// before any middleware that rewrites the remote address.
+func PeerAddress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(auth.WithPeerAddress(req.Context(), req.RemoteAddr)))
+	})
+}
+
+// RequireScope returns a middleware that only allows principals that can do the
+// action on the `{index}` URL parameter of the route. This must be used inline
+// on a route (i.e. `r.With(...)`), so the URL parameters are available.
+func RequireScope(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			principal := auth.PrincipalFromContext(req.Context())
+			index := chi.URLParam(req, "index")
+
+			if principal == nil || !principal.Can(action, index) {
+				target := "this server"
+				if index != "" {
+					target = fmt.Sprintf("index '%s'", index)
+				}
+
+				res := result.Err(http.StatusForbidden, "MISSING_SCOPE", fmt.Sprintf("You are not allowed to %s on %s.", action, target))
+				util.WriteJson(w, http.StatusForbidden, res)
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-None-Match"}
+	defaultCORSExposed = []string{"ETag", "Idempotent-Replayed", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset", "X-Request-Id"}
+)
+
+// CORS handles Cross-Origin Resource Sharing with the policy from `[cors]`. This
+// must run before Auth, since browsers send preflight requests without credentials,
+// so preflight requests are answered here and never reach the routes.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		config := internal.GlobalContainer.Config.CORS
+		if config == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// Responses without an Origin don't have the CORS headers, so caches must
+		// not reuse them for requests with one either.
+		w.Header().Add("Vary", "Origin")
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		policy := config.For(req.URL.Path)
+		preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !corsOriginAllowed(policy.AllowedOrigins, origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		credentials := policy.AllowCredentials != nil && *policy.AllowCredentials
+
+		// The origin is echoed rather than `*`, since browsers reject a wildcard with
+		// credentials. A `*` origin is never combined with credentials, the
+		// configuration is rejected when it's loaded.
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			exposed := policy.ExposedHeaders
+			if exposed == nil {
+				exposed = defaultCORSExposed
+			}
+
+			if len(exposed) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+			}
+
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		methods := policy.AllowedMethods
+		if methods == nil {
+			methods = defaultCORSMethods
+		}
+
+		headers := policy.AllowedHeaders
+		if headers == nil {
+			headers = defaultCORSHeaders
+		}
+
+		method := req.Header.Get("Access-Control-Request-Method")
+		if !corsContains(methods, method) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		requested := strings.FieldsFunc(req.Header.Get("Access-Control-Request-Headers"), func(r rune) bool { return r == ',' || r == ' ' })
+		for _, header := range requested {
+			if !corsContains(headers, header) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(requested) > 0 {
+			// The requested headers are echoed, since `*` doesn't cover `Authorization`.
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+
+		if policy.MaxAge != nil {
+			if maxAge, err := time.ParseDuration(*policy.MaxAge); err == nil {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// corsOriginAllowed returns if the origin matches one of the allowed origins, which
+// can be `*` or have a wildcard subdomain (i.e. `https://*.floofy.dev`).
+func corsOriginAllowed(allowed []string, origin string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+
+		scheme, host, ok := strings.Cut(pattern, "://*.")
+		if !ok {
+			continue
+		}
+
+		prefix := scheme + "://"
+		suffix := "." + host
+		if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// corsContains returns if the value is in the list (case-insensitive), `*` matches everything.
+func corsContains(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,170 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSOriginAllowed(t *testing.T) {
+	allowed := []string{"https://app.floofy.dev", "https://*.noel.dev"}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.floofy.dev", true},
+		{"HTTPS://APP.FLOOFY.DEV", true},
+		{"https://floofy.dev", false},
+		{"http://app.floofy.dev", false},
+		{"https://docs.noel.dev", true},
+		{"https://a.b.noel.dev", true},
+		{"https://noel.dev", false},
+		{"https://.noel.dev", false},
+		{"http://docs.noel.dev", false},
+		{"https://docs.noel.dev.evil.com", false},
+		{"https://evilnoel.dev", false},
+	}
+
+	for _, test := range tests {
+		if allowed := corsOriginAllowed(allowed, test.origin); allowed != test.allowed {
+			t.Errorf("corsOriginAllowed(%q) = %v", test.origin, allowed)
+		}
+	}
+
+	if !corsOriginAllowed([]string{"*"}, "https://anything.example") {
+		t.Error("* should allow every origin")
+	}
+}
+
+func newCORSHandler(t *testing.T, config *internal.CORSConfig) http.Handler {
+	internal.GlobalContainer = &internal.Container{Config: &internal.Config{CORS: config}}
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	return CORS(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	maxAge := "10m"
+	handler := newCORSHandler(t, &internal.CORSConfig{
+		CORSPolicy: internal.CORSPolicy{
+			AllowedOrigins: []string{"https://*.floofy.dev"},
+			AllowedMethods: []string{"GET", "POST"},
+			MaxAge:         &maxAge,
+		},
+	})
+
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{"allowed", "https://app.floofy.dev", "POST", "Authorization, Content-Type", true},
+		{"disallowed origin", "https://evil.com", "POST", "", false},
+		{"disallowed method", "https://app.floofy.dev", "DELETE", "", false},
+		{"disallowed header", "https://app.floofy.dev", "POST", "X-Secret", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", "/elastic/products/search", nil)
+			req.Header.Set("Origin", test.origin)
+			req.Header.Set("Access-Control-Request-Method", test.method)
+			if test.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", test.headers)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			// Preflight requests never reach the routes.
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status %d", rec.Code)
+			}
+
+			headers := rec.Header()
+			if vary := headers.Values("Vary"); len(vary) != 3 {
+				t.Errorf("Vary = %v", vary)
+			}
+
+			if !test.allowed {
+				if headers.Get("Access-Control-Allow-Methods") != "" {
+					t.Errorf("disallowed preflight got headers %v", headers)
+				}
+
+				return
+			}
+
+			if headers.Get("Access-Control-Allow-Origin") != test.origin ||
+				headers.Get("Access-Control-Allow-Methods") != "GET, POST" ||
+				headers.Get("Access-Control-Allow-Headers") != test.headers ||
+				headers.Get("Access-Control-Max-Age") != "600" ||
+				headers.Get("Access-Control-Allow-Credentials") != "" {
+				t.Errorf("preflight headers %v", headers)
+			}
+		})
+	}
+}
+
+func TestCORSVary(t *testing.T) {
+	credentials := true
+	handler := newCORSHandler(t, &internal.CORSConfig{
+		CORSPolicy: internal.CORSPolicy{AllowedOrigins: []string{"https://app.floofy.dev"}, AllowCredentials: &credentials},
+		Routes: map[string]internal.CORSPolicy{
+			"/admin": {AllowedOrigins: []string{"https://admin.floofy.dev"}},
+		},
+	})
+
+	tests := []struct {
+		path   string
+		origin string
+		allow  string
+	}{
+		{"/elastic/products", "https://app.floofy.dev", "https://app.floofy.dev"},
+		{"/elastic/products", "https://admin.floofy.dev", ""},
+		{"/admin/drift", "https://admin.floofy.dev", "https://admin.floofy.dev"},
+		{"/elastic/products", "", ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		headers := rec.Header()
+		if rec.Code != http.StatusOK || headers.Get("Vary") != "Origin" {
+			t.Errorf("%s from %q: status %d, Vary %v", test.path, test.origin, rec.Code, headers.Values("Vary"))
+		}
+
+		if headers.Get("Access-Control-Allow-Origin") != test.allow {
+			t.Errorf("%s from %q: Access-Control-Allow-Origin = %q", test.path, test.origin, headers.Get("Access-Control-Allow-Origin"))
+		}
+
+		if test.allow != "" && (headers.Get("Access-Control-Allow-Credentials") != "true" || headers.Get("Access-Control-Expose-Headers") == "") {
+			t.Errorf("%s from %q: headers %v", test.path, test.origin, headers)
+		}
+	}
+}
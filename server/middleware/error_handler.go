@@ -23,7 +23,6 @@ import (
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/sirupsen/logrus"
 	"net/http"
 	"time"
 )
@@ -38,7 +37,7 @@ func ErrorHandling(next http.Handler) http.Handler {
 						panic(err)
 					}
 
-					logrus.Errorf("Received panic on rotue '%s %s':", req.Method, req.URL.Path)
+					internal.Logger(req.Context()).Errorf("Received panic on rotue '%s %s':", req.Method, req.URL.Path)
 					middleware.PrintPrettyStack(err)
 
 					res := result.Err(500, "INTERNAL_SERVER_ERROR", "Unknown service error has occurred.")
@@ -69,7 +68,7 @@ func ErrorHandling(next http.Handler) http.Handler {
 						panic(err)
 					}
 
-					logrus.Errorf("Received panic on rotue '%s %s':", req.Method, req.URL.Path)
+					internal.Logger(req.Context()).Errorf("Received panic on rotue '%s %s':", req.Method, req.URL.Path)
 					middleware.PrintPrettyStack(err)
 
 					eventId := hub.RecoverWithContext(context.WithValue(req.Context(), sentry.RequestContextKey, req), err)
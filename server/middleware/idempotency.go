@@ -0,0 +1,131 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/util"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"io/ioutil"
+	"net/http"
+)
+
+// maxIdempotentBodySize is the largest request body that the Idempotency middleware
+// buffers to hash, requests with larger bodies are rejected.
+const maxIdempotentBodySize = 16 << 20
+
+// Idempotency replays the stored response of POST requests that are retried
+// with the same `Idempotency-Key` header, rather than executing them again.
+func Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if req.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxIdempotentBodySize))
+		if err != nil {
+			if len(body) >= maxIdempotentBodySize {
+				res := result.Err(413, "BODY_TOO_LARGE", fmt.Sprintf("Requests with an idempotency key can't have a body larger than %d bytes.", maxIdempotentBodySize))
+				util.WriteJson(w, 413, res)
+				return
+			}
+
+			util.WriteJson(w, 400, result.Err(400, "INVALID_BODY", "Unable to read request body."))
+			return
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(hash[:])
+		// Keys are scoped to the credential, so one can't replay another's response.
+		// Names of API keys aren't unique, so the ID is used when there is one.
+		principal := "anonymous"
+		if p := auth.PrincipalFromContext(req.Context()); p != nil {
+			principal = p.Provider + ":" + p.Name
+			if p.ID != "" {
+				principal = p.Provider + ":" + p.ID
+			}
+		}
+
+		storeKey := fmt.Sprintf("%s %s %s %s", principal, req.Method, req.URL.Path, key)
+
+		store := internal.GlobalContainer.Idempotency
+		if stored := store.Begin(storeKey, bodyHash); stored != nil {
+			if stored.BodyHash != bodyHash {
+				res := result.Err(422, "IDEMPOTENCY_KEY_REUSED", "Idempotency key was already used with a different request body.")
+				util.WriteJson(w, 422, res)
+				return
+			}
+
+			if !stored.Done {
+				res := result.Err(409, "IDEMPOTENCY_KEY_IN_USE", "A request with this idempotency key is still being processed.")
+				util.WriteJson(w, 409, res)
+				return
+			}
+
+			for k, v := range stored.Header {
+				// The replay keeps the ID of this request, rather than the original one.
+				if k == "X-Request-Id" {
+					continue
+				}
+
+				w.Header()[k] = v
+			}
+
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			_, _ = w.Write(stored.Body)
+			return
+		}
+
+		var buf bytes.Buffer
+		ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+		ww.Tee(&buf)
+
+		completed := false
+		defer func() {
+			// Failed requests (and panics) aren't stored, so the request can be retried.
+			if !completed {
+				store.Release(storeKey)
+			}
+		}()
+
+		next.ServeHTTP(ww, req)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// Only successful responses are replayed, so a retry after i.e. a rate limit
+		// or a missing scope is executed again instead of getting the same error.
+		if status < 200 || status >= 300 {
+			return
+		}
+
+		store.Complete(storeKey, status, w.Header().Clone(), buf.Bytes())
+		completed = true
+	})
+}
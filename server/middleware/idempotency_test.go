@@ -0,0 +1,86 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyScopedToCredential(t *testing.T) {
+	internal.GlobalContainer = &internal.Container{Idempotency: internal.NewIdempotencyStore(time.Hour)}
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	calls := 0
+	handler := Idempotency(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(auth.PrincipalFromContext(req.Context()).ID))
+	}))
+
+	send := func(principal *auth.Principal) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/products/search", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", "abc")
+		req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// API key names aren't unique, so keys with the same name don't share responses.
+	tenantA := &auth.Principal{ID: "a", Name: "frontend", Provider: "api_key"}
+	tenantB := &auth.Principal{ID: "b", Name: "frontend", Provider: "api_key"}
+
+	if rec := send(tenantA); rec.Body.String() != "a" {
+		t.Fatalf("unexpected response %q", rec.Body.String())
+	}
+
+	if rec := send(tenantB); rec.Body.String() != "b" || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("tenant b got a replayed response %q", rec.Body.String())
+	}
+
+	if rec := send(tenantA); rec.Header().Get("Idempotent-Replayed") != "true" || rec.Body.String() != "a" {
+		t.Fatalf("tenant a didn't get its replayed response, got %q", rec.Body.String())
+	}
+
+	if calls != 2 {
+		t.Fatalf("handler was called %d times, expected 2", calls)
+	}
+}
+
+func TestIdempotencyBodyTooLarge(t *testing.T) {
+	internal.GlobalContainer = &internal.Container{Idempotency: internal.NewIdempotencyStore(time.Hour)}
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	handler := Idempotency(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Fatal("handler shouldn't be called")
+	}))
+
+	req := httptest.NewRequest("POST", "/products/bulk", strings.NewReader(strings.Repeat("a", maxIdempotentBodySize+1)))
+	req.Header.Set("Idempotency-Key", "abc")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 413 {
+		t.Fatalf("got status %d, expected 413", rec.Code)
+	}
+}
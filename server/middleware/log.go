@@ -16,28 +16,70 @@
 package middleware
 
 import (
+	"context"
+	"floofy.dev/tsubasa/internal"
 	"floofy.dev/tsubasa/util"
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sync"
 	"time"
 )
 
+type accessLogKey struct{}
+
+// accessLog holds the fields that middleware later in the chain (i.e. Auth) add
+// to the access log entry of a request.
+type accessLog struct {
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+// addAccessLogField adds a field to the access log entry of the request.
+func addAccessLogField(ctx context.Context, key string, value interface{}) {
+	if log, ok := ctx.Value(accessLogKey{}).(*accessLog); ok {
+		log.mu.Lock()
+		log.fields[key] = value
+		log.mu.Unlock()
+	}
+}
+
+// Logging writes an access log entry for every request. The details are fields
+// of the entry, so they can be queried with the `json` and `logfmt` log formats.
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		s := time.Now()
+		log := &accessLog{fields: logrus.Fields{}}
 		ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
-		next.ServeHTTP(ww, req)
-
-		code := util.GetStatusCode(ww.Status())
-		logrus.Infof("[%s] %s %s (%s) => %d %s (%d bytes [%s])",
-			req.RemoteAddr,
-			req.Method,
-			req.URL.Path,
-			req.Proto,
-			ww.Status(),
-			code,
-			ww.BytesWritten(),
-			time.Since(s).String())
+		next.ServeHTTP(ww, req.WithContext(context.WithValue(req.Context(), accessLogKey{}, log)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		fields := logrus.Fields{
+			"ip":          req.RemoteAddr,
+			"method":      req.Method,
+			"path":        req.URL.Path,
+			"proto":       req.Proto,
+			"status":      status,
+			"bytes":       ww.BytesWritten(),
+			"duration_ms": float64(time.Since(s).Microseconds()) / 1000,
+			"user_agent":  req.UserAgent(),
+		}
+
+		if rctx := chi.RouteContext(req.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			fields["route"] = rctx.RoutePattern()
+		}
+
+		log.mu.Lock()
+		for key, value := range log.fields {
+			fields[key] = value
+		}
+		log.mu.Unlock()
+
+		internal.Logger(req.Context()).WithFields(fields).Infof("%s %s => %d %s", req.Method, req.URL.Path, status, util.GetStatusCode(status))
 	})
 }
@@ -0,0 +1,74 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal/metrics"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func histogramCount(t *testing.T, labels ...string) uint64 {
+	var m dto.Metric
+	if err := metrics.HTTPDuration.WithLabelValues(labels...).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestMetricsUseRoutePattern(t *testing.T) {
+	metrics.HTTPRequests.Reset()
+	metrics.HTTPDuration.Reset()
+
+	documents := chi.NewRouter()
+	documents.Get("/{index}/documents/{id}", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	router := chi.NewRouter()
+	router.Use(Metrics)
+	router.Mount("/elastic", documents)
+
+	for _, path := range []string{"/elastic/products/documents/1", "/elastic/products/documents/2", "/elastic/orders/documents/3", "/nothing"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/elastic/products/documents/1", nil))
+
+	route := []string{"GET", "/elastic/{index}/documents/{id}", "200"}
+	if count := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues(route...)); count != 3 {
+		t.Errorf("http_requests_total%v = %v, want 3", route, count)
+	}
+
+	if count := histogramCount(t, route...); count != 3 {
+		t.Errorf("http_request_duration_seconds%v count = %v, want 3", route, count)
+	}
+
+	if count := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "unmatched", "404")); count != 1 {
+		t.Errorf("unmatched requests = %v, want 1", count)
+	}
+
+	// Only the route patterns and known methods are used as labels, never raw paths.
+	if series := testutil.CollectAndCount(metrics.HTTPRequests); series != 3 {
+		t.Errorf("http_requests_total has %d series, want 3", series)
+	}
+}
@@ -0,0 +1,134 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/ratelimit"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/util"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimit returns a middleware that limits the requests of the route class
+// (`search`, `write` or `admin`) with the limits from `[rate_limits]`. Requests
+// are limited per principal, or per client IP if the request is anonymous.
+// Principals with a rate limit of their own (i.e. search tokens) are limited
+// by it too.
+func RateLimit(class string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if principal := auth.PrincipalFromContext(req.Context()); principal != nil && principal.RateLimit > 0 {
+				decision := internal.GlobalContainer.RateLimiter.Take("principal:"+rateLimitKey(req), ratelimit.PerMinute(principal.RateLimit))
+				if !decision.Allowed {
+					writeRateLimited(w, decision)
+					return
+				}
+
+				setRateLimitHeaders(w, decision)
+			}
+
+			limits := internal.GlobalContainer.Config.RateLimits.For(class)
+			if limits == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			key := class + ":" + rateLimitKey(req)
+			if limits.RequestsPerMinute > 0 {
+				limit := ratelimit.PerMinute(limits.RequestsPerMinute)
+				if limits.Burst != nil {
+					limit.Burst = *limits.Burst
+				}
+
+				decision := internal.GlobalContainer.RateLimiter.Take(key, limit)
+				if !decision.Allowed {
+					writeRateLimited(w, decision)
+					return
+				}
+
+				setRateLimitHeaders(w, decision)
+			}
+
+			if limits.DailyQuota != nil {
+				usage := internal.GlobalContainer.Quotas.Use(key, *limits.DailyQuota)
+				w.Header().Set("X-Quota-Limit", strconv.Itoa(usage.Quota))
+				w.Header().Set("X-Quota-Remaining", strconv.Itoa(usage.Remaining))
+				w.Header().Set("X-Quota-Reset", strconv.Itoa(seconds(usage.Reset)))
+
+				if !usage.Allowed {
+					w.Header().Set("Retry-After", strconv.Itoa(seconds(usage.Reset)))
+					res := result.Err(http.StatusTooManyRequests, "QUOTA_EXCEEDED",
+						fmt.Sprintf("%s, the daily quota of %d request(s) was exceeded.", util.GetStatusCode(http.StatusTooManyRequests), usage.Quota))
+
+					util.WriteJson(w, http.StatusTooManyRequests, res)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// rateLimitKey returns the principal that made the request, or the client IP if
+// the request is anonymous.
+func rateLimitKey(req *http.Request) string {
+	principal := auth.PrincipalFromContext(req.Context())
+	if principal != nil && principal.Provider != "anonymous" {
+		if principal.ID != "" {
+			return principal.Provider + ":" + principal.ID
+		}
+
+		return principal.Provider + ":" + principal.Name
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// setRateLimitHeaders sets the `RateLimit-*` headers of the decision.
+func setRateLimitHeaders(w http.ResponseWriter, decision ratelimit.Decision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(decision.Reset)))
+}
+
+// writeRateLimited writes the 429 response of a request that was not allowed.
+func writeRateLimited(w http.ResponseWriter, decision ratelimit.Decision) {
+	setRateLimitHeaders(w, decision)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds(decision.RetryAfter)))
+
+	res := result.Err(http.StatusTooManyRequests, "RATE_LIMITED",
+		fmt.Sprintf("%s, try again in %d second(s).", util.GetStatusCode(http.StatusTooManyRequests), seconds(decision.RetryAfter)))
+
+	util.WriteJson(w, http.StatusTooManyRequests, res)
+}
+
+// seconds rounds the duration up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
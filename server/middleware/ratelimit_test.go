@@ -0,0 +1,145 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func newRateLimitContainer(limits *internal.RouteLimitConfig) {
+	internal.GlobalContainer = &internal.Container{
+		Config:      &internal.Config{RateLimits: internal.RateLimitConfig{Search: limits}},
+		RateLimiter: ratelimit.NewLimiter(),
+		Quotas:      ratelimit.NewQuotas(),
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	quota := 3
+	newRateLimitContainer(&internal.RouteLimitConfig{RequestsPerMinute: 2, DailyQuota: &quota})
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	handler := RateLimit(auth.ActionSearch)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/products/search", nil))
+		return rec
+	}
+
+	tests := []struct {
+		status         int
+		remaining      string
+		reset          string
+		quotaRemaining string
+	}{
+		{200, "1", "30", "2"},
+		{200, "0", "60", "1"},
+		// Requests over the rate limit don't count towards the quota.
+		{429, "0", "60", ""},
+	}
+
+	for i, test := range tests {
+		rec := send()
+		headers := rec.Header()
+		if rec.Code != test.status {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+
+		if headers.Get("RateLimit-Limit") != "2" || headers.Get("RateLimit-Remaining") != test.remaining || headers.Get("RateLimit-Reset") != test.reset {
+			t.Errorf("request %d: RateLimit headers %v", i, headers)
+		}
+
+		if headers.Get("X-Quota-Remaining") != test.quotaRemaining {
+			t.Errorf("request %d: X-Quota-Remaining = %q", i, headers.Get("X-Quota-Remaining"))
+		}
+
+		if test.status == 200 {
+			reset, err := strconv.Atoi(headers.Get("X-Quota-Reset"))
+			if headers.Get("X-Quota-Limit") != "3" || err != nil || reset <= 0 || reset > 24*60*60 {
+				t.Errorf("request %d: X-Quota headers %v", i, headers)
+			}
+		} else if headers.Get("Retry-After") != "30" {
+			t.Errorf("request %d: Retry-After = %q", i, headers.Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimitQuotaExceeded(t *testing.T) {
+	quota := 1
+	newRateLimitContainer(&internal.RouteLimitConfig{DailyQuota: &quota})
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	handler := RateLimit(auth.ActionSearch)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, status := range []int{200, 429} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/products", nil))
+
+		if rec.Code != status {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+
+		if rec.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("request %d: RateLimit headers without a rate limit", i)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/products", nil))
+	if rec.Header().Get("Retry-After") != rec.Header().Get("X-Quota-Reset") || rec.Header().Get("X-Quota-Remaining") != "0" {
+		t.Errorf("exceeded quota headers %v", rec.Header())
+	}
+}
+
+func TestRateLimitPerPrincipal(t *testing.T) {
+	newRateLimitContainer(nil)
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	handler := RateLimit(auth.ActionSearch)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(principal *auth.Principal) int {
+		req := httptest.NewRequest("GET", "/products", nil)
+		req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	a := &auth.Principal{ID: "a", Name: "frontend", Provider: "api_key", RateLimit: 1}
+	b := &auth.Principal{ID: "b", Name: "frontend", Provider: "api_key", RateLimit: 1}
+
+	if send(a) != 200 || send(a) != 429 {
+		t.Error("principal rate limit wasn't applied")
+	}
+
+	if send(b) != 200 {
+		t.Error("principals with the same name share a rate limit")
+	}
+}
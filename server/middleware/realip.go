@@ -0,0 +1,153 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/util"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP replaces `http.Request.RemoteAddr` with the IP of the client when the
+// request came from a trusted proxy (`trusted_proxies`). The hops of the
+// `Forwarded` header (or `X-Forwarded-For` if it is not set) are walked from the
+// nearest one, and the first hop that is not a trusted proxy is the client, so
+// a client can't spoof its IP by sending the headers itself.
+func RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxies := internal.GlobalContainer.TrustedProxies
+		if len(proxies) == 0 || !auth.ContainsIP(proxies, req.RemoteAddr) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		hops, ok := forwardedHops(req)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hops[i] == "" {
+				// The hop is obfuscated or unknown, so everything before it can't be trusted.
+				break
+			}
+
+			req.RemoteAddr = hops[i]
+			if !auth.ContainsIP(proxies, hops[i]) {
+				break
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// forwardedHops returns the IPs of the `Forwarded`, `X-Forwarded-For` or `X-Real-IP`
+// header, in that order of preference, from the client to the nearest proxy. Hops
+// that are not IPs (i.e. `unknown`) are returned as empty strings.
+func forwardedHops(req *http.Request) ([]string, bool) {
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		hops := make([]string, 0)
+		for _, element := range splitQuoted(strings.Join(values, ","), ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					node = value
+				}
+			}
+
+			hops = append(hops, parseNode(node))
+		}
+
+		return hops, len(hops) > 0
+	}
+
+	if values := req.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := make([]string, 0)
+		for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+			hops = append(hops, parseNode(hop))
+		}
+
+		return hops, true
+	}
+
+	if value := req.Header.Get("X-Real-IP"); value != "" {
+		return []string{parseNode(value)}, true
+	}
+
+	return nil, false
+}
+
+// parseNode returns the IP of a node (i.e. `192.0.2.43`, `"[2001:db8::17]:4711"`),
+// or an empty string if it is not an IP.
+func parseNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// splitQuoted splits the value by the separator, except when it is in a quoted string.
+func splitQuoted(value string, separator rune) []string {
+	parts := make([]string, 0)
+	quoted := false
+	start := 0
+	for i, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == separator && !quoted:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+// IPFilter rejects requests from client IPs that are not allowed by the
+// `[ip_filters]` of the path. This must run after RealIP.
+func IPFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		filter := internal.GlobalContainer.IPFilterFor(req.URL.Path)
+		if filter == nil || filter.Allowed(req.RemoteAddr) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+
+		res := result.Err(403, "IP_NOT_ALLOWED", fmt.Sprintf("Requests from %s are not allowed on %s.", host, req.URL.Path))
+		util.WriteJson(w, 403, res)
+	})
+}
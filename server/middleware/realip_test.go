@@ -0,0 +1,165 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	proxies, err := auth.ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal.GlobalContainer = &internal.Container{TrustedProxies: proxies}
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		client  string
+	}{
+		{
+			name:    "untrusted peer is the client",
+			remote:  "203.0.113.9:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			client:  "203.0.113.9:4000",
+		},
+		{
+			name:    "client behind a trusted proxy",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			client:  "198.51.100.1",
+		},
+		{
+			name:    "spoofed leading hops are ignored",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "127.0.0.1, 10.0.0.5, 198.51.100.1, 10.0.0.2"},
+			client:  "198.51.100.1",
+		},
+		{
+			name:    "all-trusted chain is the leftmost proxy",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			client:  "10.0.0.3",
+		},
+		{
+			name:    "malformed hop stops the walk",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, not-an-ip, 10.0.0.2"},
+			client:  "10.0.0.2",
+		},
+		{
+			name:    "malformed nearest hop keeps the peer",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, unknown"},
+			client:  "10.0.0.1:4000",
+		},
+		{
+			name:    "forwarded is preferred",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8::17]:4711"`, "X-Forwarded-For": "198.51.100.1"},
+			client:  "198.51.100.7",
+		},
+		{
+			name:    "obfuscated forwarded node",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": `for=198.51.100.7, for=_hidden`},
+			client:  "10.0.0.1:4000",
+		},
+		{
+			name:    "x-real-ip",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Real-IP": "198.51.100.3"},
+			client:  "198.51.100.3",
+		},
+		{
+			name:   "no forwarding headers",
+			remote: "10.0.0.1:4000",
+			client: "10.0.0.1:4000",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := ""
+			handler := RealIP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				client = req.RemoteAddr
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remote
+			for key, value := range test.headers {
+				req.Header.Set(key, value)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if client != test.client {
+				t.Errorf("RemoteAddr = %q, want %q", client, test.client)
+			}
+		})
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	parts := splitQuoted(`for="a,b";by=c, for=d`, ',')
+	if len(parts) != 2 || parts[0] != `for="a,b";by=c` || parts[1] != " for=d" {
+		t.Errorf("splitQuoted() = %q", parts)
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	filter, err := internal.NewIPFilter(internal.IPFilterConfig{Allow: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	internal.GlobalContainer = &internal.Container{IPFilters: map[string]*internal.IPFilter{"/admin": filter}}
+	t.Cleanup(func() { internal.GlobalContainer = nil })
+
+	handler := IPFilter(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path   string
+		remote string
+		status int
+	}{
+		{"/admin/drift", "10.1.2.3:4000", 200},
+		{"/admin/drift", "198.51.100.1:4000", 403},
+		{"/admin", "198.51.100.1", 403},
+		{"/administrator", "198.51.100.1:4000", 200},
+		{"/elastic/products", "198.51.100.1:4000", 200},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.RemoteAddr = test.remote
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s from %s: status %d, want %d", test.path, test.remote, rec.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"floofy.dev/tsubasa/internal"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// maxRequestIDLength is the longest `X-Request-Id` that is accepted from clients.
+const maxRequestIDLength = 128
+
+// RequestID uses the `X-Request-Id` header of the request, or generates one if
+// it is missing or invalid, and echoes it back in the response. The ID and a
+// logger with the `request_id` field are attached to the request context.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-Id", id)
+
+		ctx := internal.WithRequestID(req.Context(), id)
+		ctx = internal.WithLogger(ctx, logrus.WithField("request_id", id))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// validRequestID returns if the ID from a client can be used, it is only allowed
+// to have letters, digits, `-`, `_`, `.` and `:`, so it is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
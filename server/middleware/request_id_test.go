@@ -0,0 +1,79 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var generatedRequestID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		reused bool
+	}{
+		{"valid id is reused", "req-01:abc_DEF.2", true},
+		{"longest id is reused", strings.Repeat("a", maxRequestIDLength), true},
+		{"missing id is generated", "", false},
+		{"oversized id is replaced", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"id with spaces is replaced", "a b", false},
+		{"id with control characters is replaced", "abc\x1b[31m", false},
+		{"non-ascii id is replaced", "abcé", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var seen string
+			handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				seen = internal.RequestID(req.Context())
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.header != "" {
+				req.Header.Set("X-Request-Id", test.header)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			id := rec.Header().Get("X-Request-Id")
+			if id != seen {
+				t.Errorf("response has id %q, but the context has %q", id, seen)
+			}
+
+			if test.reused && id != test.header {
+				t.Errorf("id %q was replaced with %q", test.header, id)
+			}
+
+			if !test.reused && !generatedRequestID.MatchString(id) {
+				t.Errorf("id %q wasn't replaced, got %q", test.header, id)
+			}
+		})
+	}
+}
+
+func TestRequestIDsAreUnique(t *testing.T) {
+	if a, b := newRequestID(), newRequestID(); a == b {
+		t.Errorf("newRequestID() returned %q twice", a)
+	}
+}
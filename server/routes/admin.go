@@ -0,0 +1,464 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/analytics"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/eval"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/server/middleware"
+	"floofy.dev/tsubasa/util"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func NewAdminRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.Audit(auth.ActionAdmin), middleware.Idempotency, middleware.RateLimit(auth.ActionAdmin), middleware.RequireScope(auth.ActionAdmin))
+
+	elastic := internal.GlobalContainer.Elastic
+	apiKeys := internal.GlobalContainer.APIKeys
+
+	r.Get("/drift", func(w http.ResponseWriter, req *http.Request) {
+		// `?cached=true` returns the reports from the last check rather
+		// than checking every index again.
+		if req.URL.Query().Get("cached") == "true" {
+			util.WriteJson(w, 200, result.Ok(elastic.LastDriftReports()))
+			return
+		}
+
+		util.WriteJson(w, 200, result.Ok(elastic.CheckAllDrift()))
+	})
+
+	r.Get("/drift/{index}", func(w http.ResponseWriter, req *http.Request) {
+		index := chi.URLParam(req, "index")
+		if !elastic.TracksIndex(index) {
+			util.WriteJson(w, 404, result.Err(404, "UNKNOWN_INDEX", fmt.Sprintf("Index '%s' is not tracked by Tsubasa.", index)))
+			return
+		}
+
+		report, err := elastic.CheckDrift(index)
+		if err != nil {
+			util.WriteJson(w, 500, result.Err(500, "DRIFT_CHECK_FAILED", err.Error()))
+			return
+		}
+
+		util.WriteJson(w, 200, result.Ok(report))
+	})
+
+	r.Get("/pipelines", func(w http.ResponseWriter, req *http.Request) {
+		util.WriteJson(w, 200, result.Ok(elastic.Pipelines()))
+	})
+
+	r.Post("/pipelines/{id}/simulate", func(w http.ResponseWriter, req *http.Request) {
+		status, body, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+			return
+		}
+
+		docs, ok := body["data"].([]interface{})
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {data=>%v} (expected JSON array)", body["data"])))
+			return
+		}
+
+		res := elastic.SimulatePipeline(req.Context(), chi.URLParam(req, "id"), docs)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	r.Route("/slow-queries", func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if elastic.SlowQueries == nil {
+					util.WriteJson(w, 400, result.Err(400, "SLOW_QUERIES_DISABLED", "The slow query log is not enabled, define the `[slow_queries]` table to enable it."))
+					return
+				}
+
+				next.ServeHTTP(w, req)
+			})
+		})
+
+		// `?limit=` is how many shapes are returned (by default 20), and `?sort=`
+		// is "total" (the default), "count", "max" or "average".
+		r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			limit, res := queryLimit(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			sortBy := req.URL.Query().Get("sort")
+			switch sortBy {
+			case "", "total", "count", "max", "average":
+			default:
+				util.WriteJson(w, 406, result.Err(406, "INVALID_SORT", fmt.Sprintf("Sort '%s' is not one of \"total\", \"count\", \"max\" or \"average\".", sortBy)))
+				return
+			}
+
+			util.WriteJson(w, 200, result.Ok(map[string]interface{}{
+				"threshold_ms": elastic.SlowQueries.Threshold.Milliseconds(),
+				"queries":      elastic.SlowQueries.Top(limit, sortBy),
+			}))
+		})
+
+		r.Delete("/", func(w http.ResponseWriter, req *http.Request) {
+			elastic.SlowQueries.Reset()
+			util.WriteJson(w, 200, result.Success())
+		})
+	})
+
+	// Evaluates a search template against judgments, and compares it with a
+	// second one if `compare` is given.
+	r.Post("/eval", func(w http.ResponseWriter, req *http.Request) {
+		body := evalRequest{Options: eval.DefaultOptions}
+		if status, err := util.DecodeJsonBody(req, &body); err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+			return
+		}
+
+		if body.Template.Name == "" {
+			body.Template.Name = "baseline"
+		}
+
+		templates := []eval.Template{body.Template}
+		if body.Compare != nil {
+			if body.Compare.Name == "" {
+				body.Compare.Name = "candidate"
+			}
+
+			templates = append(templates, *body.Compare)
+		}
+
+		if res := validateEval(body.Judgments, templates, body.Options); res != nil {
+			util.WriteJson(w, res.StatusCode, res)
+			return
+		}
+
+		reports := make([]*eval.Report, 0, len(templates))
+		for _, template := range templates {
+			report, err := elastic.Evaluate(req.Context(), template, body.Judgments, body.Options)
+			if err != nil {
+				util.WriteJson(w, 500, result.Err(500, "EVALUATION_FAILED", fmt.Sprintf("Unable to evaluate template '%s': %v", template.Name, err)))
+				return
+			}
+
+			reports = append(reports, report)
+		}
+
+		if len(reports) == 1 {
+			util.WriteJson(w, 200, result.Ok(reports[0]))
+			return
+		}
+
+		util.WriteJson(w, 200, result.Ok(eval.Compare(reports[0], reports[1])))
+	})
+
+	r.Route("/analytics", func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if elastic.Analytics == nil {
+					util.WriteJson(w, 400, result.Err(400, "ANALYTICS_DISABLED", "Search analytics are not enabled, define the `[analytics]` table to enable them."))
+					return
+				}
+
+				next.ServeHTTP(w, req)
+			})
+		})
+
+		// Every route accepts `?window=` (by default "24h", i.e. "7d") and `?index=`
+		// to only use the searches of the last window on the index.
+		r.Get("/top-queries", func(w http.ResponseWriter, req *http.Request) {
+			filter, res := analyticsFilter(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			limit, res := queryLimit(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			queries, err := elastic.Analytics.TopQueries(req.Context(), filter, limit)
+			if err != nil {
+				util.WriteJson(w, 500, result.Err(500, "ANALYTICS_QUERY_FAILED", err.Error()))
+				return
+			}
+
+			util.WriteJson(w, 200, result.Ok(queries))
+		})
+
+		r.Get("/zero-results", func(w http.ResponseWriter, req *http.Request) {
+			filter, res := analyticsFilter(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			limit, res := queryLimit(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			queries, err := elastic.Analytics.ZeroResultQueries(req.Context(), filter, limit)
+			if err != nil {
+				util.WriteJson(w, 500, result.Err(500, "ANALYTICS_QUERY_FAILED", err.Error()))
+				return
+			}
+
+			util.WriteJson(w, 200, result.Ok(queries))
+		})
+
+		r.Get("/indices", func(w http.ResponseWriter, req *http.Request) {
+			filter, res := analyticsFilter(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			indices, err := elastic.Analytics.Indices(req.Context(), filter)
+			if err != nil {
+				util.WriteJson(w, 500, result.Err(500, "ANALYTICS_QUERY_FAILED", err.Error()))
+				return
+			}
+
+			util.WriteJson(w, 200, result.Ok(indices))
+		})
+
+		// `?interval=` is the size of the buckets, by default "1h".
+		r.Get("/trends", func(w http.ResponseWriter, req *http.Request) {
+			filter, res := analyticsFilter(req)
+			if res != nil {
+				util.WriteJson(w, res.StatusCode, res)
+				return
+			}
+
+			value := req.URL.Query().Get("interval")
+			if value == "" {
+				value = "1h"
+			}
+
+			interval, err := analytics.ParseWindow(value)
+			if err != nil || interval < time.Minute {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_INTERVAL", fmt.Sprintf("Interval '%s' is not a duration of at least a minute.", value)))
+				return
+			}
+
+			if time.Since(filter.Since)/interval > maxTrendBuckets {
+				util.WriteJson(w, 406, result.Err(406, "TOO_MANY_BUCKETS", fmt.Sprintf("Interval '%s' is too small for the window, at most %d buckets are returned.", value, maxTrendBuckets)))
+				return
+			}
+
+			buckets, err := elastic.Analytics.Trends(req.Context(), filter, interval)
+			if err != nil {
+				util.WriteJson(w, 500, result.Err(500, "ANALYTICS_QUERY_FAILED", err.Error()))
+				return
+			}
+
+			util.WriteJson(w, 200, result.Ok(buckets))
+		})
+	})
+
+	r.Route("/keys", func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if apiKeys == nil {
+					util.WriteJson(w, 400, result.Err(400, "API_KEYS_DISABLED", "API keys are not enabled, set `auth.api_keys_path` to enable them."))
+					return
+				}
+
+				next.ServeHTTP(w, req)
+			})
+		})
+
+		r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+			keys := apiKeys.List()
+			data := make([]map[string]interface{}, 0, len(keys))
+			for _, key := range keys {
+				data = append(data, apiKeyInfo(key))
+			}
+
+			util.WriteJson(w, 200, result.Ok(data))
+		})
+
+		r.Post("/", func(w http.ResponseWriter, req *http.Request) {
+			status, body, err := util.GetJsonBody(req)
+			if err != nil {
+				util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+				return
+			}
+
+			name, ok := body["name"].(string)
+			if !ok {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {name=>%v} (expected string)", body["name"])))
+				return
+			}
+
+			rawScopes, ok := body["scopes"].([]interface{})
+			if !ok {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {scopes=>%v} (expected string array)", body["scopes"])))
+				return
+			}
+
+			scopes := make([]string, 0, len(rawScopes))
+			for _, raw := range rawScopes {
+				scope, ok := raw.(string)
+				if !ok {
+					util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {scopes=>%v} (expected string array)", body["scopes"])))
+					return
+				}
+
+				scopes = append(scopes, scope)
+			}
+
+			filters := make([]map[string]interface{}, 0)
+			if rawFilters, ok := body["filters"]; ok {
+				list, ok := rawFilters.([]interface{})
+				if !ok {
+					util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {filters=>%v} (expected object array)", rawFilters)))
+					return
+				}
+
+				for _, raw := range list {
+					filter, ok := raw.(map[string]interface{})
+					if !ok {
+						util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {filters=>%v} (expected object array)", rawFilters)))
+						return
+					}
+
+					filters = append(filters, filter)
+				}
+			}
+
+			key, token, err := apiKeys.Create(name, scopes, filters)
+			if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_API_KEY", err.Error()))
+				return
+			}
+
+			data := apiKeyInfo(*key)
+			data["token"] = token
+
+			util.WriteJson(w, 201, result.OkWithStatus(201, data))
+		})
+
+		r.Delete("/{id}", func(w http.ResponseWriter, req *http.Request) {
+			id := chi.URLParam(req, "id")
+			if err := apiKeys.Revoke(id); err != nil {
+				if err == auth.ErrUnknownAPIKey {
+					util.WriteJson(w, 404, result.Err(404, "UNKNOWN_API_KEY", fmt.Sprintf("API key '%s' does not exist.", id)))
+					return
+				}
+
+				util.WriteJson(w, 500, result.Err(500, "INTERNAL_SERVER_ERROR", err.Error()))
+				return
+			}
+
+			util.WriteJson(w, 200, result.Success())
+		})
+	})
+
+	return r
+}
+
+// evalRequest is the body of `/admin/eval`.
+type evalRequest struct {
+	eval.Options
+	Judgments eval.Judgments `json:"judgments"`
+	Template  eval.Template  `json:"template"`
+	Compare   *eval.Template `json:"compare,omitempty"`
+}
+
+// maxEvalQueries is the most queries that `/admin/eval` evaluates at once.
+const maxEvalQueries = 1000
+
+// validateEval checks the body of `/admin/eval` before anything is searched.
+func validateEval(judgments eval.Judgments, templates []eval.Template, options eval.Options) *result.Result {
+	if err := judgments.Validate(); err != nil {
+		return result.Err(406, "INVALID_JUDGMENTS", fmt.Sprintf("Invalid judgments: %v.", err))
+	}
+
+	if len(judgments) > maxEvalQueries {
+		return result.Err(406, "TOO_MANY_QUERIES", fmt.Sprintf("Judgments have %d queries, at most %d are evaluated at once.", len(judgments), maxEvalQueries))
+	}
+
+	for _, template := range templates {
+		if err := template.Validate(); err != nil {
+			return result.Err(406, "INVALID_TEMPLATE", fmt.Sprintf("Invalid template '%s': %v.", template.Name, err))
+		}
+	}
+
+	if options.K < 1 {
+		return result.Err(406, "INVALID_K", fmt.Sprintf("K '%d' is not a positive number.", options.K))
+	}
+
+	return nil
+}
+
+// maxTrendBuckets is the most buckets that `/admin/analytics/trends` returns.
+const maxTrendBuckets = 1000
+
+// queryLimit returns the `?limit=` of the request, by default it is 20.
+func queryLimit(req *http.Request) (int, *result.Result) {
+	value := req.URL.Query().Get("limit")
+	if value == "" {
+		return 20, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, result.Err(406, "INVALID_LIMIT", fmt.Sprintf("Limit '%s' is not a positive number.", value))
+	}
+
+	return limit, nil
+}
+
+// analyticsFilter returns the filter of the `?window=` and `?index=` of the request.
+func analyticsFilter(req *http.Request) (analytics.Filter, *result.Result) {
+	value := req.URL.Query().Get("window")
+	if value == "" {
+		value = "24h"
+	}
+
+	window, err := analytics.ParseWindow(value)
+	if err != nil || window <= 0 {
+		return analytics.Filter{}, result.Err(406, "INVALID_WINDOW", fmt.Sprintf("Window '%s' is not a positive duration (i.e. \"24h\" or \"7d\").", value))
+	}
+
+	return analytics.Filter{
+		Index: req.URL.Query().Get("index"),
+		Since: time.Now().Add(-window),
+	}, nil
+}
+
+// apiKeyInfo returns the public information of an API key, without its hash.
+func apiKeyInfo(key auth.APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         key.ID,
+		"name":       key.Name,
+		"scopes":     key.Scopes,
+		"filters":    key.Filters,
+		"created_at": key.CreatedAt,
+	}
+}
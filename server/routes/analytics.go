@@ -0,0 +1,127 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routes
+
+import (
+	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/analytics"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/server/middleware"
+	"floofy.dev/tsubasa/util"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"math"
+	"net/http"
+)
+
+func NewAnalyticsRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(middleware.Idempotency, middleware.RateLimit(auth.ActionSearch))
+
+	elastic := internal.GlobalContainer.Elastic
+
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if elastic.Analytics == nil {
+				util.WriteJson(w, 400, result.Err(400, "ANALYTICS_DISABLED", "Search analytics are not enabled, define the `[analytics]` table to enable them."))
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	})
+
+	r.Post("/click", feedbackHandler(elastic, analytics.FeedbackClick))
+	r.Post("/conversion", feedbackHandler(elastic, analytics.FeedbackConversion))
+
+	return r
+}
+
+// feedbackHandler records feedback on a result of a search, from a body like
+// `{"query_id": "...", "document_id": "...", "position": 1}`. The principal must
+// be able to search the index that the search was on.
+func feedbackHandler(elastic *internal.ElasticService, feedbackType analytics.FeedbackType) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		status, body, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+			return
+		}
+
+		queryID, ok := body["query_id"].(string)
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {query_id=>%v} (expected string)", body["query_id"])))
+			return
+		}
+
+		documentID, ok := body["document_id"].(string)
+		if !ok || documentID == "" || len(documentID) > 512 {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {document_id=>%v} (expected string of 1 to 512 bytes)", body["document_id"])))
+			return
+		}
+
+		position, ok := body["position"].(float64)
+		if !ok || position < 1 || position != math.Trunc(position) {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {position=>%v} (expected positive integer)", body["position"])))
+			return
+		}
+
+		unknown := result.Err(404, "UNKNOWN_QUERY", fmt.Sprintf("Query '%s' is unknown or past the analytics retention.", queryID))
+		if !analytics.ValidQueryID(queryID) {
+			util.WriteJson(w, 404, unknown)
+			return
+		}
+
+		event, err := elastic.Analytics.Event(req.Context(), queryID)
+		if err == analytics.ErrUnknownQuery {
+			util.WriteJson(w, 404, unknown)
+			return
+		}
+
+		if err != nil {
+			util.WriteJson(w, 500, result.Err(500, "ANALYTICS_QUERY_FAILED", err.Error()))
+			return
+		}
+
+		// Searches on other indices are reported as unknown, so their query IDs
+		// don't leak.
+		principal := auth.PrincipalFromContext(req.Context())
+		if principal == nil || !principal.Can(auth.ActionSearch, event.Index) {
+			util.WriteJson(w, 404, unknown)
+			return
+		}
+
+		err = elastic.Analytics.RecordFeedback(req.Context(), analytics.Feedback{
+			QueryID:    queryID,
+			DocumentID: documentID,
+			Type:       feedbackType,
+			Position:   int(position),
+		})
+
+		if err == analytics.ErrUnknownQuery {
+			util.WriteJson(w, 404, unknown)
+			return
+		}
+
+		if err != nil {
+			util.WriteJson(w, 500, result.Err(500, "ANALYTICS_FEEDBACK_FAILED", err.Error()))
+			return
+		}
+
+		util.WriteJson(w, 200, result.Success())
+	}
+}
@@ -16,11 +16,15 @@
 package routes
 
 import (
+	"encoding/json"
 	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
 	"floofy.dev/tsubasa/internal/result"
+	"floofy.dev/tsubasa/server/middleware"
 	"floofy.dev/tsubasa/util"
 	"fmt"
 	"github.com/go-chi/chi/v5"
+	"io"
 	"net/http"
 )
 
@@ -28,14 +32,18 @@ func NewElasticRouter() chi.Router {
 	r := chi.NewRouter()
 	elastic := internal.GlobalContainer.Elastic
 
-	r.Get("/{index}", func(w http.ResponseWriter, req *http.Request) {
+	// Audit is outermost, so rate limited requests and replayed responses are audited too.
+	search := r.With(middleware.Audit(auth.ActionSearch), middleware.Idempotency, middleware.RateLimit(auth.ActionSearch), middleware.RequireScope(auth.ActionSearch), middleware.Visitor)
+	write := r.With(middleware.Audit(auth.ActionWrite), middleware.Idempotency, middleware.RateLimit(auth.ActionWrite), middleware.RequireScope(auth.ActionWrite))
+
+	search.Get("/{index}", func(w http.ResponseWriter, req *http.Request) {
 		exists := elastic.IndexExists(chi.URLParam(req, "id"))
 		util.WriteJson(w, 200, result.Ok(map[string]interface{}{
 			"exists": exists,
 		}))
 	})
 
-	r.Post("/{index}/search", func(w http.ResponseWriter, req *http.Request) {
+	search.Post("/{index}/search", func(w http.ResponseWriter, req *http.Request) {
 		status, body, err := util.GetJsonBody(req)
 		if err != nil {
 			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
@@ -55,11 +63,11 @@ func NewElasticRouter() chi.Router {
 			return
 		}
 
-		res := elastic.SearchInIndex(index, matchType, data)
+		res := elastic.SearchInIndex(req.Context(), index, matchType, data)
 		util.WriteJson(w, res.StatusCode, res)
 	})
 
-	r.Post("/{index}/raw", func(w http.ResponseWriter, req *http.Request) {
+	search.Post("/{index}/raw", func(w http.ResponseWriter, req *http.Request) {
 		status, body, err := util.GetJsonBody(req)
 		if err != nil {
 			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
@@ -73,9 +81,161 @@ func NewElasticRouter() chi.Router {
 			return
 		}
 
-		res := elastic.SearchRaw(index, data)
+		res := elastic.SearchRaw(req.Context(), index, data)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	write.Post("/{index}/documents", func(w http.ResponseWriter, req *http.Request) {
+		status, body, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+			return
+		}
+
+		data, ok := body["data"].(map[string]interface{})
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {data=>%v} (expected JSON object)", body["data"])))
+			return
+		}
+
+		options, invalid := writeOptions(req)
+		if invalid != nil {
+			util.WriteJson(w, invalid.StatusCode, invalid)
+			return
+		}
+
+		res := elastic.IndexDocument(req.Context(), chi.URLParam(req, "index"), "", data, options)
+		writeDocumentResult(w, res)
+	})
+
+	search.Get("/{index}/documents/{id}", func(w http.ResponseWriter, req *http.Request) {
+		res := elastic.GetDocument(req.Context(), chi.URLParam(req, "index"), chi.URLParam(req, "id"))
+		writeDocumentResult(w, res)
+	})
+
+	write.Put("/{index}/documents/{id}", func(w http.ResponseWriter, req *http.Request) {
+		status, body, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+			return
+		}
+
+		data, ok := body["data"].(map[string]interface{})
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {data=>%v} (expected JSON object)", body["data"])))
+			return
+		}
+
+		options, invalid := writeOptions(req)
+		if invalid != nil {
+			util.WriteJson(w, invalid.StatusCode, invalid)
+			return
+		}
+
+		res := elastic.IndexDocument(req.Context(), chi.URLParam(req, "index"), chi.URLParam(req, "id"), data, options)
+		writeDocumentResult(w, res)
+	})
+
+	write.Post("/{index}/bulk", func(w http.ResponseWriter, req *http.Request) {
+		status, body, err := util.GetJsonBody(req)
+		if err != nil {
+			util.WriteJson(w, status, result.Err(status, "INVALID_JSON_BODY", err.Error()))
+			return
+		}
+
+		rawDocs, ok := body["data"].([]interface{})
+		if !ok {
+			util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {data=>%v} (expected JSON array)", body["data"])))
+			return
+		}
+
+		docs := make([]map[string]interface{}, 0, len(rawDocs))
+		for i, raw := range rawDocs {
+			doc, ok := raw.(map[string]interface{})
+			if !ok {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {data[%d]=>%v} (expected JSON object)", i, raw)))
+				return
+			}
+
+			docs = append(docs, doc)
+		}
+
+		idField := ""
+		if raw, ok := body["id_field"]; ok {
+			idField, ok = raw.(string)
+			if !ok {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_DATA_TYPE", fmt.Sprintf("Invalid data type on {id_field=>%v} (expected string)", raw)))
+				return
+			}
+		}
+
+		options, invalid := writeOptions(req)
+		if invalid != nil {
+			util.WriteJson(w, invalid.StatusCode, invalid)
+			return
+		}
+
+		res := elastic.BulkIndex(req.Context(), chi.URLParam(req, "index"), idField, docs, options)
+		util.WriteJson(w, res.StatusCode, res)
+	})
+
+	// Imports take newline-delimited JSON documents, so exports from other systems
+	// can be sent as-is. They go through the same validation as bulk writes.
+	write.Post("/{index}/import", func(w http.ResponseWriter, req *http.Request) {
+		docs := make([]map[string]interface{}, 0)
+		decoder := json.NewDecoder(req.Body)
+		for {
+			var doc map[string]interface{}
+			if err := decoder.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				util.WriteJson(w, 406, result.Err(406, "INVALID_JSON_BODY", fmt.Sprintf("Document [%d] isn't a JSON object: %s", len(docs), err)))
+				return
+			}
+
+			docs = append(docs, doc)
+		}
+
+		options, invalid := writeOptions(req)
+		if invalid != nil {
+			util.WriteJson(w, invalid.StatusCode, invalid)
+			return
+		}
+
+		res := elastic.BulkIndex(req.Context(), chi.URLParam(req, "index"), req.URL.Query().Get("id_field"), docs, options)
 		util.WriteJson(w, res.StatusCode, res)
 	})
 
 	return r
 }
+
+// writeOptions returns the internal.WriteOptions from the query parameters and
+// precondition headers of a write request, or a Result if they are invalid.
+func writeOptions(req *http.Request) (internal.WriteOptions, *result.Result) {
+	options := internal.WriteOptions{
+		Pipeline:   req.URL.Query().Get("pipeline"),
+		CreateOnly: req.Header.Get("If-None-Match") == "*",
+	}
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		version, err := internal.ParseDocumentVersion(ifMatch)
+		if err != nil {
+			return options, result.Err(400, "INVALID_IF_MATCH", fmt.Sprintf("Header If-Match must be an ETag from a previous response: %s", err))
+		}
+
+		options.IfMatch = version
+	}
+
+	return options, nil
+}
+
+// writeDocumentResult writes the Result of a document endpoint with its ETag header.
+func writeDocumentResult(w http.ResponseWriter, res *result.Result) {
+	if data, ok := res.Data.(map[string]interface{}); ok {
+		if etag, ok := data["etag"].(string); ok && etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+	}
+
+	util.WriteJson(w, res.StatusCode, res)
+}
@@ -18,6 +18,8 @@ package server
 import (
 	"context"
 	"floofy.dev/tsubasa/internal"
+	"floofy.dev/tsubasa/internal/auth"
+	"floofy.dev/tsubasa/internal/metrics"
 	"floofy.dev/tsubasa/internal/result"
 	"floofy.dev/tsubasa/server/middleware"
 	"floofy.dev/tsubasa/server/routes"
@@ -54,15 +56,34 @@ func Start(config *internal.Config) error {
 	})
 
 	// Define middleware and routing here
-	router.Use(chim.RealIP)
+	router.Use(middleware.PeerAddress)
+	router.Use(middleware.RequestID)
+	router.Use(middleware.Metrics)
+	router.Use(middleware.RealIP)
+	router.Use(middleware.IPFilter)
+	router.Use(middleware.Tracing)
 	router.Use(chim.GetHead)
 	router.Use(middleware.Logging)
 	router.Use(middleware.Headers)
-	router.Use(middleware.BasicAuth)
+	router.Use(middleware.CORS)
+	router.Use(middleware.Auth)
 	router.Use(middleware.ErrorHandling)
 	router.Mount("/", routes.NewMainRouter())
 	router.Mount("/health", routes.NewHealthRouter())
 	router.Mount("/elastic", routes.NewElasticRouter())
+	router.Mount("/admin", routes.NewAdminRouter())
+	router.Mount("/analytics", routes.NewAnalyticsRouter())
+
+	metrics.SetBuildInfo(internal.Version, internal.CommitSHA, internal.BuildDate)
+
+	var metricsServer *http.Server
+	if config.Metrics != nil {
+		if config.Metrics.Port != nil {
+			metricsServer = newMetricsServer(config)
+		} else {
+			router.With(middleware.RequireScope(auth.ActionAdmin)).Handle("/metrics", metrics.Handler())
+		}
+	}
 
 	port := 23145
 	if container.Config.Port != nil {
@@ -82,17 +103,44 @@ func Start(config *internal.Config) error {
 		ReadTimeout:  30 * time.Second,
 	}
 
+	if config.TLS != nil {
+		tlsConfig, err := newTLSConfig(config.TLS)
+		if err != nil {
+			return err
+		}
+
+		server.TLSConfig = tlsConfig
+	}
+
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		logrus.Infof("Tsubasa is now listening under address => %s", address)
-		err := server.ListenAndServe()
+		var err error
+		if server.TLSConfig != nil {
+			logrus.Infof("Tsubasa is now listening under address => %s (TLS)", address)
+
+			// The certificate comes from TLSConfig.GetCertificate.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			logrus.Infof("Tsubasa is now listening under address => %s", address)
+			err = server.ListenAndServe()
+		}
+
 		if err != nil && err != http.ErrServerClosed {
 			logrus.Errorf("Unable to run HTTP server: %s", err)
 		}
 	}()
 
+	if metricsServer != nil {
+		go func() {
+			logrus.Infof("Metrics are now served under address => %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.Errorf("Unable to run metrics server: %s", err)
+			}
+		}()
+	}
+
 	<-sigint
 
 	logrus.Warn("Shutting down HTTP server...")
@@ -107,9 +155,65 @@ func Start(config *internal.Config) error {
 
 	defer cancel()
 
+	if container.Elastic.Analytics != nil {
+		defer func() {
+			if err := container.Elastic.Analytics.Close(); err != nil {
+				logrus.Errorf("Unable to close search analytics: %v", err)
+			}
+		}()
+	}
+
+	if container.Audit != nil {
+		defer func() {
+			if err := container.Audit.Close(); err != nil {
+				logrus.Errorf("Unable to close audit log: %v", err)
+			}
+		}()
+	}
+
+	if container.Tracing != nil {
+		defer func() {
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := container.Tracing.Shutdown(flushCtx); err != nil {
+				logrus.Errorf("Unable to flush traces: %v", err)
+			}
+		}()
+	}
+
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			logrus.Errorf("Unable to shut down metrics server: %v", err)
+		}
+	}
+
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		return err
 	} else {
 		return nil
 	}
 }
+
+// newMetricsServer creates the server of the separate metrics port, which only
+// serves `/metrics`.
+func newMetricsServer(config *internal.Config) *http.Server {
+	host := "0.0.0.0"
+	if config.Host != nil {
+		host = *config.Host
+	}
+
+	if config.Metrics.Host != nil {
+		host = *config.Metrics.Host
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	return &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", host, *config.Metrics.Port),
+		Handler:      mux,
+		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  30 * time.Second,
+	}
+}
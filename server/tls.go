@@ -0,0 +1,164 @@
+// 🐇 tsubasa: Microservice to define a schema and execute it in a fast environment.
+// Copyright 2022 Noel <cutie@floofy.dev>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"floofy.dev/tsubasa/internal"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateReloader loads the certificate and key, and loads them again when
+// either file changes. The files are checked at most every 5 seconds.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	lastCheck   time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certificateReloader) load() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *certificateReloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{r.certFile, r.keyFile} {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+
+		if stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	check := time.Since(r.lastCheck) > 5*time.Second
+	if check {
+		r.lastCheck = time.Now()
+	}
+	r.mu.Unlock()
+
+	if check {
+		if modTime, err := r.latestModTime(); err == nil && !modTime.Equal(r.modTime) {
+			logrus.Info("TLS certificate has changed, now reloading...")
+
+			// The old certificate is kept if the new one can't be loaded, i.e.
+			// when only one of the files was replaced so far.
+			if err := r.load(); err != nil {
+				logrus.Errorf("Unable to reload TLS certificate: %v", err)
+			}
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.certificate, nil
+}
+
+// newTLSConfig creates the tls.Config from the `[tls]` table.
+func newTLSConfig(config *internal.TLSConfig) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("`tls.cert_file` and `tls.key_file` are required")
+	}
+
+	reloader, err := newCertificateReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.MinVersion != nil {
+		switch *config.MinVersion {
+		case "1.2":
+			tlsConfig.MinVersion = tls.VersionTLS12
+
+		case "1.3":
+			tlsConfig.MinVersion = tls.VersionTLS13
+
+		default:
+			return nil, fmt.Errorf("invalid `tls.min_version` %q (expected \"1.2\" or \"1.3\")", *config.MinVersion)
+		}
+	}
+
+	if config.ClientCAFile != nil {
+		contents, err := ioutil.ReadFile(*config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA bundle: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("client CA bundle %s has no PEM certificates", *config.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.RequireClientCert {
+		return nil, errors.New("`tls.require_client_cert` requires `tls.client_ca_file`")
+	}
+
+	return tlsConfig, nil
+}
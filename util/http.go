@@ -18,6 +18,7 @@ package util
 import (
 	"encoding/json"
 	"errors"
+	"floofy.dev/tsubasa/internal/result"
 	"fmt"
 	"net/http"
 )
@@ -109,6 +110,11 @@ func GetStatusCode(code int) string {
 
 // WriteJson is a simple utility function to write data into JSON.
 func WriteJson(w http.ResponseWriter, status int, data interface{}) {
+	// Errors have the request ID, so they can be found in the server logs.
+	if res, ok := data.(*result.Result); ok && !res.Success && res.RequestID == "" {
+		res.RequestID = w.Header().Get("X-Request-Id")
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(status)
 
@@ -120,25 +126,35 @@ func WriteJson(w http.ResponseWriter, status int, data interface{}) {
 // GetJsonBody is a simple utility function to retrieve this http.Request's
 // body as a JSON object.
 func GetJsonBody(req *http.Request) (int, map[string]interface{}, error) {
+	var data map[string]interface{}
+	if status, err := DecodeJsonBody(req, &data); err != nil {
+		return status, nil, err
+	}
+
+	return -1, data, nil
+}
+
+// DecodeJsonBody decodes this http.Request's body into the value, which can't
+// have fields that the value doesn't have.
+func DecodeJsonBody(req *http.Request, value interface{}) (int, error) {
 	contentType := req.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		return http.StatusUnsupportedMediaType, nil, fmt.Errorf("content type was not application/json, received %s", contentType)
+		return http.StatusUnsupportedMediaType, fmt.Errorf("content type was not application/json, received %s", contentType)
 	}
 
-	var data map[string]interface{}
 	var unmarshalErr *json.UnmarshalTypeError
 
 	decoder := json.NewDecoder(req.Body)
 	decoder.DisallowUnknownFields()
 
-	err := decoder.Decode(&data)
+	err := decoder.Decode(value)
 	if err != nil {
 		if errors.As(err, &unmarshalErr) {
-			return 406, nil, fmt.Errorf("wrong type provided for field '%s'", unmarshalErr.Field)
+			return 406, fmt.Errorf("wrong type provided for field '%s'", unmarshalErr.Field)
 		} else {
-			return 400, nil, err
+			return 400, err
 		}
 	}
 
-	return -1, data, nil
+	return -1, nil
 }